@@ -0,0 +1,164 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Действия, записываемые в журнал изменений.
+const (
+	AuditCreate = "create" // создание описания
+	AuditUpdate = "update" // изменение описания
+	AuditDelete = "delete" // удаление описания
+)
+
+// CollectionAudit задает название коллекции, в которую записывает журнал
+// изменений MongoAuditSink.
+var CollectionAudit = "audit"
+
+// AuditEntry описывает запись журнала изменений.
+type AuditEntry struct {
+	// кто выполнил изменение (см. WithActor); пусто, если не известно
+	Actor string `bson:"actor,omitempty" json:"actor,omitempty"`
+	// действие: AuditCreate, AuditUpdate или AuditDelete
+	Action string `bson:"action" json:"action"`
+	// название измененной коллекции
+	Collection string `bson:"collection" json:"collection"`
+	// идентификатор измененного описания; пусто для записи о пакетном
+	// изменении (см. Count)
+	TargetID string `bson:"targetId" json:"targetId"`
+	// количество описаний, затронутых пакетным изменением, идентификаторы
+	// которых не известны, например, при удалении устаревших событий; для
+	// записи об изменении одного описания не задано
+	Count int `bson:"count,omitempty" json:"count,omitempty"`
+	// идентификатор группы, если известен
+	GroupID string `bson:"groupId,omitempty" json:"group,omitempty"`
+	// время изменения
+	Time time.Time `bson:"time" json:"time"`
+}
+
+// AuditSink получает записи журнала изменений. Метод Audit вызывается после
+// каждого успешного изменения данных синхронно, поэтому он должен работать
+// быстро. Ошибки записи журнала не влияют на результат изменения данных,
+// поэтому AuditSink должен обрабатывать их самостоятельно.
+//
+// В журнал попадают изменения, выполненные методами Create, Update, Upsert и
+// Delete пользователей, устройств, мест и событий, а также изменения
+// отдельных полей: имени, пароля и группы пользователей и устройств (включая
+// Devices.ResetAllPasswords), имени места, Events.Patch, Events.SoftDelete,
+// Events.CreateEvaluate и Devices.DeleteWithEvents. При переносе
+// пользователя или устройства в другую группу запись делается для обеих
+// групп.
+//
+// Пакетные и служебные операции также записываются в журнал. Для пакетной
+// вставки (Events.BulkCreate, Events.ImportGPX, Places.BulkCreate) и
+// Places.ReindexGeometry запись делается для каждого сохраненного описания.
+// Для удаления описаний по условию (DB.DeleteGroup, Events.DeleteOlderThan,
+// Events.DeletePurgeForDevice, Events.Dedupe, Events.Downsample, удаление
+// событий в Devices.DeleteWithEvents) и для DB.MigrateFieldNames делается одна
+// запись на коллекцию с количеством удаленных или измененных описаний в поле
+// Count, если оно не равно нулю.
+//
+// Журнал не защищен от изменений: записи не подписываются и не связываются
+// друг с другом, поэтому подмену или удаление записи обнаружить нельзя.
+type AuditSink interface {
+	Audit(ctx context.Context, entry *AuditEntry)
+}
+
+// NoAudit не записывает журнал изменений. Используется по умолчанию.
+var NoAudit AuditSink = noAudit{}
+
+type noAudit struct{}
+
+func (noAudit) Audit(context.Context, *AuditEntry) {}
+
+// SetAuditSink задает получателя журнала изменений для всех последующих
+// изменений данных через это описание хранилища. Значение nil отключает
+// журнал так же, как NoAudit. Метод должен вызываться при инициализации, до
+// начала работы с данными.
+func (db *DB) SetAuditSink(sink AuditSink) {
+	db.auditSink = sink
+}
+
+// actorKey используется как ключ контекста для хранения автора изменений.
+type actorKey struct{}
+
+// WithActor возвращает контекст, в котором сохранен автор изменений, например,
+// логин пользователя, выполняющего запрос. Изменения, выполненные методами
+// с этим контекстом, записываются в журнал от его имени.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext возвращает автора изменений, сохраненного в контексте с
+// помощью WithActor, или пустую строку.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// audit записывает в журнал изменение описаний с указанными идентификаторами.
+func (db *DB) audit(ctx context.Context, action, collection, groupId string, ids ...string) {
+	if db.auditSink == nil {
+		return
+	}
+	actor, now := ActorFromContext(ctx), time.Now().UTC()
+	for _, id := range ids {
+		db.auditSink.Audit(ctx, &AuditEntry{
+			Actor:      actor,
+			Action:     action,
+			Collection: collection,
+			TargetID:   id,
+			GroupID:    groupId,
+			Time:       now,
+		})
+	}
+}
+
+// auditCount записывает в журнал одну запись о пакетном изменении count
+// описаний коллекции. Если count равен нулю, то ничего не записывается.
+func (db *DB) auditCount(ctx context.Context, action, collection, groupId string, count int) {
+	if db.auditSink == nil || count == 0 {
+		return
+	}
+	db.auditSink.Audit(ctx, &AuditEntry{
+		Actor:      ActorFromContext(ctx),
+		Action:     action,
+		Collection: collection,
+		GroupID:    groupId,
+		Count:      count,
+		Time:       time.Now().UTC(),
+	})
+}
+
+// MongoAuditSink записывает журнал изменений в коллекцию CollectionAudit
+// хранилища MongoDB. Записи только добавляются и никогда не изменяются этой
+// библиотекой, но защиты от их изменения или удаления другими средствами
+// MongoAuditSink не обеспечивает. Чтобы ограничить такую возможность, задайте
+// пользователю, от имени которого работает приложение, права только на
+// вставку в эту коллекцию.
+type MongoAuditSink struct {
+	db *DB
+	// вызывается, если запись в журнал не удалась; если не задана, то
+	// ошибки игнорируются
+	OnError func(entry *AuditEntry, err error)
+}
+
+// NewMongoAuditSink возвращает получателя журнала изменений, записывающего его
+// в коллекцию CollectionAudit хранилища db.
+func NewMongoAuditSink(db *DB) *MongoAuditSink {
+	return &MongoAuditSink{db: db}
+}
+
+// Audit записывает запись журнала в хранилище. Запись выполняется, даже если
+// контекст изменения уже отменен: само изменение к этому моменту сохранено.
+func (s *MongoAuditSink) Audit(ctx context.Context, entry *AuditEntry) {
+	err := s.db.exec(context.Background(), CollectionAudit, func(coll *mgo.Collection) error {
+		return coll.Insert(entry)
+	})
+	if err != nil && s.OnError != nil {
+		s.OnError(entry, err)
+	}
+}
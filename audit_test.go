@@ -0,0 +1,211 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// auditRecorder запоминает все записи журнала изменений.
+type auditRecorder []*AuditEntry
+
+func (r *auditRecorder) Audit(ctx context.Context, entry *AuditEntry) {
+	*r = append(*r, entry)
+}
+
+func TestActorFromContext(t *testing.T) {
+	if actor := ActorFromContext(context.Background()); actor != "" {
+		t.Errorf("unexpected actor: %q", actor)
+	}
+	ctx := WithActor(context.Background(), "admin")
+	if actor := ActorFromContext(ctx); actor != "admin" {
+		t.Errorf("unexpected actor: %q", actor)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	var entries auditRecorder
+	db.SetAuditSink(&entries)
+	ctx := WithActor(context.Background(), "admin")
+	devices := db.Devices()
+	device := &Device{ID: "device"}
+	if err := devices.CreateContext(ctx, "group", device); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.UpdateContext(ctx, "group", device); err != nil {
+		t.Fatal(err)
+	}
+	// неудачные изменения в журнал не попадают
+	if err := devices.DeleteContext(ctx, "other", "device"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := devices.Delete("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []AuditEntry{
+		{Actor: "admin", Action: AuditCreate},
+		{Actor: "admin", Action: AuditUpdate},
+		{Action: AuditDelete},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Actor != expected[i].Actor || entry.Action != expected[i].Action ||
+			entry.Collection != CollectionDevices || entry.TargetID != "device" ||
+			entry.GroupID != "group" || entry.Time.IsZero() {
+			t.Errorf("unexpected entry %d: %#v", i, entry)
+		}
+	}
+}
+
+func TestMongoAuditSink(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	db.SetAuditSink(NewMongoAuditSink(db))
+	ctx := WithActor(context.Background(), "admin")
+	events := []*Event{new(Event), new(Event)}
+	if err := db.Events().CreateContext(ctx, "group", "device", events...); err != nil {
+		t.Fatal(err)
+	}
+	var stored []AuditEntry
+	err := db.session.DB(db.name).C(CollectionAudit).Find(nil).Sort("targetId").All(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("unexpected entries: %v", stored)
+	}
+	for _, entry := range stored {
+		if entry.Actor != "admin" || entry.Action != AuditCreate ||
+			entry.Collection != CollectionEvents || entry.GroupID != "group" {
+			t.Errorf("unexpected entry: %#v", entry)
+		}
+	}
+}
+
+func TestAuditFieldChanges(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	passwd, err := NewPassword("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, devices, events, places := db.Users(), db.Devices(), db.Events(), db.Places()
+	if err := users.Create(&User{Login: "login", GroupID: "group", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	event := new(Event)
+	if err := events.Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	if err := places.Create("group", &Place{ID: "place", Circle: &circle}); err != nil {
+		t.Fatal(err)
+	}
+	var entries auditRecorder
+	db.SetAuditSink(&entries)
+	for i, change := range []func() error{
+		func() error { return users.SetName("login", "Name") },
+		func() error { return users.ChangePassword("login", "old", "new") },
+		func() error { return users.ChangeGroup("login", "other") },
+		func() error { return users.Delete("login") },
+		func() error { return devices.Rename("group", "device", "Name") },
+		func() error { return devices.SetPassword("group", "device", "password") },
+		func() error { _, err := devices.ResetAllPasswords("group"); return err },
+		func() error { return devices.ChangeGroup("group", "device", "other") },
+		func() error { return events.Patch("group", "device", event.ID.Hex(), bson.M{"comment": "x"}) },
+		func() error { return places.Rename("group", "place", "Home") },
+	} {
+		if err := change(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	// неудачные изменения в журнал не попадают
+	if err := users.SetName("unknown", "Name"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.Delete("login"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := places.Rename("other", "place", "Home"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []AuditEntry{
+		{Action: AuditUpdate, Collection: CollectionUsers, GroupID: "group", TargetID: "login"},
+		{Action: AuditUpdate, Collection: CollectionUsers, GroupID: "group", TargetID: "login"},
+		{Action: AuditUpdate, Collection: CollectionUsers, GroupID: "group", TargetID: "login"},
+		{Action: AuditUpdate, Collection: CollectionUsers, GroupID: "other", TargetID: "login"},
+		{Action: AuditDelete, Collection: CollectionUsers, GroupID: "other", TargetID: "login"},
+		{Action: AuditUpdate, Collection: CollectionDevices, GroupID: "group", TargetID: "device"},
+		{Action: AuditUpdate, Collection: CollectionDevices, GroupID: "group", TargetID: "device"},
+		{Action: AuditUpdate, Collection: CollectionDevices, GroupID: "group", TargetID: "device"},
+		{Action: AuditUpdate, Collection: CollectionDevices, GroupID: "group", TargetID: "device"},
+		{Action: AuditUpdate, Collection: CollectionDevices, GroupID: "other", TargetID: "device"},
+		{Action: AuditUpdate, Collection: CollectionEvents, GroupID: "group", TargetID: event.ID.Hex()},
+		{Action: AuditUpdate, Collection: CollectionPlaces, GroupID: "group", TargetID: "place"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	for i, entry := range entries {
+		entry.Time = expected[i].Time
+		if *entry != expected[i] {
+			t.Errorf("unexpected entry %d: %#v", i, entry)
+		}
+	}
+}
+
+func TestAuditBulk(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	var entries auditRecorder
+	db.SetAuditSink(&entries)
+	events, places := db.Events(), db.Places()
+	now := time.Now().UTC()
+	list := []*Event{{Time: now.Add(-2 * time.Hour)}, {Time: now.Add(-time.Hour)}, {Time: now}}
+	if _, err := events.BulkCreate("group", "device", true, list...); err != nil {
+		t.Fatal(err)
+	}
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	errs, err := places.BulkCreate("group", []*Place{{ID: "place", Circle: &circle}, {ID: "bad"}})
+	if err != nil || errs[0] != nil || errs[1] == nil {
+		t.Fatalf("unexpected result: %v, %v", errs, err)
+	}
+	if _, err := events.DeleteOlderThan("group", now.Add(-90*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// удаление без результата в журнал не попадает
+	if _, err := events.DeleteOlderThan("group", now.Add(-90*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteGroup("group"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []AuditEntry{
+		{Action: AuditCreate, Collection: CollectionEvents, GroupID: "group", TargetID: list[0].ID.Hex()},
+		{Action: AuditCreate, Collection: CollectionEvents, GroupID: "group", TargetID: list[1].ID.Hex()},
+		{Action: AuditCreate, Collection: CollectionEvents, GroupID: "group", TargetID: list[2].ID.Hex()},
+		{Action: AuditCreate, Collection: CollectionPlaces, GroupID: "group", TargetID: "place"},
+		{Action: AuditDelete, Collection: CollectionEvents, GroupID: "group", Count: 1},
+		{Action: AuditDelete, Collection: CollectionEvents, GroupID: "group", Count: 2},
+		{Action: AuditDelete, Collection: CollectionPlaces, GroupID: "group", Count: 1},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	for i, entry := range entries {
+		entry.Time = expected[i].Time
+		if *entry != expected[i] {
+			t.Errorf("unexpected entry %d: %#v", i, entry)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrBadRadius возвращается Events.Cluster, если радиус кластера не больше
+// нуля.
+var ErrBadRadius = errors.New("bad cluster radius")
+
+// Cluster описывает группу близко расположенных событий для отображения на
+// карте одним маркером.
+type Cluster struct {
+	// центр кластера: среднее значение координат его событий
+	Center geo.Point `json:"center"`
+	// количество событий в кластере
+	Count int `json:"count"`
+	// границы кластера: юго-западный и северо-восточный углы прямоугольника,
+	// содержащего все его события
+	Bounds [2]geo.Point `json:"bounds"`
+}
+
+// clusterItem содержит кластер и данные, необходимые для его построения.
+type clusterItem struct {
+	*Cluster
+	seed           geo.Point // первая точка кластера, от которой отсчитывается радиус
+	sumLon, sumLat float64   // суммы координат для вычисления центра
+}
+
+// add добавляет точку в кластер.
+func (c *clusterItem) add(p geo.Point) {
+	if c.Count == 0 {
+		c.Bounds = [2]geo.Point{p, p}
+	} else {
+		c.Bounds[0] = geo.Point{math.Min(c.Bounds[0][0], p[0]), math.Min(c.Bounds[0][1], p[1])}
+		c.Bounds[1] = geo.Point{math.Max(c.Bounds[1][0], p[0]), math.Max(c.Bounds[1][1], p[1])}
+	}
+	c.Count++
+	c.sumLon += p[0]
+	c.sumLat += p[1]
+	c.Center = geo.Point{c.sumLon / float64(c.Count), c.sumLat / float64(c.Count)}
+}
+
+// clusterCell задает ячейку сетки: номер ряда по широте и колонки по долготе.
+type clusterCell [2]int
+
+// clusterer строит кластеры точек жадным алгоритмом с сеточным индексом (см.
+// Events.Cluster).
+type clusterer struct {
+	radius   float64 // радиус кластера в метрах
+	height   float64 // высота ячейки сетки в градусах широты
+	cells    map[clusterCell][]*clusterItem
+	clusters []*Cluster
+}
+
+// newClusterer возвращает построитель кластеров с указанным радиусом в метрах.
+func newClusterer(radius float64) *clusterer {
+	return &clusterer{
+		radius: radius,
+		height: radius / earthRadius * 180 / math.Pi,
+		cells:  make(map[clusterCell][]*clusterItem),
+	}
+}
+
+// width возвращает ширину ячеек ряда row в градусах долготы. Она вычисляется
+// для ближайшей к полюсу границы ряда, поэтому на любой широте ряда ячейка не
+// уже радиуса. Вблизи полюсов весь ряд состоит из одной ячейки.
+func (c *clusterer) width(row int) float64 {
+	edge := math.Max(math.Abs(float64(row)*c.height), math.Abs(float64(row+1)*c.height))
+	if edge >= 90 {
+		return 360
+	}
+	return math.Min(c.height/math.Cos(edge*math.Pi/180), 360)
+}
+
+// cell возвращает ячейку сетки, в которую попадает точка, при условии, что
+// она находится в ряду row.
+func (c *clusterer) cell(p geo.Point, row int) clusterCell {
+	return clusterCell{row, int(math.Floor(p[0] / c.width(row)))}
+}
+
+// add добавляет точку в ближайший кластер, первая точка которого находится не
+// дальше радиуса, или создает для нее новый кластер.
+func (c *clusterer) add(p geo.Point) {
+	row := int(math.Floor(p[1] / c.height))
+	var nearest *clusterItem
+	nearestDistance := c.radius
+	for r := row - 1; r <= row+1; r++ {
+		center := c.cell(p, r)
+		for col := center[1] - 1; col <= center[1]+1; col++ {
+			for _, item := range c.cells[clusterCell{r, col}] {
+				if d := distance(item.seed, p); d <= nearestDistance {
+					nearest, nearestDistance = item, d
+				}
+			}
+		}
+	}
+	if nearest == nil {
+		nearest = &clusterItem{Cluster: new(Cluster), seed: p}
+		cell := c.cell(p, row)
+		c.cells[cell] = append(c.cells[cell], nearest)
+		c.clusters = append(c.clusters, nearest.Cluster)
+	}
+	nearest.add(p)
+}
+
+// Cluster объединяет события устройства с координатами за указанный интервал
+// времени (границы интервала задаются так же, как в CountByTime) в кластеры
+// радиусом radiusMeters метров и возвращает их в порядке появления: первым
+// идет кластер, в который попало самое раннее событие. Это позволяет показать
+// на карте при мелком масштабе вместо тысяч точек трека небольшое количество
+// маркеров с количеством событий. Если radiusMeters не больше нуля, то
+// возвращается ErrBadRadius.
+//
+// Кластеры строятся жадным алгоритмом по расстоянию: события обрабатываются
+// по порядку времени, и каждое из них добавляется в кластер, первая точка
+// которого находится ближе всего к событию, но не дальше radiusMeters по
+// формуле гаверсинусов. Если такого кластера нет, то событие становится
+// первой точкой нового кластера. Для поиска кластеров используется сетка с
+// ячейками размером не меньше радиуса, поэтому для каждого события
+// проверяются только кластеры из соседних ячеек. Первые точки кластеров
+// находятся друг от друга дальше радиуса, поэтому в каждой ячейке их немного,
+// и время работы составляет O(n) для n событий, а память — O(k) для k
+// кластеров: сами события в памяти не хранятся.
+//
+// Центр кластера — среднее арифметическое координат его событий, поэтому
+// кластеры не должны пересекать 180-й меридиан. Вблизи границ ячеек в
+// высоких широтах близкая первая точка кластера может быть не найдена: в этом
+// случае создается лишний кластер, но событие никогда не попадает в кластер
+// дальше радиуса от его первой точки.
+func (db *Events) Cluster(groupID, deviceId string, from, to time.Time, radiusMeters float64) (clusters []*Cluster, err error) {
+	return db.ClusterContext(context.Background(), groupID, deviceId, from, to, radiusMeters)
+}
+
+// ClusterContext работает как Cluster, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) ClusterContext(ctx context.Context, groupID, deviceId string, from, to time.Time, radiusMeters float64) (clusters []*Cluster, err error) {
+	if !(radiusMeters > 0) {
+		return nil, ErrBadRadius
+	}
+	query := bson.M{
+		"groupId":  groupID,
+		"deviceId": deviceId,
+		"location": bson.M{"$exists": true},
+	}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	builder := newClusterer(radiusMeters)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		iter := coll.Find(notDeleted(query)).
+			Select(bson.M{"location": 1}).Sort("time").Iter()
+		var event Event
+		for iter.Next(&event) {
+			if event.Location != nil {
+				builder.add(*event.Location)
+			}
+			event = Event{}
+		}
+		return iter.Close()
+	})
+	if err == nil {
+		clusters = builder.clusters
+		if clusters == nil {
+			clusters = make([]*Cluster, 0)
+		}
+	}
+	return
+}
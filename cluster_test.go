@@ -0,0 +1,93 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+func TestClusterer(t *testing.T) {
+	c := newClusterer(500)
+	for _, p := range []geo.Point{
+		{37.6100, 55.7500},
+		{37.6110, 55.7510},
+		{37.6200, 55.7500}, // ~630 м от первой точки
+		{37.6090, 55.7495},
+		{30.3141, 59.9386},
+	} {
+		c.add(p)
+	}
+	if len(c.clusters) != 3 {
+		t.Fatalf("unexpected clusters: %v", c.clusters)
+	}
+	first := c.clusters[0]
+	if first.Count != 3 || first.Bounds[0] != (geo.Point{37.6090, 55.7495}) ||
+		first.Bounds[1] != (geo.Point{37.6110, 55.7510}) ||
+		math.Abs(first.Center[0]-37.61) > 1e-9 || math.Abs(first.Center[1]-55.75016666) > 1e-6 {
+		t.Errorf("unexpected first cluster: %+v", first)
+	}
+	if c.clusters[1].Count != 1 || c.clusters[2].Count != 1 {
+		t.Errorf("unexpected clusters: %+v, %+v", c.clusters[1], c.clusters[2])
+	}
+
+	// ни одна точка не должна попасть в кластер дальше радиуса от его первой
+	// точки, в том числе на границах ячеек и в высоких широтах
+	for _, lat := range []float64{0, 55, 80, 89.9} {
+		c := newClusterer(1000)
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			p := geo.Point{random.Float64()*0.2 - 0.1, math.Min(lat+random.Float64()*0.1, 90)}
+			counts := make(map[*clusterItem]int)
+			for _, items := range c.cells {
+				for _, item := range items {
+					counts[item] = item.Count
+				}
+			}
+			c.add(p)
+			for _, items := range c.cells {
+				for _, item := range items {
+					if item.Count != counts[item] && distance(item.seed, p) > 1000 {
+						t.Fatalf("lat %v: point %v is too far from cluster %v", lat, p, item.seed)
+					}
+				}
+			}
+		}
+		if len(c.clusters) < 2 || len(c.clusters) > 200 {
+			t.Errorf("lat %v: unexpected clusters count: %d", lat, len(c.clusters))
+		}
+	}
+}
+
+func TestEventsCluster(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err := events.Create("group", "device",
+		&Event{Time: start, Location: &geo.Point{37.610, 55.750}},
+		&Event{Time: start.Add(time.Minute), Location: &geo.Point{37.611, 55.751}},
+		&Event{Time: start.Add(2 * time.Minute)},
+		&Event{Time: start.Add(3 * time.Minute), Location: &geo.Point{30.314, 59.938}},
+		&Event{Time: start.Add(2 * time.Hour), Location: &geo.Point{37.610, 55.750}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Cluster("group", "device", time.Time{}, time.Time{}, 0); err != ErrBadRadius {
+		t.Errorf("unexpected error: %v", err)
+	}
+	clusters, err := events.Cluster("group", "device", start, start.Add(time.Hour), 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Count != 2 || clusters[1].Count != 1 {
+		t.Errorf("unexpected clusters: %+v", clusters)
+	}
+	clusters, err = events.Cluster("other", "device", time.Time{}, time.Time{}, 500)
+	if err != nil || clusters == nil || len(clusters) != 0 {
+		t.Errorf("unexpected result: %v, %v", clusters, err)
+	}
+}
@@ -4,6 +4,7 @@ package model
 //go:generate codecgen -u=true -o=codec.go data.go
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -33,11 +34,41 @@ type User struct {
 	// логин пользователя
 	Login string `bson:"_id" json:"id"`
 	// уникальный идентификатор группы
-	GroupID string `bson:"group,omitempty" json:"group,omitempty"`
+	GroupID string `bson:"groupId,omitempty" json:"group,omitempty"`
 	// отображаемое имя
 	Name string `bson:"name,omitempty" json:"name,omitempty"`
 	// хеш пароля пользователя
 	Password Password `bson:"password" json:"-"`
+	// роль пользователя в группе: RoleAdmin или RoleMember; пустое значение
+	// соответствует RoleMember
+	Role string `bson:"role,omitempty" json:"role,omitempty"`
+	// время создания описания
+	CreatedAt time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	// время последнего изменения описания
+	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// Роли пользователей в группе.
+const (
+	RoleAdmin  = "admin"  // администратор: управляет устройствами и местами
+	RoleMember = "member" // обычный участник группы
+)
+
+// ErrBadRole возвращается, если роль пользователя не является одной из
+// предопределенных.
+var ErrBadRole = errors.New("bad user role")
+
+// prepareRole проверяет роль пользователя и задает RoleMember, если роль не
+// указана.
+func (u *User) prepareRole() error {
+	switch u.Role {
+	case "":
+		u.Role = RoleMember
+	case RoleAdmin, RoleMember:
+	default:
+		return ErrBadRole
+	}
+	return nil
 }
 
 // Device описывает информацию об устройстве.
@@ -55,13 +86,19 @@ type Device struct {
 	// глобальный уникальный идентификатор устройства
 	ID string `bson:"_id" json:"id"`
 	// уникальный идентификатор группы
-	GroupID string `bson:"group,omitempty" json:"group,omitempty"`
+	GroupID string `bson:"groupId,omitempty" json:"group,omitempty"`
 	// отображаемое имя
 	Name string `bson:"name,omitempty" json:"name,omitempty"`
 	// идентификатор типа устройства
 	Type string `bson:"type,omitempty" json:"type,omitempty"`
 	// хеш пароля для авторизации
 	Password Password `bson:"password,omitempty" json:"-"`
+	// версия описания, увеличивается при каждом обновлении
+	Version int `bson:"version,omitempty" json:"version,omitempty"`
+	// время создания описания
+	CreatedAt time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	// время последнего изменения описания
+	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
 // String возвращает строку с отображаемым именем устройства. Если для данного
@@ -74,6 +111,35 @@ func (d *Device) String() string {
 	return d.ID
 }
 
+// Состояния связи с устройством, возвращаемые Device.Status.
+const (
+	DeviceOnline        = "online"  // устройство недавно было на связи
+	DeviceOffline       = "offline" // устройство давно не было на связи
+	DeviceStatusUnknown = "unknown" // от устройства не было событий
+)
+
+// DefaultOfflineAfter задает время, после которого устройство без новых
+// событий считается не в сети, если другое значение не указано явно.
+var DefaultOfflineAfter = 15 * time.Minute
+
+// Status возвращает состояние связи с устройством на момент now по времени
+// его последнего события lastSeen: DeviceOnline, если с тех пор прошло не
+// больше offlineAfter, иначе DeviceOffline. Если событий от устройства не
+// было (lastSeen не задан), то возвращается DeviceStatusUnknown. Если
+// offlineAfter не больше нуля, то используется DefaultOfflineAfter.
+func (d *Device) Status(lastSeen, now time.Time, offlineAfter time.Duration) string {
+	if lastSeen.IsZero() {
+		return DeviceStatusUnknown
+	}
+	if offlineAfter <= 0 {
+		offlineAfter = DefaultOfflineAfter
+	}
+	if now.Sub(lastSeen) > offlineAfter {
+		return DeviceOffline
+	}
+	return DeviceOnline
+}
+
 // Event обычно описывает место, время и событие, которое в нем случилось.
 //
 // Каждое событие получает свой уникальный идентификатор, назначаемый
@@ -105,13 +171,16 @@ func (d *Device) String() string {
 // значения датчиков и сенсоров хорошо и удобно сохранять именно в таком виде.
 // Плюс, всегда можно добавить что-то дополнительно практически в любом удобном
 // формате. Главное, чтобы приложение знало, что потом с этим делать.
+//
+// Событие может быть помечено как удаленное без фактического удаления из
+// хранилища: в этом случае в нем сохраняется время удаления.
 type Event struct {
 	// уникальный идентификатор записи
 	ID bson.ObjectId `bson:"_id" json:"id"`
 	// уникальный идентификатор устройства
-	DeviceID string `bson:"device" json:"device"`
+	DeviceID string `bson:"deviceId" json:"device"`
 	// уникальный идентификатор группы
-	GroupID string `bson:"group,omitempty" json:"group,omitempty"`
+	GroupID string `bson:"groupId,omitempty" json:"group,omitempty"`
 
 	// временная метка
 	Time time.Time `bson:"time" json:"time"`
@@ -130,15 +199,184 @@ type Event struct {
 	Emoji rune `bson:"emoji,omitempty" json:"emoji,omitempty"`
 	// текстовый комментарий к событию
 	Comment string `bson:"comment,omitempty" json:"comment,omitempty"`
+	// идентификатор события, назначенный устройством; уникален в рамках
+	// устройства и используется для исключения повторов в Events.Upsert
+	ExternalID string `bson:"externalId,omitempty" json:"externalId,omitempty"`
 	// дополнительная именованная информация
 	Data map[string]interface{} `bson:"data,omitempty,inline" json:"data,omitempty"`
+
+	// время создания описания
+	CreatedAt time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	// время последнего изменения описания
+	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	// время пометки события как удаленного
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+}
+
+// ErrEventTimeInFuture возвращается, если время события находится в будущем
+// дальше, чем допускается MaxEventTimeAhead.
+var ErrEventTimeInFuture = errors.New("event time is too far in the future")
+
+// MaxEventTimeAhead задает максимально допустимое опережение времени события
+// относительно текущего времени сервера. Небольшое опережение допускается из-за
+// возможного расхождения часов устройства и сервера.
+var MaxEventTimeAhead = 24 * time.Hour
+
+// prepare осуществляет предварительную подготовку описания события перед его
+// сохранением: если время события не задано, то подставляется текущее время
+// сервера, а слишком далекое будущее время считается ошибкой.
+func (e *Event) prepare() error {
+	now := time.Now().UTC()
+	if e.Time.IsZero() {
+		e.Time = now
+	} else if e.Time.After(now.Add(MaxEventTimeAhead)) {
+		return ErrEventTimeInFuture
+	}
+	return nil
+}
+
+// DataFloat возвращает числовое значение дополнительного поля события с
+// указанным именем. После сохранения и чтения из хранилища или декодирования
+// из JSON числа могут иметь разный тип, поэтому все они приводятся к float64.
+// Если поле не задано или не является числом, то возвращается false.
+func (e *Event) DataFloat(key string) (float64, bool) {
+	switch value := e.Data[key].(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// DataString возвращает строковое значение дополнительного поля события с
+// указанным именем. Если поле не задано или не является строкой, то
+// возвращается false.
+func (e *Event) DataString(key string) (string, bool) {
+	switch value := e.Data[key].(type) {
+	case string:
+		return value, true
+	case []byte:
+		return string(value), true
+	}
+	return "", false
+}
+
+// ErrBadEmoji возвращается, если иконка события не является эмодзи.
+var ErrBadEmoji = errors.New("event emoji is not an emoji character")
+
+// emojiRanges содержит диапазоны символов Unicode, которые считаются эмодзи.
+var emojiRanges = []struct{ lo, hi rune }{
+	{0x00A9, 0x00A9},   // ©
+	{0x00AE, 0x00AE},   // ®
+	{0x203C, 0x2049},   // ‼ ⁉
+	{0x2122, 0x2139},   // ™ ℹ
+	{0x2194, 0x21AA},   // стрелки
+	{0x231A, 0x23FF},   // разные технические символы: ⌚ ⏰
+	{0x24C2, 0x24C2},   // Ⓜ
+	{0x25AA, 0x25FE},   // геометрические фигуры
+	{0x2600, 0x27BF},   // разные символы и дингбаты
+	{0x2934, 0x2935},   // стрелки
+	{0x2B05, 0x2B55},   // ⬅ ⭐ ⭕
+	{0x3030, 0x3030},   // 〰
+	{0x303D, 0x303D},   // 〽
+	{0x3297, 0x3299},   // ㊗ ㊙
+	{0x1F000, 0x1F2FF}, // игральные карты, маджонг, буквы в квадратах и флаги
+	{0x1F300, 0x1F6FF}, // пиктограммы, смайлы, транспорт
+	{0x1F900, 0x1FAFF}, // дополнительные пиктограммы
+}
+
+// isEmoji возвращает true, если символ относится к эмодзи.
+func isEmoji(r rune) bool {
+	for _, rng := range emojiRanges {
+		if r >= rng.lo && r <= rng.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Предопределенные типы событий.
+const (
+	EventTypeArrive  = "Arrive"   // прибытие в место
+	EventTypeLeave   = "Leave"    // уход из места
+	EventTypeTravel  = "Travel"   // перемещение
+	EventTypeCheckIn = "Check-in" // отметка в месте
+	EventTypeHappen  = "Happen"   // произвольное событие
+)
+
+// ErrUnknownEventType возвращается, если тип события не является одним из
+// предопределенных.
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// validEventType возвращает true, если тип события является одним из
+// предопределенных.
+func validEventType(eventType string) bool {
+	switch eventType {
+	case EventTypeArrive, EventTypeLeave, EventTypeTravel, EventTypeCheckIn,
+		EventTypeHappen:
+		return true
+	}
+	return false
+}
+
+// ErrInvalidLocation возвращается, если координаты события выходят за пределы
+// допустимых значений: долгота должна быть в диапазоне от -180 до 180, а
+// широта — от -90 до 90 градусов.
+var ErrInvalidLocation = errors.New("invalid event location")
+
+// validLocation возвращает true, если долгота и широта точки находятся в
+// допустимых пределах. Значения NaN считаются недопустимыми.
+func validLocation(p geo.Point) bool {
+	return p[0] >= -180 && p[0] <= 180 && p[1] >= -90 && p[1] <= 90
+}
+
+// Validate проверяет описание события и возвращает ошибку, если оно
+// некорректно. Тип события, если задан, должен быть одним из предопределенных,
+// иконка события, если задана, должна быть эмодзи, а координаты, если заданы,
+// должны находиться в допустимых пределах.
+func (e *Event) Validate() error {
+	if e.Type != "" && !validEventType(e.Type) {
+		return ErrUnknownEventType
+	}
+	if e.Emoji != 0 && !isEmoji(e.Emoji) {
+		return ErrBadEmoji
+	}
+	if e.Location != nil && !validLocation(*e.Location) {
+		return ErrInvalidLocation
+	}
+	return nil
 }
 
 // Place описывает географическое место, задаваемое для группы пользователей.
-// Такое место может быть описано либо в виде круга, задаваемого координатами
-// центральной точки и радиусом в метрах, либо полигоном. Круг имеет более
-// высокий приоритет, поэтому если задано и то, и другое, то используется именно
-// описание круга.
+// Такое место может быть описано в виде круга, задаваемого координатами
+// центральной точки и радиусом в метрах, полигоном, набором из нескольких
+// непересекающихся полигонов или маршрутом (ломаной линией с шириной
+// коридора). Если задано несколько описаний, то используется только одно из
+// них в порядке приоритета: круг, полигон, набор полигонов, маршрут.
 //
 // К сожалению, в формате GeoJSON, который использует для описание
 // географических координат в MongoDB, нет возможности описать круг. Поэтому для
@@ -150,20 +388,46 @@ type Place struct {
 	// уникальный идентификатор описания места
 	ID string `bson:"_id,omitempty" json:"id"`
 	// уникальный идентификатор группы
-	GroupID string `bson:"group,omitempty" json:"group,omitempty"`
+	GroupID string `bson:"groupId,omitempty" json:"group,omitempty"`
 	// отображаемое имя
 	Name string `bson:"name,omitempty" json:"name,omitempty"`
 	// географическое описание места как круга
 	Circle *geo.Circle `bson:"circle,omitempty" json:"circle,omitempty"`
 	// географическое описание места в виде полигона
 	Polygon *geo.Polygon `bson:"polygon,omitempty" json:"polygon,omitempty"`
+	// географическое описание места в виде нескольких полигонов
+	Polygons []geo.Polygon `bson:"polygons,omitempty" json:"polygons,omitempty"`
+	// географическое описание места в виде маршрута
+	Line *Line `bson:"line,omitempty" json:"line,omitempty"`
 	// описание в формате GeoJSON для поиска
 	Geo interface{} `bson:"geo" json:"-"`
+	// версия описания, увеличивается при каждом обновлении
+	Version int `bson:"version,omitempty" json:"version,omitempty"`
+	// время создания описания
+	CreatedAt time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	// время последнего изменения описания
+	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
-// ErrBadPlaceData возвращается, если ни полигон, ни окружность не заданы в
-// описании места.
-var ErrBadPlaceData = errors.New("circle or polygon is require in place")
+// ErrBadPlaceData возвращается, если ни окружность, ни полигоны, ни маршрут не
+// заданы в описании места.
+var ErrBadPlaceData = errors.New("circle, polygon or line is require in place")
+
+// ErrInvalidRadius возвращается, если радиус окружности в описании места не
+// положительный или превышает MaxCircleRadius.
+var ErrInvalidRadius = errors.New("invalid circle radius")
+
+// MaxCircleRadius задает максимально допустимый радиус окружности в описании
+// места в метрах.
+//
+// Окружность сохраняется для индексации в виде вписанного в нее правильного
+// многоугольника (количество вершин задается CircleSegments). Максимальное
+// отклонение его сторон от окружности составляет r·(1 - cos(π/n)), где r —
+// радиус, а n — количество вершин, т.е. при неизменном количестве вершин растет
+// пропорционально радиусу. Кроме того, для
+// больших радиусов начинает сказываться кривизна земной поверхности, поэтому
+// слишком большие окружности не принимаются.
+var MaxCircleRadius = 100000.0
 
 // String возвращает строку с отображаемым именем описания места. Если для
 // данного места задано имя, то возвращается именно оно. В противном случае
@@ -180,11 +444,29 @@ func (p *Place) String() string {
 func (p *Place) prepare() (err error) {
 	// анализируем описание места и формируем данные для индексации
 	if p.Circle != nil {
-		p.Polygon = nil
-		p.Geo = p.Circle.Geo()
+		if p.Circle.Radius <= 0 || p.Circle.Radius > MaxCircleRadius {
+			return ErrInvalidRadius
+		}
+		p.Polygon, p.Polygons, p.Line = nil, nil, nil
+		p.Geo = circleGeo(p.Circle)
 	} else if p.Polygon != nil {
-		p.Circle = nil
+		if err = validatePolygon(*p.Polygon); err != nil {
+			return
+		}
+		p.Polygons, p.Line = nil, nil
 		p.Geo = p.Polygon.Geo()
+	} else if len(p.Polygons) > 0 {
+		for _, polygon := range p.Polygons {
+			if err = validatePolygon(polygon); err != nil {
+				return
+			}
+		}
+		p.Line = nil
+		p.Geo = bson.M{"type": "MultiPolygon", "coordinates": p.Polygons}
+	} else if p.Line != nil {
+		if p.Geo, err = p.Line.geo(); err != nil {
+			return
+		}
 	} else {
 		err = ErrBadPlaceData
 	}
@@ -2,13 +2,16 @@ package model
 
 import (
 	"encoding/json"
+	"math"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/geotrace/geo"
 	"github.com/kr/pretty"
 	"github.com/mdigger/rest"
 	"github.com/ugorji/go/codec"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestData(t *testing.T) {
@@ -101,3 +104,271 @@ func TestData(t *testing.T) {
 	// }
 
 }
+
+func TestEventValidateEmoji(t *testing.T) {
+	for _, test := range []struct {
+		emoji rune
+		err   error
+	}{
+		{0, nil},
+		{'😀', nil},
+		{'🚗', nil},
+		{'🏠', nil},
+		{'☕', nil},
+		{'❤', nil},
+		{'🦄', nil},
+		{'a', ErrBadEmoji},
+		{'Z', ErrBadEmoji},
+		{'1', ErrBadEmoji},
+		{'Ж', ErrBadEmoji},
+		{' ', ErrBadEmoji},
+	} {
+		event := &Event{Emoji: test.emoji}
+		if err := event.Validate(); err != test.err {
+			t.Errorf("%q: unexpected error: %v", test.emoji, err)
+		}
+	}
+}
+
+func TestPlacePreparePolygon(t *testing.T) {
+	for name, test := range map[string]struct {
+		polygon geo.Polygon
+		err     error
+	}{
+		"square":   {geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}, nil},
+		"triangle": {geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}, nil},
+		"open ring": {geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}}},
+			ErrInvalidPolygon},
+		"too short": {geo.Polygon{{{0, 0}, {1, 0}, {0, 0}}}, ErrInvalidPolygon},
+		"bowtie": {geo.Polygon{{{0, 0}, {1, 1}, {1, 0}, {0, 1}, {0, 0}}},
+			ErrInvalidPolygon},
+		"empty": {geo.Polygon{}, ErrInvalidPolygon},
+	} {
+		place := &Place{Polygon: &test.polygon}
+		if err := place.prepare(); err != test.err {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestPlacePrepareCircle(t *testing.T) {
+	for _, test := range []struct {
+		radius float64
+		err    error
+	}{
+		{-1, ErrInvalidRadius},
+		{0, ErrInvalidRadius},
+		{0.1, nil},
+		{500, nil},
+		{MaxCircleRadius, nil},
+		{MaxCircleRadius + 1, ErrInvalidRadius},
+	} {
+		place := &Place{Circle: &geo.Circle{
+			Center: geo.Point{37.6173, 55.7558},
+			Radius: test.radius,
+		}}
+		if err := place.prepare(); err != test.err {
+			t.Errorf("radius %v: unexpected error: %v", test.radius, err)
+		}
+	}
+}
+
+func TestPlacePreparePolygons(t *testing.T) {
+	square := geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}
+	bowtie := geo.Polygon{{{0, 0}, {1, 1}, {1, 0}, {0, 1}, {0, 0}}}
+	place := &Place{Polygons: []geo.Polygon{square, bowtie}}
+	if err := place.prepare(); err != ErrInvalidPolygon {
+		t.Errorf("unexpected error: %v", err)
+	}
+	other := geo.Polygon{{{2, 2}, {3, 2}, {3, 3}, {2, 2}}}
+	place = &Place{Polygons: []geo.Polygon{square, other}}
+	if err := place.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if place.Geo.(bson.M)["type"] != "MultiPolygon" {
+		t.Errorf("unexpected geo: %v", place.Geo)
+	}
+}
+
+func TestPlacePrepareLine(t *testing.T) {
+	moscow, tver := geo.Point{37.6173, 55.7558}, geo.Point{35.9119, 56.8587}
+	for name, test := range map[string]struct {
+		line Line
+		typ  string
+		err  error
+	}{
+		"line":      {Line{Points: []geo.Point{moscow, tver}}, "LineString", nil},
+		"corridor":  {Line{Points: []geo.Point{moscow, tver}, Width: 100}, "GeometryCollection", nil},
+		"one point": {Line{Points: []geo.Point{moscow, moscow}}, "", ErrInvalidLine},
+		"empty":     {Line{}, "", ErrInvalidLine},
+		"negative":  {Line{Points: []geo.Point{moscow, tver}, Width: -1}, "", ErrInvalidLine},
+	} {
+		place := &Place{Line: &test.line}
+		if err := place.prepare(); err != test.err {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if test.err == nil && place.Geo.(bson.M)["type"] != test.typ {
+			t.Errorf("%s: unexpected geo: %v", name, place.Geo)
+		}
+	}
+	// круг имеет приоритет перед маршрутом
+	place := &Place{
+		Circle: &geo.Circle{Center: moscow, Radius: 100},
+		Line:   &Line{Points: []geo.Point{moscow, tver}},
+	}
+	if err := place.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if place.Line != nil {
+		t.Error("line is not cleared")
+	}
+}
+
+func TestEventData(t *testing.T) {
+	event := &Event{Data: map[string]interface{}{
+		"float":  1.5,
+		"int":    2,
+		"int64":  int64(3),
+		"uint8":  uint8(4),
+		"number": json.Number("5.5"),
+		"string": "text",
+		"bytes":  []byte("bytes"),
+	}}
+	for key, want := range map[string]float64{
+		"float": 1.5, "int": 2, "int64": 3, "uint8": 4, "number": 5.5,
+	} {
+		if value, ok := event.DataFloat(key); !ok || value != want {
+			t.Errorf("%s: unexpected value %v, %v", key, value, ok)
+		}
+	}
+	for _, key := range []string{"string", "unknown"} {
+		if _, ok := event.DataFloat(key); ok {
+			t.Errorf("%s: unexpected float value", key)
+		}
+	}
+	for key, want := range map[string]string{"string": "text", "bytes": "bytes"} {
+		if value, ok := event.DataString(key); !ok || value != want {
+			t.Errorf("%s: unexpected value %q, %v", key, value, ok)
+		}
+	}
+	if _, ok := event.DataString("float"); ok {
+		t.Error("unexpected string value")
+	}
+}
+
+func TestEventDataKey(t *testing.T) {
+	event := &Event{Data: map[string]interface{}{"key": "value"}}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["data"]; !ok {
+		t.Errorf("json: data field not found: %s", data)
+	}
+	data = data[:0]
+	if err := codec.NewEncoderBytes(&data, new(codec.JsonHandle)).Encode(event); err != nil {
+		t.Fatal(err)
+	}
+	fields = nil
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["data"]; !ok {
+		t.Errorf("codec: data field not found: %s", data)
+	}
+}
+
+func TestEventValidateType(t *testing.T) {
+	for _, test := range []struct {
+		eventType string
+		err       error
+	}{
+		{"", nil},
+		{EventTypeArrive, nil},
+		{EventTypeLeave, nil},
+		{EventTypeTravel, nil},
+		{EventTypeCheckIn, nil},
+		{EventTypeHappen, nil},
+		{"arrive", ErrUnknownEventType},
+		{"Unknown", ErrUnknownEventType},
+	} {
+		event := &Event{Type: test.eventType}
+		if err := event.Validate(); err != test.err {
+			t.Errorf("%q: unexpected error: %v", test.eventType, err)
+		}
+	}
+}
+
+func TestEventValidateLocation(t *testing.T) {
+	for _, test := range []struct {
+		location *geo.Point
+		err      error
+	}{
+		{nil, nil},
+		{&geo.Point{0, 0}, nil},
+		{&geo.Point{37.6173, 55.7558}, nil},
+		{&geo.Point{180, 90}, nil},
+		{&geo.Point{-180, -90}, nil},
+		{&geo.Point{180.0001, 0}, ErrInvalidLocation},
+		{&geo.Point{-180.0001, 0}, ErrInvalidLocation},
+		{&geo.Point{0, 90.0001}, ErrInvalidLocation},
+		{&geo.Point{0, -90.0001}, ErrInvalidLocation},
+		{&geo.Point{500, 0}, ErrInvalidLocation},
+		{&geo.Point{0, -200}, ErrInvalidLocation},
+		{&geo.Point{math.NaN(), 0}, ErrInvalidLocation},
+		{&geo.Point{0, math.Inf(1)}, ErrInvalidLocation},
+	} {
+		event := &Event{Location: test.location}
+		if err := event.Validate(); err != test.err {
+			t.Errorf("%v: unexpected error: %v", test.location, err)
+		}
+	}
+}
+
+func TestUserPrepareRole(t *testing.T) {
+	for _, test := range []struct {
+		role, result string
+		err          error
+	}{
+		{"", RoleMember, nil},
+		{RoleMember, RoleMember, nil},
+		{RoleAdmin, RoleAdmin, nil},
+		{"root", "root", ErrBadRole},
+		{"Admin", "Admin", ErrBadRole},
+	} {
+		user := &User{Role: test.role}
+		if err := user.prepareRole(); err != test.err {
+			t.Errorf("%q: unexpected error: %v", test.role, err)
+		}
+		if user.Role != test.result {
+			t.Errorf("%q: unexpected role: %q", test.role, user.Role)
+		}
+	}
+}
+
+func TestDeviceStatus(t *testing.T) {
+	device := &Device{ID: "device"}
+	now := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i, test := range []struct {
+		lastSeen     time.Time
+		offlineAfter time.Duration
+		status       string
+	}{
+		{time.Time{}, time.Minute, DeviceStatusUnknown},
+		{now, time.Minute, DeviceOnline},
+		{now.Add(-time.Minute), time.Minute, DeviceOnline},
+		{now.Add(-time.Minute - time.Second), time.Minute, DeviceOffline},
+		{now.Add(time.Minute), time.Minute, DeviceOnline},
+		{now.Add(-10 * time.Minute), 0, DeviceOnline},
+		{now.Add(-20 * time.Minute), 0, DeviceOffline},
+	} {
+		if status := device.Status(test.lastSeen, now, test.offlineAfter); status != test.status {
+			t.Errorf("%d: unexpected status: %s", i, status)
+		}
+	}
+}
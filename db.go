@@ -1,25 +1,115 @@
 package model
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	ErrBadObjectId = errors.New("bad object id")
+	ErrBadGroupId  = errors.New("bad group id")
 	ErrNotFound    = mgo.ErrNotFound
+	ErrDuplicate   = errors.New("duplicate key")
+
+	ErrVersionConflict = errors.New("version conflict")
 )
 
 // DB описывает хранилище данных и работу с ним.
 type DB struct {
 	session *mgo.Session // открытая сессия соединения с MongoDB
 	name    string       // название базы данных
+	tail    bool         // копировать новые события в CollectionEventsTail
+	prefix  string       // префикс названий коллекций (см. WithPrefix)
+	// получатель журнала изменений; nil отключает журнал
+	auditSink AuditSink
 }
 
 // InitDB инициализирует описание соединения с хранилищем и возвращает его.
+// Настройки сессии соединения при этом не изменяются.
 func InitDB(session *mgo.Session, dbName string) *DB {
-	return &DB{session, dbName}
+	return InitDBWithOptions(session, dbName, Options{})
+}
+
+// Options описывает настройки соединения с MongoDB. Они применяются к сессии,
+// переданной в InitDBWithOptions, и наследуются всеми ее копиями, которые
+// используются для выполнения запросов.
+type Options struct {
+	// максимальное количество соединений с каждым сервером; если не задано,
+	// то используется значение по умолчанию
+	PoolLimit int
+	// время ожидания ответа на запрос; если не задано, то не изменяется
+	SocketTimeout time.Duration
+	// режим чтения; если не задан, то не изменяется
+	Mode *mgo.Mode
+}
+
+// InitDBWithOptions инициализирует описание соединения с хранилищем с
+// указанными настройками и возвращает его.
+func InitDBWithOptions(session *mgo.Session, dbName string, opts Options) *DB {
+	if opts.PoolLimit > 0 {
+		session.SetPoolLimit(opts.PoolLimit)
+	}
+	if opts.SocketTimeout > 0 {
+		session.SetSocketTimeout(opts.SocketTimeout)
+	}
+	if opts.Mode != nil && session.Mode() != *opts.Mode {
+		session.SetMode(*opts.Mode, true)
+	}
+	return &DB{session: session, name: dbName}
+}
+
+// WithPrefix возвращает описание хранилища, которое работает с коллекциями,
+// названия которых начинаются с указанного префикса, например, staging_events
+// вместо events для префикса "staging_". Это позволяет держать в одной базе
+// данных несколько независимых окружений. Префикс добавляется ко всем
+// коллекциям, включая CollectionEventsTail и CollectionAudit (для
+// MongoAuditSink, созданного с этим описанием), и заменяет префикс, заданный
+// ранее. Пустой префикс возвращает описание, работающее с коллекциями без
+// префикса.
+//
+// Индексы создаются методами EnsureIndexes возвращенного описания, например,
+// db.WithPrefix("staging_").Events().EnsureIndexes(), и только для коллекций
+// с этим префиксом; для каждого префикса их нужно создать отдельно.
+//
+// Возвращенное описание использует ту же сессию соединения, что и db, и
+// получает его текущие настройки журнала изменений и копирования событий для
+// Events.Tail; их последующее изменение у одного из описаний не влияет на
+// другое. Закрывать нужно только одно из них.
+func (db *DB) WithPrefix(prefix string) *DB {
+	result := *db
+	result.prefix = prefix
+	return &result
+}
+
+// SetSafe задает режим подтверждения записи для всех последующих операций
+// изменения данных: создания, обновления и удаления. Например, для сохранения
+// событий можно потребовать подтверждения записи большинством узлов
+// (&mgo.Safe{WMode: "majority"}). Значение nil отключает ожидание
+// подтверждения записи.
+//
+// Настройка действует на все операции этого описания хранилища. Если для разных
+// операций нужны разные настройки, то используйте отдельные описания хранилища,
+// созданные с помощью InitDB для копий сессии.
+func (db *DB) SetSafe(safe *mgo.Safe) {
+	db.session.SetSafe(safe)
+}
+
+// SetMode задает режим чтения для всех последующих запросов к хранилищу:
+// получения, списков, поиска и агрегации. Например, для панелей мониторинга
+// допустимо использовать mgo.Eventual, разрешающий чтение с вторичных узлов.
+// Параметр refresh работает так же, как в mgo.Session.SetMode.
+//
+// Как и SetSafe, настройка действует на все операции этого описания хранилища.
+func (db *DB) SetMode(mode mgo.Mode, refresh bool) {
+	db.session.SetMode(mode, refresh)
 }
 
 // Close закрывает сессию соединения с MongoDB.
@@ -27,10 +117,452 @@ func (db *DB) Close() {
 	db.session.Close()
 }
 
+// Ping проверяет доступность сервера MongoDB и возвращает ошибку, если он
+// недоступен.
+func (db *DB) Ping() error {
+	return db.PingContext(context.Background())
+}
+
+// PingContext работает как Ping, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.execDB(ctx, func(mdb *mgo.Database) error {
+		return mdb.Session.Ping()
+	})
+}
+
+// Stats возвращает информацию о версии и сборке сервера MongoDB.
+func (db *DB) Stats() (info mgo.BuildInfo, err error) {
+	return db.StatsContext(context.Background())
+}
+
+// StatsContext работает как Stats, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *DB) StatsContext(ctx context.Context) (info mgo.BuildInfo, err error) {
+	var result mgo.BuildInfo
+	err = db.execDB(ctx, func(mdb *mgo.Database) (err error) {
+		result, err = mdb.Session.BuildInfo()
+		return
+	})
+	if err == nil {
+		info = result
+	}
+	return
+}
+
+// GroupStats описывает сводную информацию о группе: количество
+// зарегистрированных в ней пользователей, устройств, мест и событий.
+type GroupStats struct {
+	Users   int `bson:"users" json:"users"`
+	Devices int `bson:"devices" json:"devices"`
+	Places  int `bson:"places" json:"places"`
+	Events  int `bson:"events" json:"events"`
+}
+
+// Empty возвращает true, если в группе нет ни одного описания.
+func (s *GroupStats) Empty() bool {
+	return s.Users == 0 && s.Devices == 0 && s.Places == 0 && s.Events == 0
+}
+
+// GroupStats возвращает количество пользователей, устройств, мест и событий
+// указанной группы. События, помеченные как удаленные, не учитываются.
+func (db *DB) GroupStats(groupId string) (stats *GroupStats, err error) {
+	return db.GroupStatsContext(context.Background(), groupId)
+}
+
+// GroupStatsContext работает как GroupStats, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *DB) GroupStatsContext(ctx context.Context, groupId string) (stats *GroupStats, err error) {
+	result := new(GroupStats)
+	err = db.execDB(ctx, func(mdb *mgo.Database) (err error) {
+		query := bson.M{"groupId": groupId}
+		for _, count := range []struct {
+			collection string
+			query      bson.M
+			n          *int
+		}{
+			{CollectionUsers, query, &result.Users},
+			{CollectionDevices, query, &result.Devices},
+			{CollectionPlaces, query, &result.Places},
+			{CollectionEvents, notDeleted(bson.M{"groupId": groupId}), &result.Events},
+		} {
+			if *count.n, err = db.c(mdb, count.collection).Find(count.query).Count(); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err == nil {
+		stats = result
+	}
+	return
+}
+
+// CollectionErrors содержит ошибки, случившиеся при обработке отдельных
+// коллекций, с названием коллекции в качестве ключа.
+type CollectionErrors map[string]error
+
+func (e CollectionErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = name + ": " + e[name].Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// DeleteGroup безвозвратно удаляет все данные группы: события (включая
+// помеченные как удаленные), места, устройства и пользователей — именно в
+// таком порядке, чтобы при прерывании не оставалось событий без устройств.
+// Возвращается количество удаленных из каждой коллекции документов.
+//
+// Ошибка удаления из одной коллекции не прерывает удаление из остальных: в
+// этом случае возвращается CollectionErrors с ошибками по каждой коллекции, а
+// повторный вызов DeleteGroup удалит оставшиеся данные.
+func (db *DB) DeleteGroup(groupId string) (removed *GroupStats, err error) {
+	return db.DeleteGroupContext(context.Background(), groupId)
+}
+
+// DeleteGroupContext работает как DeleteGroup, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *DB) DeleteGroupContext(ctx context.Context, groupId string) (removed *GroupStats, err error) {
+	result := new(GroupStats)
+	errs := make(CollectionErrors)
+	err = db.execDB(ctx, func(mdb *mgo.Database) error {
+		query := bson.M{"groupId": groupId}
+		for _, remove := range []struct {
+			collection string
+			n          *int
+		}{
+			{CollectionEvents, &result.Events},
+			{CollectionPlaces, &result.Places},
+			{CollectionDevices, &result.Devices},
+			{CollectionUsers, &result.Users},
+		} {
+			info, err := db.c(mdb, remove.collection).RemoveAll(query)
+			if err != nil {
+				errs[remove.collection] = err
+				continue
+			}
+			*remove.n = info.Removed
+			db.auditCount(ctx, AuditDelete, remove.collection, groupId, info.Removed)
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
+	// при отмене контекста результат может быть еще не заполнен
+	if _, partial := err.(CollectionErrors); err == nil || partial {
+		removed = result
+	}
+	return
+}
+
+// Users возвращает описание для работы с данными о пользователях.
+func (db *DB) Users() *Users {
+	return (*Users)(db)
+}
+
+// Devices возвращает описание для работы с данными об устройствах.
+func (db *DB) Devices() *Devices {
+	return (*Devices)(db)
+}
+
+// Events возвращает описание для работы с данными о событиях.
+func (db *DB) Events() *Events {
+	return (*Events)(db)
+}
+
+// Places возвращает описание для работы с данными об описании мест.
+func (db *DB) Places() *Places {
+	return (*Places)(db)
+}
+
 // Названия коллекций в хранилище.
 var (
 	CollectionUsers   = "users"
 	CollectionDevices = "devices"
 	CollectionEvents  = "events"
 	CollectionPlaces  = "places"
+	// ограниченная по размеру копия новых событий для Events.Tail
+	CollectionEventsTail = "events.tail"
 )
+
+// indexes возвращает описание индексов, необходимых для работы с коллекцией с
+// указанным именем.
+//
+// Уникальный индекс по полю _id, в том числе и для логина пользователя,
+// MongoDB создает автоматически для любой коллекции, поэтому здесь он не
+// указывается.
+func indexes(name string) []mgo.Index {
+	switch name {
+	case CollectionEvents:
+		return []mgo.Index{
+			{Key: []string{"groupId", "deviceId", "time"}},
+			{Key: []string{"$2dsphere:location"}},
+			// полнотекстовый поиск по комментариям (Events.SearchComments)
+			{
+				Key:              []string{"$text:comment"},
+				DefaultLanguage:  CommentLanguage,
+				LanguageOverride: "commentLanguage",
+			},
+		}
+	case CollectionPlaces:
+		return []mgo.Index{
+			{Key: []string{"groupId"}},
+			{Key: []string{"$2dsphere:geo"}},
+		}
+	case CollectionUsers, CollectionDevices:
+		return []mgo.Index{
+			{Key: []string{"groupId"}},
+		}
+	}
+	return nil
+}
+
+// partialIndexes возвращает описание частичных индексов для коллекции с
+// указанным именем. Используемая версия mgo не поддерживает условие
+// partialFilterExpression, поэтому такие индексы описываются в формате
+// команды createIndexes. Требуется MongoDB версии 3.2 или выше.
+func partialIndexes(name string) []bson.M {
+	switch name {
+	case CollectionEvents:
+		// уникальность внешнего идентификатора события в рамках устройства;
+		// события без внешнего идентификатора в индекс не попадают
+		return []bson.M{{
+			"name": "groupId_1_deviceId_1_externalId_1",
+			"key": bson.D{
+				{Name: "groupId", Value: 1},
+				{Name: "deviceId", Value: 1},
+				{Name: "externalId", Value: 1},
+			},
+			"unique": true,
+			"partialFilterExpression": bson.M{
+				"externalId": bson.M{"$exists": true},
+			},
+		}}
+	}
+	return nil
+}
+
+// ensureIndexes создает индексы для коллекций с указанными именами и
+// возвращает первую случившуюся ошибку.
+func (db *DB) ensureIndexes(names ...string) error {
+	return db.execDB(context.Background(), func(mdb *mgo.Database) error {
+		for _, name := range names {
+			coll := db.c(mdb, name)
+			for _, index := range indexes(name) {
+				if err := coll.EnsureIndex(index); err != nil {
+					return err
+				}
+			}
+			if partial := partialIndexes(name); len(partial) > 0 {
+				err := mdb.Run(bson.D{
+					{Name: "createIndexes", Value: db.prefix + name},
+					{Name: "indexes", Value: partial},
+				}, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// EnsureIndexes создает все индексы, необходимые для работы с хранилищем.
+// Если индексы уже существуют, то они не пересоздаются, поэтому метод можно
+// безопасно вызывать при каждом запуске сервиса. Возвращается первая
+// случившаяся при создании индексов ошибка.
+func (db *DB) EnsureIndexes() error {
+	return db.ensureIndexes(CollectionUsers, CollectionDevices,
+		CollectionEvents, CollectionPlaces)
+}
+
+// NotFoundError возвращается методами Get, если запрошенное описание не
+// найдено. Оно содержит название коллекции, идентификатор и группу, что
+// позволяет точно указать в журнале или ответе, что именно не найдено.
+// Проверка errors.Is(err, ErrNotFound) для него продолжает работать.
+type NotFoundError struct {
+	Collection string // название коллекции
+	ID         string // идентификатор описания
+	GroupID    string // идентификатор группы
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found in group %q", e.Collection, e.ID, e.GroupID)
+}
+
+// Is позволяет сравнивать ошибку с ErrNotFound с помощью errors.Is.
+func (e *NotFoundError) Is(target error) bool { return target == ErrNotFound }
+
+// notFound заменяет ErrNotFound на NotFoundError с указанными параметрами.
+// Остальные ошибки возвращаются без изменений.
+func notFound(err error, collection, groupId, id string) error {
+	if err == ErrNotFound {
+		return &NotFoundError{Collection: collection, ID: id, GroupID: groupId}
+	}
+	return err
+}
+
+// duplicateError возвращается при нарушении уникальности ключа. Оно
+// сравнивается с ErrDuplicate и сохраняет исходную ошибку MongoDB.
+type duplicateError struct {
+	err error
+}
+
+func (e *duplicateError) Error() string {
+	return ErrDuplicate.Error() + ": " + e.err.Error()
+}
+
+func (e *duplicateError) Is(target error) bool { return target == ErrDuplicate }
+func (e *duplicateError) Unwrap() error        { return e.err }
+
+// duplicate заменяет ошибку нарушения уникальности ключа (код 11000) на
+// ошибку, соответствующую ErrDuplicate. Остальные ошибки возвращаются без
+// изменений.
+func duplicate(err error) error {
+	if err != nil && mgo.IsDup(err) {
+		return &duplicateError{err}
+	}
+	return err
+}
+
+// versionQuery возвращает условие выборки документа с указанной версией.
+// Нулевая версия соответствует и документам, сохраненным без версии.
+func versionQuery(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return version
+}
+
+// updateVersioned обновляет документ с указанным идентификатором и версией в
+// рамках группы. Если документ не найден, то проверяется, существует ли он с
+// другой версией: в этом случае возвращается ErrVersionConflict, иначе —
+// ErrNotFound.
+func updateVersioned(coll *mgo.Collection, id interface{}, groupId string, version int, update interface{}) error {
+	err := coll.Update(bson.M{
+		"_id":     id,
+		"groupId": groupId,
+		"version": versionQuery(version),
+	}, update)
+	if err != ErrNotFound {
+		return err
+	}
+	count, err := coll.Find(bson.M{"_id": id, "groupId": groupId}).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrVersionConflict
+	}
+	return ErrNotFound
+}
+
+// storedCreatedAt возвращает сохраненное время создания документа с указанным
+// идентификатором. Если документ не найден, то возвращается нулевое время.
+func storedCreatedAt(coll *mgo.Collection, id interface{}) (time.Time, error) {
+	var doc struct {
+		CreatedAt time.Time `bson:"createdAt"`
+	}
+	err := coll.FindId(id).Select(bson.M{"createdAt": 1}).One(&doc)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return doc.CreatedAt, err
+}
+
+// countGroup возвращает количество документов указанной коллекции,
+// привязанных к группе.
+func (db *DB) countGroup(ctx context.Context, collection, groupId string) (count int, err error) {
+	var result int
+	err = db.exec(ctx, collection, func(coll *mgo.Collection) (err error) {
+		result, err = coll.Find(bson.M{"groupId": groupId}).Count()
+		return
+	})
+	if err == nil {
+		count = result
+	}
+	return
+}
+
+// renameUpdate возвращает описание изменения имени документа. Пустое имя
+// удаляет поле из документа.
+func renameUpdate(name string) bson.M {
+	set := bson.M{"updatedAt": time.Now().UTC()}
+	update := bson.M{"$set": set}
+	if name != "" {
+		set["name"] = name
+	} else {
+		update["$unset"] = bson.M{"name": ""}
+	}
+	return update
+}
+
+// containsRegex возвращает регулярное выражение для поиска строки без учета
+// регистра. Специальные символы регулярных выражений в строке экранируются.
+func containsRegex(s string) bson.RegEx {
+	return bson.RegEx{Pattern: regexp.QuoteMeta(s), Options: "i"}
+}
+
+// execDB выполняет функцию f с копией сессии соединения с MongoDB и закрывает
+// ее по окончании.
+//
+// mgo не поддерживает контекст, поэтому, если контекст может быть отменен,
+// функция выполняется в отдельном потоке. При отмене контекста сессия
+// закрывается сразу, не дожидаясь завершения запроса, а в качестве ошибки
+// возвращается ctx.Err(). Результат такого прерванного запроса игнорируется,
+// поэтому функция f не должна напрямую изменять возвращаемые значения
+// вызывающего метода: только свои локальные переменные.
+func (db *DB) execDB(ctx context.Context, f func(mdb *mgo.Database) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	session := db.session.Copy()
+	// сессия закрывается при любом выходе, в том числе при ошибке или отмене
+	defer session.Close()
+	// если контекст не может быть отменен, то выполняем запрос синхронно
+	if ctx.Done() == nil {
+		return f(session.DB(db.name))
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			// обращение к уже закрытой при отмене контекста сессии вызывает
+			// panic в mgo: в этом случае результат все равно никому не нужен
+			if p := recover(); p != nil {
+				if ctx.Err() == nil {
+					panic(p)
+				}
+				done <- ctx.Err()
+			}
+		}()
+		done <- f(session.DB(db.name))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// c возвращает коллекцию базы данных mdb с указанным именем с учетом префикса
+// названий коллекций.
+func (db *DB) c(mdb *mgo.Database, name string) *mgo.Collection {
+	return mdb.C(db.prefix + name)
+}
+
+// exec выполняет функцию f с коллекцией с указанным именем. Подробнее о работе
+// с контекстом смотри в описании execDB.
+func (db *DB) exec(ctx context.Context, name string, f func(coll *mgo.Collection) error) error {
+	return db.execDB(ctx, func(mdb *mgo.Database) error {
+		return f(db.c(mdb, name))
+	})
+}
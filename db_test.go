@@ -1,9 +1,14 @@
 package model
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/geotrace/geo"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestDBType(t *testing.T) {
@@ -16,10 +21,296 @@ func TestDBType(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer session.Close()
-	db := &DB{session, mdi.Database}
-	users := (*Users)(db)
+	db := &DB{session: session, name: mdi.Database}
+	users := db.Users()
 	_ = users
 	// users.List("groupID")
 	// pretty.Println(db)
 	// pretty.Println(users)
 }
+
+func TestExecCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db := new(DB) // сессия не нужна: запрос не должен начаться
+	if _, err := db.Events().GetContext(ctx, "group", "device",
+		bson.NewObjectId().Hex()); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testDB возвращает описание соединения с тестовой базой данных.
+func testDB(t *testing.T) *DB {
+	session, err := mgo.Dial("mongodb://localhost/geotrace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return InitDB(session, "geotrace_test")
+}
+
+// closeTestDB удаляет тестовую базу данных и закрывает соединение с ней.
+func closeTestDB(db *DB) {
+	db.session.DB(db.name).DropDatabase()
+	db.Close()
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	// повторный вызов не должен приводить к ошибке
+	for i := 0; i < 2; i++ {
+		if err := db.EnsureIndexes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version == "" {
+		t.Error("empty server version")
+	}
+}
+
+func TestInitDBWithOptions(t *testing.T) {
+	session, err := mgo.Dial("mongodb://localhost/geotrace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := mgo.Monotonic
+	db := InitDBWithOptions(session, "geotrace_test", Options{
+		PoolLimit:     10,
+		SocketTimeout: 5 * time.Second,
+		Mode:          &mode,
+	})
+	defer db.Close()
+	if mode := db.session.Mode(); mode != mgo.Monotonic {
+		t.Errorf("unexpected mode: %v", mode)
+	}
+	// режим работы наследуется копиями сессии
+	if err := db.execDB(context.Background(), func(mdb *mgo.Database) error {
+		if mode := mdb.Session.Mode(); mode != mgo.Monotonic {
+			t.Errorf("unexpected copied session mode: %v", mode)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// без указания режима он не изменяется
+	strong := session.Copy()
+	defer strong.Close()
+	strong.SetMode(mgo.Strong, true)
+	InitDBWithOptions(strong, "geotrace_test", Options{PoolLimit: 10})
+	if mode := strong.Mode(); mode != mgo.Strong {
+		t.Errorf("mode changed: %v", mode)
+	}
+}
+
+func TestSetSafeMode(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	db.SetMode(mgo.Eventual, true)
+	db.SetSafe(&mgo.Safe{WMode: "majority"})
+	if err := db.execDB(context.Background(), func(mdb *mgo.Database) error {
+		if mode := mdb.Session.Mode(); mode != mgo.Eventual {
+			t.Errorf("unexpected mode: %v", mode)
+		}
+		if safe := mdb.Session.Safe(); safe == nil || safe.WMode != "majority" {
+			t.Errorf("unexpected safe: %#v", safe)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	for _, id := range []string{"1", "2"} {
+		if err := db.Devices().Create("group", &Device{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Users().Create(&User{Login: "login", GroupID: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range []func(string) (int, error){
+		db.Devices().Count, db.Users().Count, db.Places().Count,
+	} {
+		if n, err := count("other"); err != nil || n != 0 {
+			t.Errorf("unexpected count for other group: %d, %v", n, err)
+		}
+	}
+	if n, err := db.Devices().Count("group"); err != nil || n != 2 {
+		t.Errorf("unexpected devices count: %d, %v", n, err)
+	}
+	if n, err := db.Users().Count("group"); err != nil || n != 1 {
+		t.Errorf("unexpected users count: %d, %v", n, err)
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	stats, err := db.GroupStats("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Empty() {
+		t.Errorf("unexpected stats for empty group: %+v", stats)
+	}
+	if err := db.Devices().Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Users().Create(&User{Login: "login", GroupID: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Events().Create("group", "device", new(Event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, err = db.GroupStats("group"); err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (GroupStats{Users: 1, Devices: 1, Events: 3}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDBStore(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	store := db.Store()
+	if err := store.Devices().Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Devices().Get("group", "device"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSessionLeak(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	mgo.SetStats(true)
+	defer mgo.SetStats(false)
+	mgo.ResetStats()
+	before := mgo.GetStats().SocketsInUse
+	for i := 0; i < 1000; i++ {
+		if _, err := events.Get("group", "device", "bad"); err != ErrBadObjectId {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := events.Get("group", "device", bson.NewObjectId().Hex()); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if after := mgo.GetStats().SocketsInUse; after > before {
+		t.Errorf("sessions leaked: %d sockets in use, was %d", after, before)
+	}
+}
+
+func TestDeleteGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	for _, groupId := range []string{"group", "other"} {
+		if err := db.Users().Create(&User{GroupID: groupId}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Devices().Create(groupId, &Device{ID: groupId + "-device"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := db.Events().Create(groupId, groupId+"-device", new(Event)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	removed, err := db.DeleteGroup("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *removed != (GroupStats{Users: 1, Devices: 1, Events: 2}) {
+		t.Errorf("unexpected removed: %+v", removed)
+	}
+	if stats, err := db.GroupStats("group"); err != nil || !stats.Empty() {
+		t.Errorf("group is not empty: %+v, %v", stats, err)
+	}
+	if stats, err := db.GroupStats("other"); err != nil || stats.Empty() {
+		t.Errorf("other group is deleted: %+v, %v", stats, err)
+	}
+}
+
+func TestCollectionErrors(t *testing.T) {
+	err := CollectionErrors{
+		CollectionUsers:  errors.New("b"),
+		CollectionEvents: errors.New("a"),
+	}
+	if msg := err.Error(); msg != CollectionEvents+": a; "+CollectionUsers+": b" {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+func TestDBWithPrefix(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	staging := db.WithPrefix("staging_")
+	if db.prefix != "" {
+		t.Fatalf("original prefix changed: %q", db.prefix)
+	}
+	if err := staging.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	indexes, err := db.session.DB(db.name).C("staging_events").Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) < 2 {
+		t.Errorf("indexes are not created for prefixed collection: %v", indexes)
+	}
+	if err := staging.Devices().Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{Location: &geo.Point{37.61, 55.75}}
+	if err := staging.Events().Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]int{
+		"staging_devices": 1,
+		"staging_events":  1,
+		"devices":         0,
+		"events":          0,
+	} {
+		count, err := db.session.DB(db.name).C(name).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("%s: unexpected count: %d", name, count)
+		}
+	}
+	if _, err := staging.Events().Get("group", "device", event.ID.Hex()); err != nil {
+		t.Errorf("prefixed event not found: %v", err)
+	}
+	if _, err := db.Events().Get("group", "device", event.ID.Hex()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	stats, err := staging.GroupStats("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Devices != 1 || stats.Events != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -1,75 +1,754 @@
 package model
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/geotrace/geo"
 	"github.com/geotrace/uid"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-type Devices DB // для обращения к данным об устройствах
+// Devices предоставляет доступ к данным об устройствах. Получить его можно
+// с помощью метода DB.Devices.
+type Devices DB
 
 // Login возвращает авторизационную информацию об устройстве
 func (db *Devices) Login(id string) (device *Device, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	device = new(Device)
-	err = coll.FindId(id).One(device)
-	session.Close()
+	return db.LoginContext(context.Background(), id)
+}
+
+// LoginContext работает как Login, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) LoginContext(ctx context.Context, id string) (device *Device, err error) {
+	result := new(Device)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.FindId(id).One(result)
+	})
+	if err == nil {
+		device = result
+	}
+	return
+}
+
+// Authenticate проверяет пароль устройства и возвращает его описание, если
+// пароль верен. Хеш пароля в возвращаемом описании не заполняется. Если
+// устройство не найдено, то возвращается ErrNotFound, а если пароль неверен —
+// ErrWrongPassword.
+func (db *Devices) Authenticate(id, password string) (device *Device, err error) {
+	return db.AuthenticateContext(context.Background(), id, password)
+}
+
+// AuthenticateContext работает как Authenticate, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) AuthenticateContext(ctx context.Context, id, password string) (device *Device, err error) {
+	result, err := db.LoginContext(ctx, id)
+	if err != nil {
+		return
+	}
+	if !result.Password.Compare(password) {
+		err = ErrWrongPassword
+		return
+	}
+	result.Password = nil
+	device = result
 	return
 }
 
 // Get возвращает информацию о устройстве с указанным идентификатором, которое
 // привязано к указанной группе.
 func (db *Devices) Get(groupId, id string) (device *Device, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	device = new(Device)
-	err = coll.Find(bson.M{"_id": id, "groupId": groupId}).
-		Select(bson.M{"groupId": 0, "password": 0}).One(device)
-	session.Close()
+	return db.GetContext(context.Background(), groupId, id)
+}
+
+// GetContext работает как Get, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) GetContext(ctx context.Context, groupId, id string) (device *Device, err error) {
+	result := new(Device)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": id, "groupId": groupId}).
+			Select(bson.M{"groupId": 0, "password": 0}).One(result)
+	})
+	if err == nil {
+		device = result
+	} else {
+		err = notFound(err, CollectionDevices, groupId, id)
+	}
+	return
+}
+
+// GetFields работает как Get, но возвращает только указанные поля устройства
+// (названия задаются так же, как в хранилище), что позволяет сократить объем
+// передаваемых данных. Хеш пароля запросить нельзя: для него,
+// как и для неизвестных полей, возвращается ErrBadField.
+func (db *Devices) GetFields(groupId, id string, fields ...string) (device *Device, err error) {
+	return db.GetFieldsContext(context.Background(), groupId, id, fields...)
+}
+
+// GetFieldsContext работает как GetFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Devices) GetFieldsContext(ctx context.Context, groupId, id string, fields ...string) (device *Device, err error) {
+	selector, err := fieldSelector((*Device)(nil), fields, "password")
+	if err != nil {
+		return
+	}
+	result := new(Device)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": id, "groupId": groupId}).Select(selector).One(result)
+	})
+	if err == nil {
+		device = result
+	} else {
+		err = notFound(err, CollectionDevices, groupId, id)
+	}
+	return
+}
+
+// ListFields работает как List, но возвращает только указанные поля
+// устройства так же, как GetFields.
+func (db *Devices) ListFields(groupID string, fields ...string) (devices []*Device, err error) {
+	return db.ListFieldsContext(context.Background(), groupID, fields...)
+}
+
+// ListFieldsContext работает как ListFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Devices) ListFieldsContext(ctx context.Context, groupID string, fields ...string) (devices []*Device, err error) {
+	selector, err := fieldSelector((*Device)(nil), fields, "password")
+	if err != nil {
+		return
+	}
+	result := make([]*Device, 0)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).Select(selector).All(&result)
+	})
+	if err == nil {
+		devices = result
+	}
 	return
 }
 
 // List возвращает список всех устройств, которые зарегистрированы для данной
 // группы пользователей.
 func (db *Devices) List(groupID string) (devices []*Device, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	devices = make([]*Device, 0)
-	err = coll.Find(bson.M{"groupId": groupID}).
-		Select(bson.M{"groupId": 0, "password": 0}).All(&devices)
-	session.Close()
+	return db.ListContext(context.Background(), groupID)
+}
+
+// ListContext работает как List, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) ListContext(ctx context.Context, groupID string) (devices []*Device, err error) {
+	result := make([]*Device, 0)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).
+			Select(bson.M{"groupId": 0, "password": 0}).All(&result)
+	})
+	if err == nil {
+		devices = result
+	}
+	return
+}
+
+// Search возвращает список устройств группы, отображаемое имя которых содержит
+// указанную строку без учета регистра. Строка ищется как есть: специальные
+// символы регулярных выражений в ней не учитываются.
+func (db *Devices) Search(groupId, query string) (devices []*Device, err error) {
+	return db.SearchContext(context.Background(), groupId, query)
+}
+
+// SearchContext работает как Search, но позволяет прервать выполнение запроса
+// с помощью контекста.
+func (db *Devices) SearchContext(ctx context.Context, groupId, query string) (devices []*Device, err error) {
+	result := make([]*Device, 0)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupId, "name": containsRegex(query)}).
+			Select(bson.M{"groupId": 0, "password": 0}).All(&result)
+	})
+	if err == nil {
+		devices = result
+	}
+	return
+}
+
+// ListByType возвращает список устройств группы с указанным типом. Если таких
+// устройств нет, то возвращается пустой список.
+func (db *Devices) ListByType(groupId, deviceType string) (devices []*Device, err error) {
+	return db.ListByTypeContext(context.Background(), groupId, deviceType)
+}
+
+// ListByTypeContext работает как ListByType, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Devices) ListByTypeContext(ctx context.Context, groupId, deviceType string) (devices []*Device, err error) {
+	result := make([]*Device, 0)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupId, "type": deviceType}).
+			Select(bson.M{"groupId": 0, "password": 0}).All(&result)
+	})
+	if err == nil {
+		devices = result
+	}
+	return
+}
+
+// LastSeen возвращает время последнего события устройства группы. События,
+// помеченные как удаленные, не учитываются. Если от устройства не было ни
+// одного события, то возвращается ErrNotFound. Для запроса используется
+// индекс по группе, устройству и времени событий.
+func (db *Devices) LastSeen(groupId, id string) (lastSeen time.Time, err error) {
+	return db.LastSeenContext(context.Background(), groupId, id)
+}
+
+// LastSeenContext работает как LastSeen, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Devices) LastSeenContext(ctx context.Context, groupId, id string) (lastSeen time.Time, err error) {
+	var result struct {
+		Time time.Time `bson:"time"`
+	}
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{"groupId": groupId, "deviceId": id})).
+			Select(bson.M{"time": 1}).Sort("-time").One(&result)
+	})
+	if err == nil {
+		lastSeen = result.Time
+	}
+	return
+}
+
+// DeviceLastSeen описывает устройство вместе со временем его последнего
+// события.
+type DeviceLastSeen struct {
+	Device `bson:",inline"`
+	// время последнего события устройства; не задано, если событий не было
+	LastSeen time.Time `bson:"lastSeen,omitempty" json:"lastSeen,omitempty"`
+}
+
+// ListWithLastSeen возвращает список устройств группы, дополненный временем
+// последнего события каждого из них. Время последних событий всех устройств
+// вычисляется одним запросом агрегации.
+func (db *Devices) ListWithLastSeen(groupId string) (devices []*DeviceLastSeen, err error) {
+	return db.ListWithLastSeenContext(context.Background(), groupId)
+}
+
+// ListWithLastSeenContext работает как ListWithLastSeen, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) ListWithLastSeenContext(ctx context.Context, groupId string) (devices []*DeviceLastSeen, err error) {
+	list := make([]*Device, 0)
+	var seen []struct {
+		DeviceID string    `bson:"_id"`
+		Time     time.Time `bson:"time"`
+	}
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) error {
+		err := (*DB)(db).c(mdb, CollectionDevices).Find(bson.M{"groupId": groupId}).
+			Select(bson.M{"groupId": 0, "password": 0}).All(&list)
+		if err != nil {
+			return err
+		}
+		return (*DB)(db).c(mdb, CollectionEvents).Pipe([]bson.M{
+			{"$match": notDeleted(bson.M{"groupId": groupId})},
+			{"$group": bson.M{"_id": "$deviceId", "time": bson.M{"$max": "$time"}}},
+		}).All(&seen)
+	})
+	if err != nil {
+		return
+	}
+	lastSeen := make(map[string]time.Time, len(seen))
+	for _, item := range seen {
+		lastSeen[item.DeviceID] = item.Time
+	}
+	devices = make([]*DeviceLastSeen, len(list))
+	for i, device := range list {
+		devices[i] = &DeviceLastSeen{Device: *device, LastSeen: lastSeen[device.ID]}
+	}
+	return
+}
+
+// DeviceStatus описывает устройство вместе со временем его последнего события
+// и состоянием связи с ним.
+type DeviceStatus struct {
+	Device `bson:",inline"`
+	// время последнего события устройства; не задано, если событий не было
+	LastSeen time.Time `bson:"lastSeen,omitempty" json:"lastSeen,omitempty"`
+	// состояние связи: DeviceOnline, DeviceOffline или DeviceStatusUnknown
+	Status string `bson:"status" json:"status"`
+}
+
+// ListWithStatus возвращает список устройств группы, дополненный временем
+// последнего события и состоянием связи с каждым из них на текущий момент (см.
+// Device.Status). Если offlineAfter не больше нуля, то используется
+// DefaultOfflineAfter.
+func (db *Devices) ListWithStatus(groupId string, offlineAfter time.Duration) (devices []*DeviceStatus, err error) {
+	return db.ListWithStatusContext(context.Background(), groupId, offlineAfter)
+}
+
+// ListWithStatusContext работает как ListWithStatus, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) ListWithStatusContext(ctx context.Context, groupId string, offlineAfter time.Duration) (devices []*DeviceStatus, err error) {
+	list, err := db.ListWithLastSeenContext(ctx, groupId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	devices = make([]*DeviceStatus, len(list))
+	for i, item := range list {
+		devices[i] = &DeviceStatus{
+			Device:   item.Device,
+			LastSeen: item.LastSeen,
+			Status:   item.Status(item.LastSeen, now, offlineAfter),
+		}
+	}
+	return
+}
+
+// NearestMaxAge задает, насколько давно должны быть получены координаты
+// устройства, чтобы NearestToPoint его учитывал. Нулевое значение снимает
+// ограничение.
+var NearestMaxAge = time.Hour
+
+// DeviceDistance описывает устройство вместе с его последними известными
+// координатами и расстоянием от них до заданной точки.
+type DeviceDistance struct {
+	Device `bson:",inline"`
+	// последние известные координаты устройства
+	Location geo.Point `bson:"location" json:"location"`
+	// время события, в котором были получены координаты
+	Time time.Time `bson:"time" json:"time"`
+	// расстояние до точки в метрах
+	Distance float64 `bson:"distance" json:"distance"`
+}
+
+// NearestToPoint возвращает до limit устройств группы, последние известные
+// координаты которых находятся ближе всего к указанной точке, упорядоченных по
+// возрастанию расстояния. Последние координаты устройства берутся из его самого
+// позднего события с координатами. Устройства, у которых таких событий нет или
+// последние координаты получены раньше, чем NearestMaxAge назад, в результат
+// не попадают. Размер limit ограничивается так же, как размер страницы в
+// Events.ListPaged.
+func (db *Devices) NearestToPoint(groupId string, p geo.Point, limit int) (devices []*DeviceDistance, err error) {
+	return db.NearestToPointContext(context.Background(), groupId, p, limit)
+}
+
+// NearestToPointContext работает как NearestToPoint, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) NearestToPointContext(ctx context.Context, groupId string, p geo.Point, limit int) (devices []*DeviceDistance, err error) {
+	limit = pageLimit(limit)
+	match := notDeleted(bson.M{
+		"groupId":  groupId,
+		"location": bson.M{"$exists": true},
+	})
+	if NearestMaxAge > 0 {
+		match["time"] = bson.M{"$gte": time.Now().Add(-NearestMaxAge)}
+	}
+	var latest []struct {
+		DeviceID string    `bson:"_id"`
+		Location geo.Point `bson:"location"`
+		Time     time.Time `bson:"time"`
+		Distance float64
+	}
+	list := make([]*Device, 0)
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) error {
+		err := (*DB)(db).c(mdb, CollectionEvents).Pipe([]bson.M{
+			{"$match": match},
+			{"$sort": bson.M{"time": -1}},
+			{"$group": bson.M{
+				"_id":      "$deviceId",
+				"location": bson.M{"$first": "$location"},
+				"time":     bson.M{"$first": "$time"},
+			}},
+		}).All(&latest)
+		if err != nil {
+			return err
+		}
+		for i := range latest {
+			latest[i].Distance = distance(p, latest[i].Location)
+		}
+		sort.SliceStable(latest, func(i, j int) bool {
+			return latest[i].Distance < latest[j].Distance
+		})
+		// ограничение применяется после исключения удаленных устройств, поэтому
+		// запрашиваются описания всех найденных устройств
+		ids := make([]string, len(latest))
+		for i, item := range latest {
+			ids[i] = item.DeviceID
+		}
+		return (*DB)(db).c(mdb, CollectionDevices).Find(bson.M{
+			"_id":     bson.M{"$in": ids},
+			"groupId": groupId,
+		}).Select(bson.M{"groupId": 0, "password": 0}).All(&list)
+	})
+	if err != nil {
+		return
+	}
+	found := make(map[string]*Device, len(list))
+	for _, device := range list {
+		found[device.ID] = device
+	}
+	devices = make([]*DeviceDistance, 0, limit)
+	for _, item := range latest {
+		if len(devices) == limit {
+			break
+		}
+		// события удаленных или перенесенных в другую группу устройств
+		// пропускаем
+		if device, ok := found[item.DeviceID]; ok {
+			devices = append(devices, &DeviceDistance{
+				Device:   *device,
+				Location: item.Location,
+				Time:     item.Time,
+				Distance: item.Distance,
+			})
+		}
+	}
 	return
 }
 
+// Count возвращает количество устройств, зарегистрированных в указанной группе.
+func (db *Devices) Count(groupId string) (count int, err error) {
+	return db.CountContext(context.Background(), groupId)
+}
+
+// CountContext работает как Count, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) CountContext(ctx context.Context, groupId string) (count int, err error) {
+	return (*DB)(db).countGroup(ctx, CollectionDevices, groupId)
+}
+
 // Create создает описание нового устройства, одновременно привязывая его к
 // указанной группе.
 func (db *Devices) Create(groupId string, device *Device) (err error) {
+	return db.CreateContext(context.Background(), groupId, device)
+}
+
+// CreateContext работает как Create, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) CreateContext(ctx context.Context, groupId string, device *Device) (err error) {
 	if device.ID == "" {
 		device.ID = uid.New()
 	}
 	device.GroupID = groupId
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	err = coll.Insert(device)
-	session.Close()
+	now := time.Now().UTC()
+	device.CreatedAt, device.UpdatedAt = now, now
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return duplicate(coll.Insert(device))
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditCreate, CollectionDevices, groupId, device.ID)
+	}
 	return
 }
 
-// Update обновляет описание устройства и привязывает его к указанной группе.
+// Update обновляет описание устройства, привязанного к указанной группе. Если
+// устройство не привязано к этой группе, то возвращается ErrNotFound: для
+// смены группы используется ChangeGroup.
+//
+// Обновляются только имя и тип устройства. Пароль обновляется только в том
+// случае, если он задан: описание устройства, полученное через Get, не содержит
+// пароля, и его сохранение не должно приводить к потере пароля.
+//
+// Описание сохраняется только в том случае, если его версия совпадает с
+// сохраненной, т.е. оно не было изменено с момента чтения. В противном случае
+// возвращается ErrVersionConflict. При успешном обновлении версия
+// увеличивается.
 func (db *Devices) Update(groupId string, device *Device) (err error) {
+	return db.UpdateContext(context.Background(), groupId, device)
+}
+
+// UpdateContext работает как Update, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) UpdateContext(ctx context.Context, groupId string, device *Device) (err error) {
 	device.GroupID = groupId
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	err = coll.UpdateId(device.ID, device)
-	session.Close()
+	now := time.Now().UTC()
+	update := device.update(now)
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return updateVersioned(coll, device.ID, groupId, device.Version, update)
+	})
+	if err == nil {
+		device.Version++
+		device.UpdatedAt = now
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, groupId, device.ID)
+	}
+	return
+}
+
+// update возвращает описание изменений для обновления сохраненного описания
+// устройства. Имя и тип устройства заменяются, а пароль — только если задан.
+// Версия описания увеличивается, а время изменения устанавливается в now.
+func (d *Device) update(now time.Time) bson.M {
+	set, unset := bson.M{"updatedAt": now}, bson.M{}
+	for name, value := range map[string]string{
+		"name": d.Name,
+		"type": d.Type,
+	} {
+		if value != "" {
+			set[name] = value
+		} else {
+			unset[name] = ""
+		}
+	}
+	if len(d.Password) > 0 {
+		set["password"] = d.Password
+	}
+	update := bson.M{"$inc": bson.M{"version": 1}, "$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// Upsert создает описание устройства в указанной группе или обновляет его, если
+// устройство с таким идентификатором уже существует, и возвращает true, если
+// было создано новое описание. Как и в Update, сохраненный пароль не
+// заменяется пустым.
+//
+// Устройство не может быть перенесено таким образом в другую группу: если
+// устройство с таким идентификатором уже привязано к другой группе, то
+// возвращается ошибка дублирования ключа.
+func (db *Devices) Upsert(groupId string, device *Device) (created bool, err error) {
+	return db.UpsertContext(context.Background(), groupId, device)
+}
+
+// UpsertContext работает как Upsert, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) UpsertContext(ctx context.Context, groupId string, device *Device) (created bool, err error) {
+	if device.ID == "" {
+		device.ID = uid.New()
+	}
+	device.GroupID = groupId
+	now := time.Now().UTC()
+	update := device.update(now)
+	update["$setOnInsert"] = bson.M{"createdAt": now}
+	var info *mgo.ChangeInfo
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) (err error) {
+		info, err = coll.Upsert(bson.M{"_id": device.ID, "groupId": groupId}, update)
+		return duplicate(err)
+	})
+	if err == nil {
+		created = info.UpsertedId != nil
+		action := AuditUpdate
+		if created {
+			device.CreatedAt = now
+			action = AuditCreate
+		}
+		device.UpdatedAt = now
+		(*DB)(db).audit(ctx, action, CollectionDevices, groupId, device.ID)
+	}
 	return
 }
 
-// Delete удаляет описание устройства.
+// Rename изменяет только имя устройства, привязанного к указанной группе,
+// не затрагивая остальные поля описания. Версия описания увеличивается, чтобы
+// последующее Update с прежней версией не затерло новое имя. Пустое имя
+// удаляет его. Если устройство не найдено, то возвращается ErrNotFound.
+func (db *Devices) Rename(groupId, id, name string) (err error) {
+	return db.RenameContext(context.Background(), groupId, id, name)
+}
+
+// RenameContext работает как Rename, но позволяет прервать выполнение запроса
+// с помощью контекста.
+func (db *Devices) RenameContext(ctx context.Context, groupId, id, name string) (err error) {
+	update := renameUpdate(name)
+	update["$inc"] = bson.M{"version": 1}
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"_id": id, "groupId": groupId}, update)
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, groupId, id)
+	}
+	return
+}
+
+// SetPassword устанавливает новый пароль устройства, привязанного к указанной
+// группе. В хранилище сохраняется только хеш пароля. Версия описания при этом
+// увеличивается, как и при Update. Если устройство не найдено, то
+// возвращается ErrNotFound.
+func (db *Devices) SetPassword(groupId, id, password string) (err error) {
+	return db.SetPasswordContext(context.Background(), groupId, id, password)
+}
+
+// SetPasswordContext работает как SetPassword, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Devices) SetPasswordContext(ctx context.Context, groupId, id, password string) (err error) {
+	passwd, err := NewPassword(password)
+	if err != nil {
+		return
+	}
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"_id": id, "groupId": groupId}, bson.M{
+			"$set": bson.M{"password": passwd, "updatedAt": time.Now().UTC()},
+			"$inc": bson.M{"version": 1},
+		})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, groupId, id)
+	}
+	return
+}
+
+// ResetAllPasswords задает новые случайные пароли для всех устройств группы и
+// возвращает их в виде словаря, где ключом является идентификатор устройства.
+// Пароли создаются криптографически стойким генератором (RandomPassword), а в
+// хранилище сохраняются только их хеши: полученные пароли нигде больше не
+// сохраняются и не могут быть получены повторно, поэтому их нужно сразу
+// передать владельцам устройств.
+//
+// Пароли меняются для каждого устройства по очереди, и версия описания каждого
+// измененного устройства увеличивается. Если при этом произошла ошибка, то
+// вместе с ней возвращаются пароли устройств, которые уже были изменены, чтобы
+// они не были потеряны.
+func (db *Devices) ResetAllPasswords(groupId string) (passwords map[string]string, err error) {
+	return db.ResetAllPasswordsContext(context.Background(), groupId)
+}
+
+// ResetAllPasswordsContext работает как ResetAllPasswords, но позволяет
+// прервать выполнение запроса с помощью контекста. При отмене контекста
+// пароли не возвращаются, хотя часть из них уже может быть изменена: в этом
+// случае метод нужно вызвать повторно.
+func (db *Devices) ResetAllPasswordsContext(ctx context.Context, groupId string) (passwords map[string]string, err error) {
+	result := make(map[string]string)
+	// при отмене контекста запрос может продолжать заполнять словарь, поэтому
+	// в этом случае он не возвращается
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		var ids []struct {
+			ID string `bson:"_id"`
+		}
+		err := coll.Find(bson.M{"groupId": groupId}).Select(bson.M{"_id": 1}).All(&ids)
+		if err != nil {
+			return err
+		}
+		for _, device := range ids {
+			password, err := RandomPassword()
+			if err != nil {
+				return err
+			}
+			// случайный пароль не проверяется политикой: иначе более строгая
+			// политика прерывала бы сброс паролей
+			passwd, err := hashPassword(password, DefaultPasswordCost)
+			if err != nil {
+				return err
+			}
+			err = coll.Update(bson.M{"_id": device.ID, "groupId": groupId}, bson.M{
+				"$set": bson.M{"password": passwd, "updatedAt": time.Now().UTC()},
+				"$inc": bson.M{"version": 1},
+			})
+			if err == ErrNotFound {
+				// устройство было удалено или перенесено в другую группу
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result[device.ID] = password
+			// записываем в журнал сразу: при ошибке или отмене контекста
+			// измененные пароли все равно должны попасть в журнал
+			(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, groupId, device.ID)
+		}
+		return nil
+	})
+	if err != context.Canceled && err != context.DeadlineExceeded {
+		passwords = result
+	}
+	return
+}
+
+// ChangeGroup привязывает устройство к новой группе пользователей и увеличивает
+// версию его описания. Если устройство не привязано к группе oldGroupId, то
+// возвращается ErrNotFound.
+//
+// Уже сохраненные события устройства остаются привязаны к старой группе,
+// поэтому пользователи новой группы не получат доступа к ним: им будут видны
+// только события, зарегистрированные после смены группы.
+func (db *Devices) ChangeGroup(oldGroupId, id, newGroupId string) (err error) {
+	return db.ChangeGroupContext(context.Background(), oldGroupId, id, newGroupId)
+}
+
+// ChangeGroupContext работает как ChangeGroup, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) ChangeGroupContext(ctx context.Context, oldGroupId, id, newGroupId string) (err error) {
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"_id": id, "groupId": oldGroupId}, bson.M{
+			"$set": bson.M{"groupId": newGroupId, "updatedAt": time.Now().UTC()},
+			"$inc": bson.M{"version": 1},
+		})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, oldGroupId, id)
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionDevices, newGroupId, id)
+	}
+	return
+}
+
+// Delete удаляет описание устройства. События устройства при этом не
+// удаляются: для этого используйте DeleteWithEvents, а для очистки уже
+// оставшихся без устройства событий — Events.DeletePurgeForDevice.
 func (db *Devices) Delete(groupId, id string) (err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionDevices)
-	err = coll.Remove(bson.M{"_id": id, "groupId": groupId})
-	session.Close()
+	return db.DeleteContext(context.Background(), groupId, id)
+}
+
+// DeleteContext работает как Delete, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Devices) DeleteContext(ctx context.Context, groupId, id string) (err error) {
+	err = (*DB)(db).exec(ctx, CollectionDevices, func(coll *mgo.Collection) error {
+		return coll.Remove(bson.M{"_id": id, "groupId": groupId})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionDevices, groupId, id)
+	}
+	return
+}
+
+// DeleteError возвращается DeleteWithEvents, если события устройства уже были
+// удалены, но удалить само описание устройства не удалось.
+type DeleteError struct {
+	// количество удаленных событий устройства
+	EventsRemoved int
+	// ошибка удаления описания устройства
+	Err error
+}
+
+func (e *DeleteError) Error() string {
+	return fmt.Sprintf("device events removed (%d), but device not deleted: %v",
+		e.EventsRemoved, e.Err)
+}
+
+// DeleteWithEvents удаляет описание устройства вместе со всеми его событиями,
+// включая помеченные как удаленные. Если устройство не найдено, то
+// возвращается ErrNotFound и события не затрагиваются.
+//
+// Драйвер не поддерживает транзакции, охватывающие несколько документов,
+// поэтому удаление выполняется последовательно: сначала удаляются события, а
+// затем описание устройства. При прерывании между этими шагами устройство
+// остается без событий, но события без устройства не появляются. Если
+// события удалены, а удалить устройство не удалось, то возвращается
+// *DeleteError; повторный вызов DeleteWithEvents завершит удаление.
+func (db *Devices) DeleteWithEvents(groupId, id string) (err error) {
+	return db.DeleteWithEventsContext(context.Background(), groupId, id)
+}
+
+// DeleteWithEventsContext работает как DeleteWithEvents, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Devices) DeleteWithEventsContext(ctx context.Context, groupId, id string) (err error) {
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) error {
+		devices := (*DB)(db).c(mdb, CollectionDevices)
+		selector := bson.M{"_id": id, "groupId": groupId}
+		n, err := devices.Find(selector).Count()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		removed, err := removeDeviceEvents((*DB)(db).c(mdb, CollectionEvents), groupId, id)
+		if err != nil {
+			return err
+		}
+		(*DB)(db).auditCount(ctx, AuditDelete, CollectionEvents, groupId, removed)
+		if err = devices.Remove(selector); err != nil {
+			return &DeleteError{EventsRemoved: removed, Err: err}
+		}
+		return nil
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionDevices, groupId, id)
+	}
 	return
 }
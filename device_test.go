@@ -0,0 +1,645 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDevicesChangeGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices, events := db.Devices(), db.Events()
+	if err := devices.Create("old", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Create("old", "device", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.ChangeGroup("other", "device", "new"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := devices.ChangeGroup("old", "device", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := devices.Get("new", "device"); err != nil {
+		t.Error(err)
+	}
+	if _, err := devices.Get("old", "device"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// старые события не должны стать доступны новой группе
+	list, err := events.List("new", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("old events are visible to the new group: %v", list)
+	}
+	if list, err = events.List("old", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("unexpected old group events: %v", list)
+	}
+}
+
+func TestDevicesSearch(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	for _, device := range []*Device{
+		{ID: "1", Name: "Tracker A.B"},
+		{ID: "2", Name: "tracker axb"},
+		{ID: "3", Name: "Phone"},
+	} {
+		if err := devices.Create("group", device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := devices.Search("group", "TRACKER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected devices: %v", list)
+	}
+	if list, err = devices.Search("group", "a.b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "1" {
+		t.Errorf("unexpected devices: %v", list)
+	}
+	if list, err = devices.Search("group", "watch"); err != nil {
+		t.Fatal(err)
+	}
+	if list == nil || len(list) != 0 {
+		t.Errorf("unexpected devices: %v", list)
+	}
+}
+
+func TestDevicesUpdateKeepsPassword(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{ID: "device", Name: "old", Password: passwd}
+	if err := devices.Create("group", device); err != nil {
+		t.Fatal(err)
+	}
+	// описание, полученное через Get, не содержит пароля
+	if device, err = devices.Get("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	device.Name = "new"
+	if err := devices.Update("group", device); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := devices.Login("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "new" {
+		t.Errorf("unexpected name: %q", stored.Name)
+	}
+	if !stored.Password.Compare("secret") {
+		t.Error("device password is clobbered by update")
+	}
+	if err := devices.Update("other", device); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDevicesPassword(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	if err := devices.Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.SetPassword("other", "device", "secret"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := devices.SetPassword("group", "device", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	device, err := devices.Authenticate("device", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.ID != "device" || device.Password != nil {
+		t.Errorf("unexpected device: %#v", device)
+	}
+	if _, err := devices.Authenticate("device", "wrong"); err != ErrWrongPassword {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := devices.Authenticate("unknown", "secret"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDevicesUpsert(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := devices.Upsert("group",
+		&Device{ID: "device", Name: "old", Password: passwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("device is not created")
+	}
+	created, err = devices.Upsert("group", &Device{ID: "device", Name: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("device is created twice")
+	}
+	stored, err := devices.Login("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "new" || !stored.Password.Compare("secret") {
+		t.Errorf("unexpected device: %#v", stored)
+	}
+	if _, err := devices.Upsert("other", &Device{ID: "device"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDevicesUpdateVersion(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	if err := devices.Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Name = "first"
+	if err := devices.Update("group", first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 1 {
+		t.Errorf("unexpected version: %d", first.Version)
+	}
+	second.Name = "second"
+	if err := devices.Update("group", second); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	first.Name = "third"
+	if err := devices.Update("group", first); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDevicesTimestamps(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	device := &Device{ID: "device", Name: "Tracker"}
+	if err := devices.Create("group", device); err != nil {
+		t.Fatal(err)
+	}
+	if device.CreatedAt.IsZero() || !device.UpdatedAt.Equal(device.CreatedAt) {
+		t.Errorf("unexpected timestamps: %v, %v", device.CreatedAt, device.UpdatedAt)
+	}
+	stored, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	stored.Name = "Phone"
+	if err := devices.Update("group", stored); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.CreatedAt.Equal(stored.CreatedAt) {
+		t.Errorf("created time changed: %v != %v", updated.CreatedAt, stored.CreatedAt)
+	}
+	if !updated.UpdatedAt.After(stored.CreatedAt) {
+		t.Errorf("updated time not changed: %v", updated.UpdatedAt)
+	}
+}
+
+func TestDevicesRename(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{ID: "device", Name: "Old", Password: passwd}
+	if err := devices.Create("group", device); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Rename("group", "device", "New"); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Rename("other", "device", "New"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := devices.Authenticate("device", "password"); err != nil {
+		t.Errorf("password lost after rename: %v", err)
+	}
+	stored, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "New" || stored.Version != device.Version+1 {
+		t.Errorf("unexpected renamed device: %v", stored)
+	}
+	// изменение описания с прежней версией не должно затереть новое имя
+	if err := devices.Update("group", device); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDevicesFieldChangesVersion(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	if err := devices.Create("group", &Device{ID: "device"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func() error{
+		"password": func() error { return devices.SetPassword("group", "device", "password") },
+		"reset":    func() error { _, err := devices.ResetAllPasswords("group"); return err },
+		"group": func() error {
+			if err := devices.ChangeGroup("group", "device", "other"); err != nil {
+				return err
+			}
+			return devices.ChangeGroup("other", "device", "group")
+		},
+	} {
+		stale, err := devices.Get("group", "device")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := change(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// изменение описания с прежней версией не должно затереть изменения
+		if err := devices.Update("group", stale); err != ErrVersionConflict {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestDevicesDeleteWithEvents(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices, events := db.Devices(), db.Events()
+	for _, id := range []string{"device", "other"} {
+		if err := devices.Create("group", &Device{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := events.Create("group", id, new(Event)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := devices.DeleteWithEvents("other-group", "device"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := devices.DeleteWithEvents("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := devices.Get("group", "device"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// события удаленного устройства не должны остаться в хранилище
+	n, err := db.session.DB(db.name).C(CollectionEvents).Find(
+		bson.M{"deviceId": "device"}).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("orphan events remain: %d", n)
+	}
+	if n, err := events.Count("group", "other"); err != nil || n != 2 {
+		t.Errorf("unexpected other device events: %d, %v", n, err)
+	}
+}
+
+func TestDevicesLastSeen(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices, events := db.Devices(), db.Events()
+	for _, id := range []string{"device", "silent"} {
+		if err := devices.Create("group", &Device{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := devices.LastSeen("group", "device"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		event := &Event{Time: now.Add(time.Duration(-i) * time.Hour)}
+		if err := events.Create("group", "device", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastSeen, err := devices.LastSeen("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastSeen.Equal(now) {
+		t.Errorf("unexpected last seen: %v", lastSeen)
+	}
+	list, err := devices.ListWithLastSeen("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected devices: %v", list)
+	}
+	for _, device := range list {
+		switch device.ID {
+		case "device":
+			if !device.LastSeen.Equal(now) {
+				t.Errorf("unexpected last seen: %v", device.LastSeen)
+			}
+		case "silent":
+			if !device.LastSeen.IsZero() {
+				t.Errorf("unexpected last seen for silent device: %v", device.LastSeen)
+			}
+		}
+	}
+}
+
+func TestDeviceSummariesBSON(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	data, err := bson.Marshal(&DeviceLastSeen{Device: Device{ID: "device"}, LastSeen: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["_id"] != "device" || !doc["lastSeen"].(time.Time).Equal(now) {
+		t.Errorf("unexpected document: %v", doc)
+	}
+	data, err = bson.Marshal(&DeviceStatus{Device: Device{ID: "device"}, Status: DeviceOnline})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = nil
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["_id"] != "device" || doc["status"] != DeviceOnline {
+		t.Errorf("unexpected document: %v", doc)
+	}
+	data, err = bson.Marshal(&DeviceDistance{Device: Device{ID: "device"}, Distance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = nil
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["_id"] != "device" || doc["distance"] != 10.0 {
+		t.Errorf("unexpected document: %v", doc)
+	}
+}
+
+func TestDevicesListByType(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []*Device{
+		{ID: "1", Type: "tracker-v2", Password: passwd},
+		{ID: "2", Type: "tracker-v1"},
+		{ID: "3", Type: "tracker-v2"},
+		{ID: "4"},
+	} {
+		if err := devices.Create("group", device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := devices.Create("other", &Device{ID: "5", Type: "tracker-v2"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := devices.ListByType("group", "tracker-v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected devices: %v", list)
+	}
+	for _, device := range list {
+		if device.Type != "tracker-v2" || len(device.Password) != 0 {
+			t.Errorf("unexpected device: %#v", device)
+		}
+	}
+	if list, err = devices.ListByType("group", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if list == nil || len(list) != 0 {
+		t.Errorf("unexpected devices: %#v", list)
+	}
+}
+
+func TestDevicesNearestToPoint(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices, events := db.Devices(), db.Events()
+	for _, id := range []string{"near", "far", "moved", "stale", "silent", "deleted"} {
+		if err := devices.Create("group", &Device{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	center := geo.Point{37.6173, 55.7558}
+	for id, list := range map[string][]*Event{
+		"near": {{Time: now, Location: &geo.Point{37.6180, 55.7558}}},
+		"far":  {{Time: now, Location: &geo.Point{37.7000, 55.7558}}},
+		"moved": {
+			{Time: now.Add(-time.Minute), Location: &geo.Point{37.6174, 55.7558}},
+			{Time: now, Location: &geo.Point{37.6500, 55.7558}},
+			{Time: now.Add(time.Second)},
+		},
+		"stale":   {{Time: now.Add(-2 * NearestMaxAge), Location: &center}},
+		"silent":  {{Time: now}},
+		"deleted": {{Time: now, Location: &center}},
+	} {
+		if err := events.Create("group", id, list...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// события удаленного устройства остаются, но оно не занимает место в
+	// результате
+	if err := devices.Delete("group", "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := devices.NearestToPoint("group", center, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "near" || list[1].ID != "moved" {
+		t.Fatalf("unexpected devices: %v", list)
+	}
+	if list[0].Distance <= 0 || list[0].Distance > list[1].Distance {
+		t.Errorf("unexpected distances: %v, %v", list[0].Distance, list[1].Distance)
+	}
+	if !list[1].Time.Equal(now) {
+		t.Errorf("unexpected location time: %v", list[1].Time)
+	}
+	if list, err = devices.NearestToPoint("group", center, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("unexpected devices: %v", list)
+	}
+}
+
+func TestDevicesGetFields(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{ID: "device", Name: "Name", Type: "phone", Password: passwd}
+	if err := devices.Create("group", device); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := devices.GetFields("group", "device", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != "device" || stored.Name != "Name" || stored.Type != "" ||
+		len(stored.Password) != 0 || !stored.CreatedAt.IsZero() {
+		t.Errorf("unexpected device: %#v", stored)
+	}
+	if _, err := devices.GetFields("group", "device", "password"); err != ErrBadField {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := devices.GetFields("other", "device", "name"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	list, err := devices.ListFields("group", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "Name" || list[0].Type != "" {
+		t.Errorf("unexpected devices: %v", list)
+	}
+}
+
+func TestDevicesResetAllPasswords(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices := db.Devices()
+	passwd, err := NewPassword("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if err := devices.Create("group", &Device{ID: id, Password: passwd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := devices.Create("other", &Device{ID: "foreign", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	passwords, err := devices.ResetAllPasswords("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 || passwords["first"] == passwords["second"] {
+		t.Fatalf("unexpected passwords: %v", passwords)
+	}
+	for id, password := range passwords {
+		if _, err := devices.Authenticate(id, password); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+		if _, err := devices.Authenticate(id, "old"); err != ErrWrongPassword {
+			t.Errorf("%s: old password is accepted: %v", id, err)
+		}
+	}
+	if _, err := devices.Authenticate("foreign", "old"); err != nil {
+		t.Errorf("password of other group is changed: %v", err)
+	}
+	// политика паролей не применяется к созданным случайным паролям
+	defer func(policy func(string) error) { PasswordPolicy = policy }(PasswordPolicy)
+	PasswordPolicy = func(string) error { return errors.New("weak password") }
+	if passwords, err = devices.ResetAllPasswords("group"); err != nil || len(passwords) != 2 {
+		t.Errorf("unexpected result: %v, %v", passwords, err)
+	}
+}
+
+func TestDevicesListWithStatus(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	devices, events := db.Devices(), db.Events()
+	for _, id := range []string{"online", "offline", "silent"} {
+		if err := devices.Create("group", &Device{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+	if err := events.Create("group", "online", &Event{Time: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Create("group", "offline", &Event{Time: now.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := devices.ListWithStatus("group", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("unexpected devices: %v", list)
+	}
+	for _, device := range list {
+		expected := map[string]string{
+			"online":  DeviceOnline,
+			"offline": DeviceOffline,
+			"silent":  DeviceStatusUnknown,
+		}[device.ID]
+		if device.Status != expected {
+			t.Errorf("%s: unexpected status: %s", device.ID, device.Status)
+		}
+	}
+	list, err = devices.ListWithStatus("group", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range list {
+		if device.ID == "offline" && device.Status != DeviceOnline {
+			t.Errorf("threshold is ignored: %s", device.Status)
+		}
+	}
+}
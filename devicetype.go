@@ -0,0 +1,81 @@
+package model
+
+import (
+	"errors"
+	"sync"
+)
+
+// DeviceType описывает тип устройства: поддерживаемые им возможности, формат
+// дополнительных данных в событиях и команды, которые устройство понимает.
+// Типы устройств не сохраняются в хранилище: их регистрирует сам сервис при
+// запуске в DeviceTypeRegistry.
+type DeviceType struct {
+	// идентификатор типа, совпадающий со значением Device.Type
+	ID string `json:"id"`
+	// отображаемое имя типа
+	Name string `json:"name,omitempty"`
+	// поддерживаемые возможности, например, "location" или "power"
+	Capabilities []string `json:"capabilities,omitempty"`
+	// формат дополнительных данных (Event.Data), передаваемых устройством
+	DataFormat string `json:"dataFormat,omitempty"`
+	// поддерживаемые устройством команды
+	Commands []string `json:"commands,omitempty"`
+}
+
+// Has возвращает true, если тип устройства поддерживает указанную возможность.
+func (t DeviceType) Has(capability string) bool {
+	for _, name := range t.Capabilities {
+		if name == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrBadDeviceType возвращается при попытке зарегистрировать тип устройства
+// без идентификатора.
+var ErrBadDeviceType = errors.New("device type id is required")
+
+// DeviceTypeRegistry хранит в памяти описания зарегистрированных типов
+// устройств. Его можно безопасно использовать одновременно из нескольких
+// потоков.
+type DeviceTypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]DeviceType
+}
+
+// NewDeviceTypeRegistry возвращает новый пустой реестр типов устройств.
+func NewDeviceTypeRegistry() *DeviceTypeRegistry {
+	return &DeviceTypeRegistry{types: make(map[string]DeviceType)}
+}
+
+// Register добавляет описание типа устройства в реестр. Если тип с таким
+// идентификатором уже зарегистрирован, то его описание заменяется.
+func (r *DeviceTypeRegistry) Register(deviceType DeviceType) error {
+	if deviceType.ID == "" {
+		return ErrBadDeviceType
+	}
+	r.mu.Lock()
+	r.types[deviceType.ID] = deviceType
+	r.mu.Unlock()
+	return nil
+}
+
+// Lookup возвращает описание типа устройства с указанным идентификатором.
+// Если такой тип не зарегистрирован, то возвращается false.
+func (r *DeviceTypeRegistry) Lookup(id string) (DeviceType, bool) {
+	r.mu.RLock()
+	deviceType, ok := r.types[id]
+	r.mu.RUnlock()
+	return deviceType, ok
+}
+
+// DeviceTypes — реестр типов устройств, используемый Device.Capabilities.
+// Заполняется сервисом при запуске.
+var DeviceTypes = NewDeviceTypeRegistry()
+
+// Capabilities возвращает описание типа устройства из реестра DeviceTypes.
+// Если тип устройства не задан или не зарегистрирован, то возвращается false.
+func (d *Device) Capabilities() (DeviceType, bool) {
+	return DeviceTypes.Lookup(d.Type)
+}
@@ -0,0 +1,31 @@
+package model
+
+import "testing"
+
+func TestDeviceTypeRegistry(t *testing.T) {
+	defer func(registry *DeviceTypeRegistry) { DeviceTypes = registry }(DeviceTypes)
+	DeviceTypes = NewDeviceTypeRegistry()
+	if err := DeviceTypes.Register(DeviceType{Name: "No ID"}); err != ErrBadDeviceType {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := DeviceTypes.Register(DeviceType{
+		ID:           "tracker-v2",
+		Capabilities: []string{"location", "power"},
+		DataFormat:   "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceType, ok := (&Device{Type: "tracker-v2"}).Capabilities()
+	if !ok {
+		t.Fatal("device type is not found")
+	}
+	if !deviceType.Has("power") || deviceType.Has("commands") {
+		t.Errorf("unexpected capabilities: %v", deviceType.Capabilities)
+	}
+	for _, device := range []*Device{{Type: "unknown"}, {}} {
+		if _, ok := device.Capabilities(); ok {
+			t.Errorf("unexpected type for %q", device.Type)
+		}
+	}
+}
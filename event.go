@@ -1,83 +1,1395 @@
 package model
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
 
-type Events DB // для обращения к данным о событиях
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Events предоставляет доступ к данным о событиях. Получить его можно с
+// помощью метода DB.Events.
+type Events DB
 
 // Get возвращает описание события с указанным идентификатором для конкретного
 // устройства из хранилища.
 func (db *Events) Get(groupId, deviceId, id string) (event *Event, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
+	return db.GetContext(context.Background(), groupId, deviceId, id)
+}
+
+// GetContext работает как Get, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) GetContext(ctx context.Context, groupId, deviceId, id string) (event *Event, err error) {
 	if !bson.IsObjectIdHex(id) {
 		err = ErrBadObjectId
 		return
 	}
 	objID := bson.ObjectIdHex(id)
-	event = new(Event)
-	err = coll.Find(bson.M{"_id": objID, "groupId": groupId, "deviceId": deviceId}).
-		Select(bson.M{"groupId": 0, "deviceId": 0}).One(event)
-	session.Close()
+	result := new(Event)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{"_id": objID, "groupId": groupId, "deviceId": deviceId})).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).One(result)
+	})
+	if err == nil {
+		event = result
+	} else {
+		err = notFound(err, CollectionEvents, groupId, id)
+	}
+	return
+}
+
+// GetFields работает как Get, но возвращает только указанные поля события
+// (названия задаются так же, как в хранилище), что позволяет сократить объем
+// передаваемых данных. Для неизвестных полей возвращается ErrBadField.
+func (db *Events) GetFields(groupId, deviceId, id string, fields ...string) (event *Event, err error) {
+	return db.GetFieldsContext(context.Background(), groupId, deviceId, id, fields...)
+}
+
+// GetFieldsContext работает как GetFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) GetFieldsContext(ctx context.Context, groupId, deviceId, id string, fields ...string) (event *Event, err error) {
+	selector, err := fieldSelector((*Event)(nil), fields)
+	if err != nil {
+		return
+	}
+	if !bson.IsObjectIdHex(id) {
+		err = ErrBadObjectId
+		return
+	}
+	result := new(Event)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{"_id": bson.ObjectIdHex(id), "groupId": groupId, "deviceId": deviceId})).Select(selector).One(result)
+	})
+	if err == nil {
+		event = result
+	} else {
+		err = notFound(err, CollectionEvents, groupId, id)
+	}
 	return
 }
 
 // List возвращает список всех событий, зарегистрированных для указанного
 // устройства.
 func (db *Events) List(groupID, deviceId string) (events []*Event, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
-	events = make([]*Event, 0)
-	err = coll.Find(bson.M{"groupId": groupID, "deviceId": deviceId}).
-		Select(bson.M{"groupId": 0, "deviceId": 0}).All(&events)
-	session.Close()
+	return db.ListContext(context.Background(), groupID, deviceId)
+}
+
+// ListContext работает как List, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) ListContext(ctx context.Context, groupID, deviceId string) (events []*Event, err error) {
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{"groupId": groupID, "deviceId": deviceId})).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// ListByType возвращает список событий устройства указанных типов,
+// отсортированный по времени. Если типы не указаны, то возвращаются все
+// события устройства, как и в List. Если хотя бы один из указанных типов не
+// является предопределенным, то возвращается ErrUnknownEventType.
+func (db *Events) ListByType(groupID, deviceId string, types ...string) (events []*Event, err error) {
+	return db.ListByTypeContext(context.Background(), groupID, deviceId, types...)
+}
+
+// ListByTypeContext работает как ListByType, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) ListByTypeContext(ctx context.Context, groupID, deviceId string, types ...string) (events []*Event, err error) {
+	query := bson.M{"groupId": groupID, "deviceId": deviceId}
+	if len(types) > 0 {
+		for _, eventType := range types {
+			if !validEventType(eventType) {
+				err = ErrUnknownEventType
+				return
+			}
+		}
+		query["type"] = bson.M{"$in": types}
+	}
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(query)).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).Sort("time").All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// AcceptUnknownAccuracy определяет, возвращает ли ListAccurate события, для
+// которых точность координат не указана.
+var AcceptUnknownAccuracy = true
+
+// ListAccurate возвращает отсортированный по времени список событий
+// устройства за указанный интервал времени (границы интервала задаются так же,
+// как в CountByTime), точность координат которых не хуже maxAccuracy метров.
+// События без указания точности включаются в список, только если
+// AcceptUnknownAccuracy установлен в true.
+func (db *Events) ListAccurate(groupID, deviceId string, maxAccuracy float64, from, to time.Time) (events []*Event, err error) {
+	return db.ListAccurateContext(context.Background(), groupID, deviceId, maxAccuracy, from, to)
+}
+
+// ListAccurateContext работает как ListAccurate, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) ListAccurateContext(ctx context.Context, groupID, deviceId string, maxAccuracy float64, from, to time.Time) (events []*Event, err error) {
+	query := bson.M{"groupId": groupID, "deviceId": deviceId}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	accurate := bson.M{"accuracy": bson.M{"$lte": maxAccuracy}}
+	if AcceptUnknownAccuracy {
+		query["$or"] = []bson.M{accurate, {"accuracy": bson.M{"$exists": false}}}
+	} else {
+		query["accuracy"] = accurate["accuracy"]
+	}
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(query)).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).Sort("time").All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// LowPower возвращает отсортированный по времени список событий устройства, в
+// которых уровень заряда батареи ниже threshold.
+//
+// Поле power сохраняется с omitempty, поэтому нулевой уровень заряда не
+// отличается от отсутствия информации о нем: такие события считаются
+// событиями с неизвестным уровнем заряда и в список не попадают.
+func (db *Events) LowPower(groupID, deviceId string, threshold uint8) (events []*Event, err error) {
+	return db.LowPowerContext(context.Background(), groupID, deviceId, threshold)
+}
+
+// LowPowerContext работает как LowPower, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) LowPowerContext(ctx context.Context, groupID, deviceId string, threshold uint8) (events []*Event, err error) {
+	query := bson.M{
+		"groupId":  groupID,
+		"deviceId": deviceId,
+		"power":    bson.M{"$gt": 0, "$lt": threshold},
+	}
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(query)).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).Sort("time").All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// CommentLanguage задает язык полнотекстового индекса комментариев событий.
+// Язык определяет правила выделения основы слов и список стоп-слов; значение
+// "none" отключает и то, и другое. Изменение языка вступает в силу только при
+// пересоздании индекса.
+var CommentLanguage = "russian"
+
+// SearchComments возвращает события, в комментариях к которым встречаются
+// слова из запроса, отсортированные по убыванию релевантности. Если
+// идентификатор устройства не указан, то поиск выполняется по событиям всех
+// устройств группы.
+//
+// Поиск использует полнотекстовый индекс MongoDB, создаваемый EnsureIndexes:
+// запрос разбивается на слова по пробелам и знакам препинания, регистр букв
+// не учитывается, а слова приводятся к основе по правилам языка
+// CommentLanguage, поэтому разные формы одного слова считаются совпадающими.
+// Фраза в двойных кавычках ищется целиком, а слово с минусом впереди
+// исключает события, в которых оно встречается.
+func (db *Events) SearchComments(groupID, deviceId, query string) (events []*Event, err error) {
+	return db.SearchCommentsContext(context.Background(), groupID, deviceId, query)
+}
+
+// SearchCommentsContext работает как SearchComments, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) SearchCommentsContext(ctx context.Context, groupID, deviceId, query string) (events []*Event, err error) {
+	search := bson.M{"groupId": groupID, "$text": bson.M{"$search": query}}
+	if deviceId != "" {
+		search["deviceId"] = deviceId
+	}
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(search)).
+			Select(bson.M{"groupId": 0, "score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score").All(&result)
+	})
+	if err != nil {
+		return
+	}
+	// оценка релевантности попадает в дополнительные данные события
+	for _, event := range result {
+		delete(event.Data, "score")
+		if len(event.Data) == 0 {
+			event.Data = nil
+		}
+	}
+	events = result
+	return
+}
+
+// Ограничения на количество событий, возвращаемых за один запрос
+// постраничного вывода.
+var (
+	DefaultPageSize = 100  // размер страницы по умолчанию
+	MaxPageSize     = 1000 // максимальный размер страницы
+)
+
+// pageLimit возвращает размер страницы с учетом ограничений.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+// ListPaged возвращает страницу списка событий, зарегистрированных для
+// указанного устройства. События отсортированы по времени в обратном порядке:
+// сначала самые последние. Параметр skip задает количество пропускаемых
+// событий, а limit — размер страницы. Если limit не задан, то используется
+// DefaultPageSize, но в любом случае не больше MaxPageSize. Флаг more
+// показывает, что за этой страницей есть еще события.
+func (db *Events) ListPaged(groupID, deviceId string, skip, limit int) (events []*Event, more bool, err error) {
+	return db.ListPagedContext(context.Background(), groupID, deviceId, skip, limit)
+}
+
+// ListPagedContext работает как ListPaged, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) ListPagedContext(ctx context.Context, groupID, deviceId string, skip, limit int) (events []*Event, more bool, err error) {
+	return db.listPagedContext(ctx, bson.M{"groupId": groupID, "deviceId": deviceId},
+		bson.M{"groupId": 0, "deviceId": 0}, skip, limit)
+}
+
+// ListAllForGroup возвращает страницу списка событий всех устройств группы.
+// События отсортированы по времени в обратном порядке, а параметры skip и limit
+// работают так же, как в ListPaged. В отличие от других методов, идентификатор
+// устройства в описаниях событий сохраняется, чтобы было понятно, к какому
+// устройству относится каждое событие.
+func (db *Events) ListAllForGroup(groupID string, skip, limit int) (events []*Event, more bool, err error) {
+	return db.ListAllForGroupContext(context.Background(), groupID, skip, limit)
+}
+
+// ListAllForGroupContext работает как ListAllForGroup, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) ListAllForGroupContext(ctx context.Context, groupID string, skip, limit int) (events []*Event, more bool, err error) {
+	return db.listPagedContext(ctx, bson.M{"groupId": groupID},
+		bson.M{"groupId": 0}, skip, limit)
+}
+
+// listPagedContext возвращает страницу списка событий, удовлетворяющих
+// запросу, отсортированного по времени в обратном порядке.
+func (db *Events) listPagedContext(ctx context.Context, query, selector bson.M, skip, limit int) (events []*Event, more bool, err error) {
+	if skip < 0 {
+		skip = 0
+	}
+	limit = pageLimit(limit)
+	result := make([]*Event, 0, limit+1)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		// запрашиваем на одно событие больше, чтобы узнать, есть ли еще
+		return coll.Find(notDeleted(query)).Select(selector).
+			Sort("-time").Skip(skip).Limit(limit + 1).All(&result)
+	})
+	if err != nil {
+		return
+	}
+	if len(result) > limit {
+		result, more = result[:limit], true
+	}
+	events = result
+	return
+}
+
+// geoPoint возвращает описание точки в формате GeoJSON для использования в
+// запросах.
+func geoPoint(p geo.Point) bson.M {
+	return bson.M{"type": "Point", "coordinates": p}
+}
+
+// Near возвращает список событий устройства, отсортированный по удаленности от
+// указанной точки: от ближних к дальним. Если maxMeters больше нуля, то
+// возвращаются только события, находящиеся не дальше указанного расстояния в
+// метрах.
+//
+// Для работы запроса необходим индекс 2dsphere по полю location (смотри
+// EnsureIndexes). Если индекс не создан, то MongoDB вернет ошибку, которая
+// возвращается без изменений.
+func (db *Events) Near(groupID, deviceId string, center geo.Point, maxMeters float64) (events []*Event, err error) {
+	return db.NearContext(context.Background(), groupID, deviceId, center, maxMeters)
+}
+
+// NearContext работает как Near, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) NearContext(ctx context.Context, groupID, deviceId string, center geo.Point, maxMeters float64) (events []*Event, err error) {
+	near := bson.M{"$geometry": geoPoint(center)}
+	if maxMeters > 0 {
+		near["$maxDistance"] = maxMeters
+	}
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{
+			"groupId":  groupID,
+			"deviceId": deviceId,
+			"location": bson.M{"$nearSphere": near},
+		})).Select(bson.M{"groupId": 0, "deviceId": 0}).All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// EnsureIndexes создает индексы, необходимые для работы с коллекцией событий.
+// Если индексы уже существуют, то ничего не происходит.
+func (db *Events) EnsureIndexes() error {
+	return (*DB)(db).ensureIndexes(CollectionEvents)
+}
+
+// Count возвращает количество событий, зарегистрированных для указанного
+// устройства.
+func (db *Events) Count(groupID, deviceId string) (count int, err error) {
+	return db.CountContext(context.Background(), groupID, deviceId)
+}
+
+// CountContext работает как Count, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) CountContext(ctx context.Context, groupID, deviceId string) (count int, err error) {
+	return db.countContext(ctx, bson.M{"groupId": groupID, "deviceId": deviceId})
+}
+
+// CountByTime возвращает количество событий устройства, произошедших в
+// указанный интервал времени: не раньше from и раньше to. Нулевое значение
+// любой из границ означает, что интервал с этой стороны не ограничен.
+func (db *Events) CountByTime(groupID, deviceId string, from, to time.Time) (count int, err error) {
+	return db.CountByTimeContext(context.Background(), groupID, deviceId, from, to)
+}
+
+// CountByTimeContext работает как CountByTime, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) CountByTimeContext(ctx context.Context, groupID, deviceId string, from, to time.Time) (count int, err error) {
+	query := bson.M{"groupId": groupID, "deviceId": deviceId}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	return db.countContext(ctx, query)
+}
+
+// countContext возвращает количество событий, удовлетворяющих запросу.
+func (db *Events) countContext(ctx context.Context, query bson.M) (count int, err error) {
+	var result int
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		result, err = coll.Find(notDeleted(query)).Count()
+		return
+	})
+	if err == nil {
+		count = result
+	}
+	return
+}
+
+// timeRange возвращает условие выборки по интервалу времени: не раньше from и
+// раньше to. Нулевое значение границы не добавляет ограничения с этой стороны.
+// Если обе границы не заданы, то возвращается nil.
+func timeRange(from, to time.Time) bson.M {
+	period := make(bson.M, 2)
+	if !from.IsZero() {
+		period["$gte"] = from
+	}
+	if !to.IsZero() {
+		period["$lt"] = to
+	}
+	if len(period) == 0 {
+		return nil
+	}
+	return period
+}
+
+// LatestPerDevice возвращает последнее по времени событие для каждого
+// устройства группы. Результат возвращается в виде словаря, где ключом
+// является идентификатор устройства. Устройства, для которых нет ни одного
+// события, в него не попадают. Все события выбираются одним запросом
+// агрегации.
+func (db *Events) LatestPerDevice(groupID string) (events map[string]*Event, err error) {
+	return db.LatestPerDeviceContext(context.Background(), groupID)
+}
+
+// LatestPerDeviceContext работает как LatestPerDevice, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) LatestPerDeviceContext(ctx context.Context, groupID string) (events map[string]*Event, err error) {
+	var latest []struct {
+		DeviceID string `bson:"_id"`
+		Event    *Event `bson:"event"`
+	}
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Pipe([]bson.M{
+			{"$match": notDeleted(bson.M{"groupId": groupID})},
+			{"$sort": bson.M{"time": -1}},
+			{"$group": bson.M{
+				"_id":   "$deviceId",
+				"event": bson.M{"$first": "$$ROOT"},
+			}},
+		}).All(&latest)
+	})
+	if err != nil {
+		return
+	}
+	events = make(map[string]*Event, len(latest))
+	for _, item := range latest {
+		events[item.DeviceID] = item.Event
+	}
 	return
 }
 
+// Summary описывает сводную информацию о треке устройства.
+type Summary struct {
+	// количество точек трека
+	PointCount int `bson:"points" json:"points"`
+	// время первой точки
+	FirstTime time.Time `bson:"first,omitempty" json:"first,omitempty"`
+	// время последней точки
+	LastTime time.Time `bson:"last,omitempty" json:"last,omitempty"`
+	// пройденное расстояние в метрах
+	TotalMeters float64 `bson:"meters" json:"meters"`
+}
+
+// TrackSummary возвращает сводную информацию о треке устройства за указанный
+// интервал времени (границы интервала задаются так же, как в CountByTime):
+// количество точек, время первой и последней из них и пройденное расстояние.
+// Расстояние вычисляется как сумма расстояний между последовательными по
+// времени точками по формуле гаверсинусов. События без координат не
+// учитываются.
+//
+// События читаются из хранилища последовательно, без загрузки их всех в память,
+// и при этом запрашиваются только время и координаты.
+func (db *Events) TrackSummary(groupID, deviceId string, from, to time.Time) (summary *Summary, err error) {
+	return db.TrackSummaryContext(context.Background(), groupID, deviceId, from, to)
+}
+
+// TrackSummaryContext работает как TrackSummary, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) TrackSummaryContext(ctx context.Context, groupID, deviceId string, from, to time.Time) (summary *Summary, err error) {
+	query := bson.M{
+		"groupId":  groupID,
+		"deviceId": deviceId,
+		"location": bson.M{"$exists": true},
+	}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	result := new(Summary)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		iter := coll.Find(notDeleted(query)).
+			Select(bson.M{"time": 1, "location": 1}).Sort("time").Iter()
+		var event, last Event
+		for iter.Next(&event) {
+			if event.Location == nil {
+				continue
+			}
+			if result.PointCount == 0 {
+				result.FirstTime = event.Time
+			} else if meters, ok := last.DistanceTo(&event); ok {
+				result.TotalMeters += meters
+			}
+			result.LastTime = event.Time
+			result.PointCount++
+			last, event = event, Event{}
+		}
+		return iter.Close()
+	})
+	if err == nil {
+		summary = result
+	}
+	return
+}
+
+// TrackGeoJSON возвращает трек устройства за указанный интервал времени (границы
+// интервала задаются так же, как в CountByTime) в виде коллекции объектов
+// (FeatureCollection) в формате GeoJSON, которую можно сразу отобразить на
+// карте с помощью Leaflet, Mapbox и им подобных библиотек. Каждое событие
+// представлено точкой, а его время, тип, погрешность, уровень заряда и
+// комментарий сохраняются в свойствах объекта. События без координат
+// пропускаются.
+func (db *Events) TrackGeoJSON(groupID, deviceId string, from, to time.Time) (data []byte, err error) {
+	return db.TrackGeoJSONContext(context.Background(), groupID, deviceId, from, to)
+}
+
+// TrackGeoJSONContext работает как TrackGeoJSON, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) TrackGeoJSONContext(ctx context.Context, groupID, deviceId string, from, to time.Time) (data []byte, err error) {
+	query := bson.M{
+		"groupId":  groupID,
+		"deviceId": deviceId,
+		"location": bson.M{"$exists": true},
+	}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	collection := newGeoJSONFeatureCollection()
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		iter := coll.Find(notDeleted(query)).
+			Select(bson.M{"groupId": 0, "deviceId": 0}).Sort("time").Iter()
+		event := new(Event)
+		for iter.Next(event) {
+			if event.Location != nil {
+				collection.Features = append(collection.Features, event.geoJSON())
+			}
+			event = new(Event)
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return
+	}
+	return collection.Bytes()
+}
+
+// geoJSON возвращает описание события в виде объекта Feature в формате
+// GeoJSON. Событие должно содержать координаты.
+func (e *Event) geoJSON() *geoJSONFeature {
+	feature := newGeoJSONFeature(e.ID.Hex(), geoPoint(*e.Location))
+	feature.Properties["time"] = e.Time
+	if e.Type != "" {
+		feature.Properties["type"] = e.Type
+	}
+	if e.Accuracy != 0 {
+		feature.Properties["accuracy"] = e.Accuracy
+	}
+	if e.Power != 0 {
+		feature.Properties["power"] = e.Power
+	}
+	if e.Comment != "" {
+		feature.Properties["comment"] = e.Comment
+	}
+	return feature
+}
+
 // Devices возвращает список идентификаторов устройств, данные о которых есть в
 // коллекции событий для данной группы пользователей.
 func (db *Events) Devices(groupID string) (deviceIds []string, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
-	deviceIds = make([]string, 0)
-	err = coll.Find(bson.M{"groupId": groupID}).Distinct("deviceID", &deviceIds)
-	session.Close()
+	return db.DevicesContext(context.Background(), groupID)
+}
+
+// DevicesContext работает как Devices, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) DevicesContext(ctx context.Context, groupID string) (deviceIds []string, err error) {
+	result := make([]string, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(notDeleted(bson.M{"groupId": groupID})).Distinct("deviceId", &result)
+	})
+	if err == nil {
+		deviceIds = result
+	}
 	return
 }
 
 // Create добавляет в хранилище описание новых событий с привязкой к устройству.
 func (db *Events) Create(groupId, deviceId string, events ...*Event) (err error) {
+	return db.CreateContext(context.Background(), groupId, deviceId, events...)
+}
+
+// CreateContext работает как Create, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) CreateContext(ctx context.Context, groupId, deviceId string, events ...*Event) (err error) {
+	objs, err := prepareEvents(groupId, deviceId, events)
+	if err != nil {
+		return
+	}
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		if err := coll.Insert(objs...); err != nil {
+			return duplicate(err)
+		}
+		db.mirror(coll.Database, objs...)
+		return nil
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditCreate, CollectionEvents, groupId, eventIDs(events)...)
+	}
+	return
+}
+
+// CreateReturning добавляет в хранилище описания новых событий так же, как
+// Create, и возвращает присвоенные им идентификаторы в том же порядке, в
+// котором события переданы. Это удобно, если событие нужно сразу
+// использовать, например, в ответе на запрос.
+func (db *Events) CreateReturning(groupId, deviceId string, events ...*Event) (ids []bson.ObjectId, err error) {
+	return db.CreateReturningContext(context.Background(), groupId, deviceId, events...)
+}
+
+// CreateReturningContext работает как CreateReturning, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) CreateReturningContext(ctx context.Context, groupId, deviceId string, events ...*Event) (ids []bson.ObjectId, err error) {
+	if err = db.CreateContext(ctx, groupId, deviceId, events...); err != nil {
+		return
+	}
+	ids = make([]bson.ObjectId, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return
+}
+
+// eventIDs возвращает список идентификаторов событий в виде строк.
+func eventIDs(events []*Event) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID.Hex()
+	}
+	return ids
+}
+
+// CreateEvaluate добавляет в хранилище описание новых событий, как и Create, и
+// возвращает для каждого из них список мест группы, внутри которых находится
+// точка события. Для событий без координат возвращается пустой список.
+//
+// Чтобы не выполнять отдельный запрос для каждого события, точки проверяются
+// пакетами по 100 за один запрос агрегации к коллекции мест, а описания
+// найденных мест загружаются одним дополнительным запросом. Таким образом,
+// для пакета до 100 событий вместе со вставкой выполняется всего три запроса
+// к MongoDB. Требуется MongoDB версии 3.4 или выше.
+//
+// Если события были сохранены, но запрос к коллекции мест завершился ошибкой,
+// то возвращается *EvaluateError: в этом случае события остаются в хранилище и
+// записываются в журнал изменений, но список мест не возвращается.
+func (db *Events) CreateEvaluate(groupId, deviceId string, events ...*Event) (places [][]*Place, err error) {
+	return db.CreateEvaluateContext(context.Background(), groupId, deviceId, events...)
+}
+
+// CreateEvaluateContext работает как CreateEvaluate, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) CreateEvaluateContext(ctx context.Context, groupId, deviceId string, events ...*Event) (places [][]*Place, err error) {
+	objs, err := prepareEvents(groupId, deviceId, events)
+	if err != nil {
+		return
+	}
+	// собираем точки событий, запоминая, к какому событию они относятся
+	points := make([]geo.Point, 0, len(events))
+	positions := make([]int, 0, len(events))
+	for i, event := range events {
+		if event.Location != nil {
+			points = append(points, *event.Location)
+			positions = append(positions, i)
+		}
+	}
+	var result [][]*Place
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) error {
+		if err := (*DB)(db).c(mdb, CollectionEvents).Insert(objs...); err != nil {
+			return duplicate(err)
+		}
+		db.mirror(mdb, objs...)
+		// события уже сохранены, поэтому изменение записывается в журнал
+		// независимо от результата проверки мест
+		(*DB)(db).audit(ctx, AuditCreate, CollectionEvents, groupId, eventIDs(events)...)
+		found, err := containingAll((*DB)(db).c(mdb, CollectionPlaces), groupId, points)
+		if err != nil {
+			return &EvaluateError{Err: err}
+		}
+		result = make([][]*Place, len(events))
+		for i := range result {
+			result[i] = make([]*Place, 0)
+		}
+		for i, index := range positions {
+			result[index] = found[i]
+		}
+		return nil
+	})
+	if err == nil {
+		places = result
+	}
+	return
+}
+
+// EvaluateError возвращается CreateEvaluate, если события уже были сохранены,
+// но проверить, в какие места они попадают, не удалось. Повторно сохранять
+// такие события не нужно.
+type EvaluateError struct {
+	// ошибка проверки мест
+	Err error
+}
+
+func (e *EvaluateError) Error() string {
+	return "events stored, but places not evaluated: " + e.Err.Error()
+}
+
+func (e *EvaluateError) Unwrap() error { return e.Err }
+
+// prepareEvents проверяет и подготавливает описания событий к сохранению,
+// привязывая их к группе и устройству, и возвращает их в виде списка для
+// вставки в коллекцию.
+func prepareEvents(groupId, deviceId string, events []*Event) ([]interface{}, error) {
+	now := time.Now().UTC()
 	objs := make([]interface{}, len(events))
 	for i, event := range events {
+		if err := event.Validate(); err != nil {
+			return nil, err
+		}
+		if err := event.prepare(); err != nil {
+			return nil, err
+		}
 		if !event.ID.Valid() {
 			event.ID = bson.NewObjectId()
 		}
 		event.GroupID = groupId
 		event.DeviceID = deviceId
+		event.CreatedAt, event.UpdatedAt = now, now
 		objs[i] = event
 	}
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
-	err = coll.Insert(objs...)
-	session.Close()
+	return objs, nil
+}
+
+// BulkCreate добавляет в хранилище описания новых событий с привязкой к
+// устройству, используя пакетную вставку.
+//
+// Если ordered равно false, то события вставляются в произвольном порядке и
+// ошибка при вставке одного из них не прерывает вставку остальных. В этом
+// случае возвращается ошибка *mgo.BulkError, метод Cases которой позволяет
+// узнать порядковые номера событий, которые не удалось сохранить. При
+// ordered, равном true, вставка прерывается на первой же ошибке.
+//
+// Проверка описаний событий выполняется до начала вставки: если хотя бы одно
+// из них некорректно, то ничего не сохраняется. При ошибке вставки части
+// событий сохраненные события, как и при успешной вставке, копируются для
+// Events.Tail и записываются в журнал изменений.
+func (db *Events) BulkCreate(groupId, deviceId string, ordered bool, events ...*Event) (result *mgo.BulkResult, err error) {
+	return db.BulkCreateContext(context.Background(), groupId, deviceId, ordered, events...)
+}
+
+// BulkCreateContext работает как BulkCreate, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) BulkCreateContext(ctx context.Context, groupId, deviceId string, ordered bool, events ...*Event) (result *mgo.BulkResult, err error) {
+	objs, err := prepareEvents(groupId, deviceId, events)
+	if err != nil {
+		return
+	}
+	var bulkResult *mgo.BulkResult
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		bulk := coll.Bulk()
+		if !ordered {
+			bulk.Unordered()
+		}
+		bulk.Insert(objs...)
+		bulkResult, err = bulk.Run()
+		inserted := events
+		if err != nil {
+			// часть событий могла быть сохранена до ошибки
+			inserted = make([]*Event, 0, len(events))
+			for _, i := range bulkInserted(len(events), ordered, err) {
+				inserted = append(inserted, events[i])
+			}
+		}
+		if len(inserted) > 0 {
+			stored := make([]interface{}, len(inserted))
+			for i, event := range inserted {
+				stored[i] = event
+			}
+			db.mirror(coll.Database, stored...)
+			(*DB)(db).audit(ctx, AuditCreate, CollectionEvents, groupId, eventIDs(inserted)...)
+		}
+		return
+	})
+	if err != context.Canceled && err != context.DeadlineExceeded {
+		result = bulkResult
+	}
+	return
+}
+
+// bulkInserted возвращает индексы описаний, сохраненных пакетной вставкой n
+// описаний, которая завершилась ошибкой err. При упорядоченной вставке
+// сохраняются все описания до первого ошибочного, а при неупорядоченной — все,
+// кроме ошибочных. Если ошибка не описывает, какие именно описания не
+// сохранены, то считается, что не сохранено ни одно.
+func bulkInserted(n int, ordered bool, err error) []int {
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return nil
+	}
+	cases := bulkErr.Cases()
+	if len(cases) == 0 {
+		return nil
+	}
+	failed := make(map[int]bool)
+	for _, c := range cases {
+		if c.Index < 0 || c.Index >= n {
+			return nil
+		}
+		failed[c.Index] = true
+	}
+	inserted := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if failed[i] {
+			if ordered {
+				break
+			}
+			continue
+		}
+		inserted = append(inserted, i)
+	}
+	return inserted
+}
+
+// Upsert сохраняет событие устройства, исключая повторы: если событие с таким
+// же внешним идентификатором (ExternalID) уже сохранено для устройства, то
+// оно обновляется, иначе создается новое. Возвращается true, если было
+// создано новое событие. Это позволяет безопасно сохранять события, повторно
+// переданные устройством.
+//
+// При обновлении сохраняются идентификатор и время создания существующего
+// события, и они же записываются в описание. Событие, помеченное как
+// удаленное, остается таким и после повторной передачи. Если ExternalID не
+// задан, то событие просто создается, как в Create.
+func (db *Events) Upsert(groupId, deviceId string, event *Event) (created bool, err error) {
+	return db.UpsertContext(context.Background(), groupId, deviceId, event)
+}
+
+// UpsertContext работает как Upsert, но позволяет прервать выполнение запроса
+// с помощью контекста.
+func (db *Events) UpsertContext(ctx context.Context, groupId, deviceId string, event *Event) (created bool, err error) {
+	if event.ExternalID == "" {
+		if err = db.CreateContext(ctx, groupId, deviceId, event); err == nil {
+			created = true
+		}
+		return
+	}
+	if _, err = prepareEvents(groupId, deviceId, []*Event{event}); err != nil {
+		return
+	}
+	// сохраняем все поля события, кроме неизменяемых при обновлении
+	data, err := bson.Marshal(event)
+	if err != nil {
+		return
+	}
+	var set bson.M
+	if err = bson.Unmarshal(data, &set); err != nil {
+		return
+	}
+	delete(set, "_id")
+	delete(set, "createdAt")
+	change := mgo.Change{
+		Update: bson.M{
+			"$set":         set,
+			"$setOnInsert": bson.M{"_id": event.ID, "createdAt": event.CreatedAt},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	selector := bson.M{
+		"groupId":    groupId,
+		"deviceId":   deviceId,
+		"externalId": event.ExternalID,
+	}
+	var (
+		stored Event
+		info   *mgo.ChangeInfo
+	)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		info, err = coll.Find(selector).Apply(change, &stored)
+		if mgo.IsDup(err) {
+			// событие было одновременно создано другим запросом: теперь
+			// оно точно существует и будет обновлено
+			info, err = coll.Find(selector).Apply(change, &stored)
+		}
+		if err == nil && info.UpsertedId != nil {
+			db.mirror(coll.Database, &stored)
+		}
+		return duplicate(err)
+	})
+	if err == nil {
+		created = info.UpsertedId != nil
+		event.ID, event.CreatedAt = stored.ID, stored.CreatedAt
+		action := AuditUpdate
+		if created {
+			action = AuditCreate
+		}
+		(*DB)(db).audit(ctx, action, CollectionEvents, groupId, event.ID.Hex())
+	}
 	return
 }
 
-// Update обновляет описание события в хранилище.
+// Update обновляет описание события в хранилище. Если событие не найдено у
+// указанного устройства группы или помечено как удаленное, то возвращается
+// ErrNotFound. Отметка об удалении при обновлении не изменяется.
 func (db *Events) Update(groupId, deviceId string, event *Event) (err error) {
+	return db.UpdateContext(context.Background(), groupId, deviceId, event)
+}
+
+// UpdateContext работает как Update, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) UpdateContext(ctx context.Context, groupId, deviceId string, event *Event) (err error) {
+	if err = event.Validate(); err != nil {
+		return
+	}
 	event.GroupID = groupId
 	event.DeviceID = deviceId
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
-	err = coll.UpdateId(event.ID, event)
-	session.Close()
+	// сохраняем копию описания со временем изменения
+	doc := *event
+	doc.UpdatedAt, doc.DeletedAt = time.Now().UTC(), nil
+	selector := notDeleted(bson.M{"_id": doc.ID, "groupId": groupId, "deviceId": deviceId})
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		if doc.CreatedAt.IsZero() {
+			if doc.CreatedAt, err = storedCreatedAt(coll, doc.ID); err != nil {
+				return
+			}
+		}
+		return coll.Update(selector, &doc)
+	})
+	if err == nil {
+		event.CreatedAt, event.UpdatedAt = doc.CreatedAt, doc.UpdatedAt
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionEvents, groupId, event.ID.Hex())
+	}
+	return
+}
+
+// notDeleted добавляет к запросу условие, исключающее помеченные как удаленные
+// события, и возвращает его.
+func notDeleted(query bson.M) bson.M {
+	query["deletedAt"] = bson.M{"$exists": false}
+	return query
+}
+
+// SoftDelete помечает событие как удаленное, сохраняя время удаления, но не
+// удаляет его из хранилища. Такие события не возвращаются остальными методами
+// чтения, но доступны через ListDeleted. Если событие не найдено или уже
+// помечено как удаленное, то возвращается ErrNotFound.
+func (db *Events) SoftDelete(groupId, deviceId, id string) (err error) {
+	return db.SoftDeleteContext(context.Background(), groupId, deviceId, id)
+}
+
+// SoftDeleteContext работает как SoftDelete, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) SoftDeleteContext(ctx context.Context, groupId, deviceId, id string) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		err = ErrBadObjectId
+		return
+	}
+	objID := bson.ObjectIdHex(id)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Update(
+			notDeleted(bson.M{"_id": objID, "groupId": groupId, "deviceId": deviceId}),
+			bson.M{"$set": bson.M{"deletedAt": time.Now().UTC(), "updatedAt": time.Now().UTC()}})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionEvents, groupId, id)
+	}
+	return
+}
+
+// ListDeleted возвращает список событий устройства, помеченных как удаленные
+// с помощью SoftDelete.
+func (db *Events) ListDeleted(groupID, deviceId string) (events []*Event, err error) {
+	return db.ListDeletedContext(context.Background(), groupID, deviceId)
+}
+
+// ListDeletedContext работает как ListDeleted, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) ListDeletedContext(ctx context.Context, groupID, deviceId string) (events []*Event, err error) {
+	result := make([]*Event, 0)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{
+			"groupId":   groupID,
+			"deviceId":  deviceId,
+			"deletedAt": bson.M{"$exists": true},
+		}).Select(bson.M{"groupId": 0, "deviceId": 0}).All(&result)
+	})
+	if err == nil {
+		events = result
+	}
+	return
+}
+
+// ErrImmutableField возвращается при попытке изменить поле, которое не может
+// быть изменено: уникальный идентификатор, привязку к группе и устройству,
+// время создания и изменения описания или отметку об удалении.
+var ErrImmutableField = errors.New("field can't be changed")
+
+// ErrBadEventTime возвращается Patch, если новое время события задано не как
+// time.Time или не задано.
+var ErrBadEventTime = errors.New("bad event time")
+
+// validatePatch проверяет новые значения полей события по тем же правилам, что
+// и Validate, а время события — так же, как при сохранении нового события.
+// Значения остальных полей не проверяются.
+func validatePatch(fields bson.M) error {
+	for _, name := range []string{"_id", "groupId", "deviceId", "createdAt", "updatedAt", "deletedAt"} {
+		if _, ok := fields[name]; ok {
+			return ErrImmutableField
+		}
+	}
+	for name, value := range fields {
+		switch name {
+		case "time":
+			t, ok := value.(time.Time)
+			if !ok || t.IsZero() {
+				return ErrBadEventTime
+			}
+			if t.After(time.Now().UTC().Add(MaxEventTimeAhead)) {
+				return ErrEventTimeInFuture
+			}
+		case "type":
+			eventType, ok := value.(string)
+			if !ok || (eventType != "" && !validEventType(eventType)) {
+				return ErrUnknownEventType
+			}
+		case "emoji":
+			var emoji rune
+			switch value := value.(type) {
+			case rune:
+				emoji = value
+			case int:
+				if int(rune(value)) != value {
+					return ErrBadEmoji
+				}
+				emoji = rune(value)
+			default:
+				return ErrBadEmoji
+			}
+			if emoji != 0 && !isEmoji(emoji) {
+				return ErrBadEmoji
+			}
+		case "location":
+			switch location := value.(type) {
+			case geo.Point:
+				if !validLocation(location) {
+					return ErrInvalidLocation
+				}
+			case *geo.Point:
+				if location != nil && !validLocation(*location) {
+					return ErrInvalidLocation
+				}
+			default:
+				return ErrInvalidLocation
+			}
+		}
+	}
+	return nil
+}
+
+// Patch изменяет в описании события только указанные поля, не затрагивая
+// остальные, в отличие от Update, который заменяет описание целиком. Названия
+// полей задаются так, как они сохраняются в хранилище. Изменять идентификатор
+// события, группы или устройства, время создания и изменения описания и
+// отметку об удалении нельзя: в этом случае возвращается ErrImmutableField.
+//
+// Новые значения типа, иконки и координат проверяются так же, как в Validate,
+// и при ошибке возвращается ErrUnknownEventType, ErrBadEmoji или
+// ErrInvalidLocation. Координаты должны быть заданы как geo.Point или
+// *geo.Point, тип — как строка, а иконка — как rune или int. Время события
+// должно быть задано как time.Time: в противном случае возвращается
+// ErrBadEventTime, а для слишком далекого будущего — ErrEventTimeInFuture. Если
+// событие не найдено для указанного устройства, то возвращается ErrNotFound.
+func (db *Events) Patch(groupId, deviceId, id string, fields bson.M) (err error) {
+	return db.PatchContext(context.Background(), groupId, deviceId, id, fields)
+}
+
+// PatchContext работает как Patch, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) PatchContext(ctx context.Context, groupId, deviceId, id string, fields bson.M) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		err = ErrBadObjectId
+		return
+	}
+	objID := bson.ObjectIdHex(id)
+	if err = validatePatch(fields); err != nil {
+		return
+	}
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		query := notDeleted(bson.M{"_id": objID, "groupId": groupId, "deviceId": deviceId})
+		if len(fields) == 0 {
+			// изменять нечего: только проверяем, что событие существует
+			count, err := coll.Find(query).Count()
+			if err == nil && count == 0 {
+				err = ErrNotFound
+			}
+			return err
+		}
+		set := bson.M{"updatedAt": time.Now().UTC()}
+		for name, value := range fields {
+			set[name] = value
+		}
+		return coll.Update(query, bson.M{"$set": set})
+	})
+	if err == nil && len(fields) > 0 {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionEvents, groupId, id)
+	}
 	return
 }
 
 // Delete удаляет описание события из хранилища.
 func (db *Events) Delete(groupId, deviceId, id string) (err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionEvents)
-	err = coll.Remove(bson.M{"_id": id, "groupId": groupId, "deviceId": deviceId})
-	session.Close()
+	return db.DeleteContext(context.Background(), groupId, deviceId, id)
+}
+
+// DeleteContext работает как Delete, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) DeleteContext(ctx context.Context, groupId, deviceId, id string) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		err = ErrBadObjectId
+		return
+	}
+	objID := bson.ObjectIdHex(id)
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		return coll.Remove(bson.M{"_id": objID, "groupId": groupId, "deviceId": deviceId})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionEvents, groupId, id)
+	}
+	return
+}
+
+// DeletePurgeForDevice безвозвратно удаляет все события указанного устройства
+// группы, включая помеченные как удаленные, и возвращает количество удаленных
+// событий. Наличие описания устройства не проверяется, поэтому метод
+// подходит для очистки событий, оставшихся после удаления устройства.
+func (db *Events) DeletePurgeForDevice(groupId, deviceId string) (removed int, err error) {
+	return db.DeletePurgeForDeviceContext(context.Background(), groupId, deviceId)
+}
+
+// DeletePurgeForDeviceContext работает как DeletePurgeForDevice, но позволяет
+// прервать выполнение запроса с помощью контекста.
+func (db *Events) DeletePurgeForDeviceContext(ctx context.Context, groupId, deviceId string) (removed int, err error) {
+	var result int
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		result, err = removeDeviceEvents(coll, groupId, deviceId)
+		return
+	})
+	if err == nil {
+		removed = result
+		(*DB)(db).auditCount(ctx, AuditDelete, CollectionEvents, groupId, removed)
+	}
+	return
+}
+
+// DeleteOlderThan безвозвратно удаляет все события группы, произошедшие раньше
+// указанного времени, включая помеченные как удаленные, и возвращает
+// количество удаленных событий. Предназначен для периодической очистки
+// хранилища от устаревших данных.
+func (db *Events) DeleteOlderThan(groupID string, cutoff time.Time) (removed int, err error) {
+	return db.DeleteOlderThanContext(context.Background(), groupID, cutoff)
+}
+
+// DeleteOlderThanContext работает как DeleteOlderThan, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Events) DeleteOlderThanContext(ctx context.Context, groupID string, cutoff time.Time) (removed int, err error) {
+	return db.removeAll(ctx, groupID, bson.M{"groupId": groupID, "time": bson.M{"$lt": cutoff}})
+}
+
+// DeleteOlderThanForDevice работает как DeleteOlderThan, но удаляет события
+// только указанного устройства.
+func (db *Events) DeleteOlderThanForDevice(groupID, deviceId string, cutoff time.Time) (removed int, err error) {
+	return db.DeleteOlderThanForDeviceContext(context.Background(), groupID, deviceId, cutoff)
+}
+
+// DeleteOlderThanForDeviceContext работает как DeleteOlderThanForDevice, но
+// позволяет прервать выполнение запроса с помощью контекста.
+func (db *Events) DeleteOlderThanForDeviceContext(ctx context.Context, groupID, deviceId string, cutoff time.Time) (removed int, err error) {
+	return db.removeAll(ctx, groupID, bson.M{
+		"groupId":  groupID,
+		"deviceId": deviceId,
+		"time":     bson.M{"$lt": cutoff},
+	})
+}
+
+// Dedupe безвозвратно удаляет повторяющиеся события устройства, у которых
+// совпадают время и координаты, оставляя из каждой такой группы только одно
+// событие, и возвращает количество удаленных событий. События без координат
+// считаются повторяющимися, если совпадает время. Из повторов сохраняется
+// событие, не помеченное как удаленное, с наименьшим идентификатором, т.е.
+// добавленное первым.
+//
+// Метод предназначен для разовой очистки данных, загруженных до появления
+// Upsert. Его можно безопасно вызывать повторно: если повторов нет, то ничего
+// не удаляется.
+func (db *Events) Dedupe(groupId, deviceId string) (removed int, err error) {
+	return db.DedupeContext(context.Background(), groupId, deviceId)
+}
+
+// DedupeContext работает как Dedupe, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Events) DedupeContext(ctx context.Context, groupId, deviceId string) (removed int, err error) {
+	var result int
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		// события без отметки об удалении сортируются первыми
+		iter := coll.Pipe([]bson.M{
+			{"$match": bson.M{"groupId": groupId, "deviceId": deviceId}},
+			{"$sort": bson.D{{Name: "deletedAt", Value: 1}, {Name: "_id", Value: 1}}},
+			{"$group": bson.M{
+				"_id":   bson.M{"time": "$time", "location": "$location"},
+				"ids":   bson.M{"$push": "$_id"},
+				"count": bson.M{"$sum": 1},
+			}},
+			{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+			{"$project": bson.M{"_id": 0, "ids": 1}},
+		}).AllowDiskUse().Iter()
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		var (
+			group struct {
+				IDs []bson.ObjectId `bson:"ids"`
+			}
+			found bool
+		)
+		for iter.Next(&group) {
+			bulk.RemoveAll(bson.M{"_id": bson.M{"$in": group.IDs[1:]}})
+			found = true
+		}
+		if err := iter.Close(); err != nil || !found {
+			return err
+		}
+		info, err := bulk.Run()
+		if err != nil {
+			return err
+		}
+		result = info.Matched
+		return nil
+	})
+	if err == nil {
+		removed = result
+		(*DB)(db).auditCount(ctx, AuditDelete, CollectionEvents, groupId, removed)
+	}
+	return
+}
+
+// ErrBadInterval возвращается Downsample, если интервал не больше нуля.
+var ErrBadInterval = errors.New("bad interval")
+
+// Downsample прореживает старые события устройства для экономии места в
+// хранилище: все события раньше olderThan разбиваются на интервалы времени
+// длиной interval, и в каждом интервале сохраняется только одно событие, а
+// остальные безвозвратно удаляются. Возвращается количество удаленных
+// событий.
+//
+// Из событий интервала сохраняется событие с медианной точностью координат
+// (при четном количестве — более точное из двух средних), а если точность не
+// указана ни для одного из них — среднее по времени. События без указания
+// точности участвуют в выборе, только если точность неизвестна для всех
+// событий интервала. Интервалы отсчитываются от нулевого времени, как в
+// time.Time.Truncate, поэтому повторный вызов с тем же interval ничего не
+// удаляет. События, помеченные как удаленные, не затрагиваются.
+func (db *Events) Downsample(groupId, deviceId string, olderThan time.Time, interval time.Duration) (removed int, err error) {
+	return db.DownsampleContext(context.Background(), groupId, deviceId, olderThan, interval)
+}
+
+// DownsampleContext работает как Downsample, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Events) DownsampleContext(ctx context.Context, groupId, deviceId string, olderThan time.Time, interval time.Duration) (removed int, err error) {
+	if interval <= 0 {
+		return 0, ErrBadInterval
+	}
+	var result int
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) error {
+		iter := coll.Find(notDeleted(bson.M{
+			"groupId":  groupId,
+			"deviceId": deviceId,
+			"time":     bson.M{"$lt": olderThan},
+		})).Select(bson.M{"time": 1, "accuracy": 1}).Sort("time").Iter()
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		var (
+			bucket []downsamplePoint
+			start  time.Time
+			found  bool
+		)
+		flush := func() {
+			if ids := downsampleBucket(bucket); len(ids) > 0 {
+				bulk.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+				found = true
+			}
+			bucket = bucket[:0]
+		}
+		var point downsamplePoint
+		for iter.Next(&point) {
+			if key := point.Time.Truncate(interval); !key.Equal(start) {
+				flush()
+				start = key
+			}
+			bucket = append(bucket, point)
+			point = downsamplePoint{}
+		}
+		flush()
+		if err := iter.Close(); err != nil || !found {
+			return err
+		}
+		info, err := bulk.Run()
+		if err != nil {
+			return err
+		}
+		result = info.Matched
+		return nil
+	})
+	if err == nil {
+		removed = result
+		(*DB)(db).auditCount(ctx, AuditDelete, CollectionEvents, groupId, removed)
+	}
 	return
 }
+
+// downsamplePoint содержит поля события, необходимые для прореживания.
+type downsamplePoint struct {
+	ID       bson.ObjectId `bson:"_id"`
+	Time     time.Time     `bson:"time"`
+	Accuracy float64       `bson:"accuracy"`
+}
+
+// downsampleBucket выбирает из отсортированных по времени событий одного
+// интервала событие с медианной точностью и возвращает идентификаторы
+// остальных событий, которые нужно удалить.
+func downsampleBucket(bucket []downsamplePoint) []bson.ObjectId {
+	if len(bucket) < 2 {
+		return nil
+	}
+	candidates := make([]downsamplePoint, 0, len(bucket))
+	for _, point := range bucket {
+		if point.Accuracy > 0 {
+			candidates = append(candidates, point)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, bucket...)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Accuracy < candidates[j].Accuracy
+	})
+	keep := candidates[(len(candidates)-1)/2].ID
+	ids := make([]bson.ObjectId, 0, len(bucket)-1)
+	for _, point := range bucket {
+		if point.ID != keep {
+			ids = append(ids, point.ID)
+		}
+	}
+	return ids
+}
+
+// removeAll удаляет все события группы, удовлетворяющие запросу, и возвращает
+// их количество.
+func (db *Events) removeAll(ctx context.Context, groupId string, query bson.M) (removed int, err error) {
+	var info *mgo.ChangeInfo
+	err = (*DB)(db).exec(ctx, CollectionEvents, func(coll *mgo.Collection) (err error) {
+		info, err = coll.RemoveAll(query)
+		return
+	})
+	if err == nil {
+		removed = info.Removed
+		(*DB)(db).auditCount(ctx, AuditDelete, CollectionEvents, groupId, removed)
+	}
+	return
+}
+
+// removeDeviceEvents удаляет все события устройства группы и возвращает их
+// количество.
+func removeDeviceEvents(coll *mgo.Collection, groupId, deviceId string) (int, error) {
+	info, err := coll.RemoveAll(bson.M{"groupId": groupId, "deviceId": deviceId})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
@@ -0,0 +1,1020 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventsDevices(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	if err := events.Create("group", "device1", new(Event), new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Create("group", "device2", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Create("other", "device3", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	deviceIds, err := events.Devices("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deviceIds) != 2 {
+		t.Fatalf("unexpected devices: %v", deviceIds)
+	}
+	for _, id := range []string{"device1", "device2"} {
+		var found bool
+		for _, deviceId := range deviceIds {
+			if deviceId == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("device %q not found in %v", id, deviceIds)
+		}
+	}
+}
+
+func TestEventsDelete(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event := new(Event)
+	if err := events.Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Delete("group", "device", "bad id"); err != ErrBadObjectId {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.Delete("group", "device", event.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Get("group", "device", event.ID.Hex()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsListPaged(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		err := events.Create("group", "device", &Event{
+			Time: now.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, more, err := events.ListPaged("group", "device", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || !more {
+		t.Fatalf("unexpected first page: %d events, more %v", len(page), more)
+	}
+	if !page[0].Time.After(page[1].Time) {
+		t.Error("events are not sorted by time descending")
+	}
+	page, more, err = events.ListPaged("group", "device", 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || more {
+		t.Fatalf("unexpected last page: %d events, more %v", len(page), more)
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	for limit, want := range map[int]int{
+		-1:              DefaultPageSize,
+		0:               DefaultPageSize,
+		10:              10,
+		MaxPageSize:     MaxPageSize,
+		MaxPageSize + 1: MaxPageSize,
+	} {
+		if got := pageLimit(limit); got != want {
+			t.Errorf("pageLimit(%d) = %d, want %d", limit, got, want)
+		}
+	}
+}
+
+func TestEventsNear(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	if err := events.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	far := &Event{Location: &geo.Point{37.6173, 55.7558}}
+	near := &Event{Location: &geo.Point{37.6200, 55.7560}}
+	if err := events.Create("group", "device", far, near); err != nil {
+		t.Fatal(err)
+	}
+	center := geo.Point{37.6201, 55.7561}
+	list, err := events.Near("group", "device", center, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != near.ID {
+		t.Fatalf("unexpected events order: %v", list)
+	}
+	list, err = events.Near("group", "device", center, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != near.ID {
+		t.Fatalf("unexpected events: %v", list)
+	}
+}
+
+func TestEventsCount(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().Truncate(time.Second) // MongoDB хранит время с точностью до мс
+	for i := 0; i < 5; i++ {
+		err := events.Create("group", "device", &Event{
+			Time: now.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, err := events.Count("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("unexpected count: %d", count)
+	}
+	count, err = events.CountByTime("group", "device",
+		now.Add(time.Hour), now.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("unexpected count by time: %d", count)
+	}
+}
+
+func TestEventPrepare(t *testing.T) {
+	event := new(Event)
+	if err := event.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if event.Time.IsZero() {
+		t.Error("event time is not set")
+	}
+	if time.Since(event.Time) > time.Minute {
+		t.Errorf("unexpected event time: %v", event.Time)
+	}
+	event = &Event{Time: time.Now().Add(MaxEventTimeAhead + time.Hour)}
+	if err := event.prepare(); err != ErrEventTimeInFuture {
+		t.Errorf("unexpected error: %v", err)
+	}
+	event = &Event{Time: time.Now().Add(time.Hour)}
+	if err := event.prepare(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsCreateTime(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event := new(Event)
+	if err := events.Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := events.Get("group", "device", event.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Time.IsZero() {
+		t.Error("stored event time is not set")
+	}
+	future := &Event{Time: time.Now().Add(2 * MaxEventTimeAhead)}
+	if err := events.Create("group", "device", future); err != ErrEventTimeInFuture {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsBulkCreate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	existing := new(Event)
+	if err := events.Create("group", "device", existing); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetupEventsTail(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	var entries auditRecorder
+	db.SetAuditSink(&entries)
+	// второе событие дублирует уже сохраненное
+	list := []*Event{new(Event), {ID: existing.ID}, new(Event)}
+	_, err := events.BulkCreate("group", "device", false, list...)
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cases := bulkErr.Cases(); len(cases) != 1 || cases[0].Index != 1 {
+		t.Errorf("unexpected error cases: %v", cases)
+	}
+	count, err := events.Count("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("unexpected count: %d", count)
+	}
+	// при упорядоченной вставке сохраняются события до ошибочного
+	ordered := []*Event{new(Event), {ID: existing.ID}, new(Event)}
+	if _, err := events.BulkCreate("group", "device", true, ordered...); err == nil {
+		t.Fatal("duplicate inserted")
+	}
+	// сохраненные события копируются для Tail и записываются в журнал
+	expected := []bson.ObjectId{list[0].ID, list[2].ID, ordered[0].ID}
+	var mirrored []*Event
+	err = db.session.DB(db.name).C(CollectionEventsTail).Find(nil).Sort("$natural").All(&mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mirrored) != len(expected) || len(entries) != len(expected) {
+		t.Fatalf("unexpected mirrored events and audit entries: %v, %v", mirrored, entries)
+	}
+	for i, id := range expected {
+		if mirrored[i].ID != id || entries[i].TargetID != id.Hex() {
+			t.Errorf("%d: unexpected event %v and audit entry %v", i, mirrored[i], entries[i])
+		}
+	}
+}
+
+func TestEventsListAllForGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	for _, deviceId := range []string{"device1", "device2"} {
+		if err := events.Create("group", deviceId, new(Event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := events.Create("other", "device3", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	list, more, err := events.ListAllForGroup("group", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || more {
+		t.Fatalf("unexpected events: %v, more %v", list, more)
+	}
+	for _, event := range list {
+		if event.DeviceID == "" {
+			t.Error("event device id is empty")
+		}
+	}
+}
+
+func TestEventsSoftDelete(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event := new(Event)
+	if err := events.Create("group", "device", event, new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "device", event.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "device", event.ID.Hex()); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := events.Get("group", "device", event.ID.Hex()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	list, err := events.List("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID == event.ID {
+		t.Errorf("unexpected events: %v", list)
+	}
+	if list, err = events.ListDeleted("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != event.ID || list[0].DeletedAt == nil {
+		t.Errorf("unexpected deleted events: %v", list)
+	}
+}
+
+func TestEventsUpdate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event, deleted := &Event{Comment: "old"}, new(Event)
+	if err := events.Create("group", "device", event, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "device", deleted.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	// удаленное событие не восстанавливается при обновлении
+	if err := events.Update("group", "device", &Event{ID: deleted.ID}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// событие другой группы или устройства не изменяется
+	if err := events.Update("other", "device", &Event{ID: event.ID}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.Update("group", "other", &Event{ID: event.ID}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	update := &Event{ID: event.ID, Comment: "new"}
+	if err := events.Update("group", "device", update); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := events.Get("group", "device", event.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Comment != "new" || !stored.CreatedAt.Equal(event.CreatedAt) {
+		t.Errorf("unexpected event: %v", stored)
+	}
+	if list, err := events.ListDeleted("group", "device"); err != nil || len(list) != 1 {
+		t.Errorf("unexpected deleted events: %v, %v", list, err)
+	}
+}
+
+func TestEventsPatch(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event := &Event{Comment: "comment", Data: map[string]interface{}{"temp": 20}}
+	if err := events.Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	id := event.ID.Hex()
+	for _, name := range []string{"_id", "groupId", "deviceId", "createdAt", "updatedAt", "deletedAt"} {
+		err := events.Patch("group", "device", id, bson.M{name: "value"})
+		if err != ErrImmutableField {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if err := events.Patch("group", "device", id, bson.M{"location": []interface{}{500, 500}}); err != ErrInvalidLocation {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.Patch("other", "device", id, bson.M{"power": 50}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.Patch("group", "device", id, bson.M{"power": 50}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := events.Get("group", "device", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Power != 50 || stored.Comment != "comment" || stored.Data["temp"] == nil {
+		t.Errorf("unexpected event: %#v", stored)
+	}
+}
+
+func TestEventsDataRoundTrip(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	event := &Event{Data: map[string]interface{}{
+		"temperature": 21.5,
+		"humidity":    40,
+		"sensor":      "dht22",
+	}}
+	if err := events.Create("group", "device", event); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := events.Get("group", "device", event.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := stored.DataFloat("temperature"); !ok || value != 21.5 {
+		t.Errorf("unexpected temperature: %v, %v", value, ok)
+	}
+	if value, ok := stored.DataFloat("humidity"); !ok || value != 40 {
+		t.Errorf("unexpected humidity: %v, %v", value, ok)
+	}
+	if value, ok := stored.DataString("sensor"); !ok || value != "dht22" {
+		t.Errorf("unexpected sensor: %v, %v", value, ok)
+	}
+}
+
+func TestEventsListByType(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now()
+	err := events.Create("group", "device",
+		&Event{Type: EventTypeLeave, Time: now.Add(2 * time.Minute)},
+		&Event{Type: EventTypeTravel, Time: now.Add(time.Minute)},
+		&Event{Type: EventTypeArrive, Time: now},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := events.ListByType("group", "device", EventTypeArrive, EventTypeLeave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Type != EventTypeArrive || list[1].Type != EventTypeLeave {
+		t.Errorf("unexpected events: %v", list)
+	}
+	if list, err = events.ListByType("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("unexpected events: %v", list)
+	}
+	if _, err := events.ListByType("group", "device", "Unknown"); err != ErrUnknownEventType {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsLatestPerDevice(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now()
+	latest := &Event{Time: now}
+	if err := events.Create("group", "device1",
+		&Event{Time: now.Add(-time.Hour)}, latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Create("group", "device2", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := events.LatestPerDevice("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected events: %v", list)
+	}
+	if event := list["device1"]; event == nil || event.ID != latest.ID {
+		t.Errorf("unexpected latest event: %v", event)
+	}
+	if list, err = events.LatestPerDevice("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("unexpected events: %v", list)
+	}
+}
+
+func TestEventsTrackSummary(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().Truncate(time.Second)
+	err := events.Create("group", "device",
+		&Event{Time: now, Location: &geo.Point{0, 0}},
+		&Event{Time: now.Add(time.Minute)}, // без координат
+		&Event{Time: now.Add(2 * time.Minute), Location: &geo.Point{1, 0}},
+		&Event{Time: now.Add(3 * time.Minute), Location: &geo.Point{1, 1}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := events.TrackSummary("group", "device", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.PointCount != 3 {
+		t.Errorf("unexpected point count: %d", summary.PointCount)
+	}
+	if !summary.FirstTime.Equal(now) || !summary.LastTime.Equal(now.Add(3*time.Minute)) {
+		t.Errorf("unexpected time span: %v - %v", summary.FirstTime, summary.LastTime)
+	}
+	// два отрезка примерно по одному градусу
+	if summary.TotalMeters < 222000 || summary.TotalMeters > 223000 {
+		t.Errorf("unexpected distance: %v", summary.TotalMeters)
+	}
+}
+
+func TestEventsTrackGeoJSON(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	err := events.Create("group", "device",
+		&Event{Location: &geo.Point{37.6173, 55.7558}, Type: EventTypeTravel,
+			Accuracy: 10, Power: 80, Comment: "comment"},
+		&Event{}, // без координат
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := events.TrackGeoJSON("group", "device", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collection struct {
+		Type     string
+		Features []struct {
+			Type     string
+			Geometry struct {
+				Type        string
+				Coordinates []float64
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		t.Fatal(err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 1 {
+		t.Fatalf("unexpected collection: %s", data)
+	}
+	feature := collection.Features[0]
+	if feature.Type != "Feature" || feature.Geometry.Type != "Point" ||
+		len(feature.Geometry.Coordinates) != 2 {
+		t.Errorf("unexpected feature: %s", data)
+	}
+	for _, name := range []string{"time", "type", "accuracy", "power", "comment"} {
+		if _, ok := feature.Properties[name]; !ok {
+			t.Errorf("property %q not found", name)
+		}
+	}
+}
+
+func TestEventsDeletePurgeForDevice(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	for _, deviceId := range []string{"device", "device", "device", "other"} {
+		if err := events.Create("group", deviceId, new(Event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := events.List("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "device", list[0].ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := events.DeletePurgeForDevice("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("unexpected removed count: %d", removed)
+	}
+	if n, err := events.Count("group", "other"); err != nil || n != 1 {
+		t.Errorf("unexpected other device events: %d, %v", n, err)
+	}
+}
+
+func TestEventsListAccurate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, accuracy := range []float64{5, 500, 0, 20, 1000} {
+		event := &Event{Time: now.Add(time.Duration(-i) * time.Minute), Accuracy: accuracy}
+		if err := events.Create("group", "device", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(accept bool) { AcceptUnknownAccuracy = accept }(AcceptUnknownAccuracy)
+	for _, test := range []struct {
+		accept     bool
+		accuracies []float64
+	}{
+		{true, []float64{20, 0, 5}},
+		{false, []float64{20, 5}},
+	} {
+		AcceptUnknownAccuracy = test.accept
+		list, err := events.ListAccurate("group", "device", 50, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != len(test.accuracies) {
+			t.Errorf("accept %v: unexpected events: %v", test.accept, list)
+			continue
+		}
+		for i, event := range list {
+			if event.Accuracy != test.accuracies[i] {
+				t.Errorf("accept %v: unexpected accuracy at %d: %v", test.accept, i, event.Accuracy)
+			}
+		}
+	}
+	// ограничение по времени
+	AcceptUnknownAccuracy = true
+	list, err := events.ListAccurate("group", "device", 50, now.Add(-2*time.Minute), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected events in period: %v", list)
+	}
+}
+
+func TestEventsLowPower(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, power := range []uint8{19, 20, 0, 5, 100} {
+		event := &Event{Time: now.Add(time.Duration(i) * time.Minute), Power: power}
+		if err := events.Create("group", "device", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := events.LowPower("group", "device", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Power != 19 || list[1].Power != 5 {
+		t.Errorf("unexpected events: %v", list)
+	}
+	if list, err = events.LowPower("group", "device", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("unexpected events for zero threshold: %v", list)
+	}
+}
+
+func TestEventsBadObjectId(t *testing.T) {
+	// сессия не нужна: при неверном идентификаторе запрос не должен начаться,
+	// а обращение к пустой сессии вызвало бы panic
+	events := new(DB).Events()
+	for name, call := range map[string]func() error{
+		"Get": func() error {
+			_, err := events.Get("group", "device", "bad")
+			return err
+		},
+		"SoftDelete": func() error { return events.SoftDelete("group", "device", "bad") },
+		"Patch":      func() error { return events.Patch("group", "device", "bad", nil) },
+		"Delete":     func() error { return events.Delete("group", "device", "bad") },
+	} {
+		if err := call(); err != ErrBadObjectId {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestEventsUpsert(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	if err := db.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	events := db.Events()
+	first := &Event{ExternalID: "1", Comment: "first"}
+	created, err := events.Upsert("group", "device", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("event is not created")
+	}
+	// повторная передача того же события
+	again := &Event{ExternalID: "1", Comment: "again"}
+	if created, err = events.Upsert("group", "device", again); err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("duplicate event is created")
+	}
+	if again.ID != first.ID {
+		t.Errorf("unexpected event id: %v != %v", again.ID, first.ID)
+	}
+	// без внешнего идентификатора событие всегда создается
+	for i := 0; i < 2; i++ {
+		if created, err = events.Upsert("group", "device", new(Event)); err != nil || !created {
+			t.Errorf("unexpected result: %v, %v", created, err)
+		}
+	}
+	// тот же внешний идентификатор у другого устройства
+	if created, err = events.Upsert("group", "other", &Event{ExternalID: "1"}); err != nil || !created {
+		t.Errorf("unexpected result: %v, %v", created, err)
+	}
+	list, err := events.List("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("unexpected events: %v", list)
+	}
+	stored, err := events.Get("group", "device", first.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Comment != "again" {
+		t.Errorf("event is not updated: %v", stored.Comment)
+	}
+	// уникальный индекс не дает создать дубликат напрямую
+	if err := events.Create("group", "device", &Event{ExternalID: "1"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsDeleteOlderThan(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, deviceId := range []string{"device", "other"} {
+		for days := 0; days < 4; days++ {
+			event := &Event{Time: now.AddDate(0, 0, -days)}
+			if err := events.Create("group", deviceId, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cutoff := now.AddDate(0, 0, -2)
+	removed, err := events.DeleteOlderThanForDevice("group", "device", cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("unexpected removed for device: %d", removed)
+	}
+	if removed, err = events.DeleteOlderThan("group", now.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("unexpected removed for group: %d", removed)
+	}
+	for _, deviceId := range []string{"device", "other"} {
+		if n, err := events.Count("group", deviceId); err != nil || n != 2 {
+			t.Errorf("%s: unexpected count: %d, %v", deviceId, n, err)
+		}
+	}
+}
+
+func TestEventsDedupe(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().UTC().Truncate(time.Second)
+	point := &geo.Point{37.57, 55.71}
+	for _, deviceId := range []string{"device", "other"} {
+		for i := 0; i < 3; i++ {
+			err := events.Create("group", deviceId,
+				&Event{Time: now, Location: point},
+				&Event{Time: now, Location: &geo.Point{37.58, 55.71}},
+				&Event{Time: now.Add(time.Minute), Location: point})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	removed, err := events.Dedupe("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 6 {
+		t.Errorf("unexpected removed: %d", removed)
+	}
+	if removed, err = events.Dedupe("group", "device"); err != nil || removed != 0 {
+		t.Errorf("unexpected second run: %d, %v", removed, err)
+	}
+	if n, err := events.Count("group", "device"); err != nil || n != 3 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+	if n, err := events.Count("group", "other"); err != nil || n != 9 {
+		t.Errorf("other device is changed: %d, %v", n, err)
+	}
+}
+
+func TestEventsSearchComments(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	if err := db.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	events := db.Events()
+	for deviceId, comments := range map[string][]string{
+		"device": {"Забрал посылку", "Посылки нет", "Обед"},
+		"other":  {"Отдал посылку"},
+	} {
+		for _, comment := range comments {
+			if err := events.Create("group", deviceId, &Event{Comment: comment}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list, err := events.SearchComments("group", "device", "посылка")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected device events: %v", list)
+	}
+	for _, event := range list {
+		if event.Data != nil {
+			t.Errorf("unexpected event data: %v", event.Data)
+		}
+	}
+	if list, err = events.SearchComments("group", "", "посылку"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("unexpected group events: %v", list)
+	}
+}
+
+func TestEventsCreateReturning(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	preset := bson.NewObjectId()
+	list := []*Event{{Comment: "first"}, {ID: preset, Comment: "second"}, {Comment: "third"}}
+	ids, err := events.CreateReturning("group", "device", list...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(list) || ids[1] != preset {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+	for i, id := range ids {
+		event, err := events.Get("group", "device", id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Comment != list[i].Comment {
+			t.Errorf("%d: unexpected event: %v", i, event)
+		}
+	}
+	if _, err := events.CreateReturning("group", "device", &Event{Type: "unknown"}); err != ErrUnknownEventType {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDownsampleBucket(t *testing.T) {
+	ids := make([]bson.ObjectId, 5)
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	for i, test := range []struct {
+		accuracy []float64
+		keep     int
+	}{
+		{[]float64{10}, 0},
+		{[]float64{30, 10, 20}, 2},
+		{[]float64{40, 10, 30, 20}, 3},
+		{[]float64{0, 50, 0, 5, 0}, 3},
+		{[]float64{0, 0, 0, 0}, 1},
+	} {
+		bucket := make([]downsamplePoint, len(test.accuracy))
+		for j, accuracy := range test.accuracy {
+			bucket[j] = downsamplePoint{ID: ids[j], Accuracy: accuracy}
+		}
+		removed := downsampleBucket(bucket)
+		if len(bucket) > 1 && len(removed) != len(bucket)-1 {
+			t.Errorf("%d: unexpected removed: %v", i, removed)
+		}
+		for _, id := range removed {
+			if id == ids[test.keep] {
+				t.Errorf("%d: median event is removed", i)
+			}
+		}
+	}
+}
+
+func TestEventsDownsample(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	start := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Hour)
+	var median *Event
+	for i, accuracy := range []float64{50, 10, 30, 0} {
+		event := &Event{Time: start.Add(time.Duration(i) * time.Minute), Accuracy: accuracy}
+		if accuracy == 30 {
+			median = event
+		}
+		if err := events.Create("group", "device", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// одиночное событие в другом часе и свежие события не затрагиваются
+	err := events.Create("group", "device",
+		&Event{Time: start.Add(time.Hour)},
+		&Event{Time: time.Now().UTC()},
+		&Event{Time: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Downsample("group", "device", time.Now(), 0); err != ErrBadInterval {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cutoff := time.Now().UTC().Add(-time.Hour)
+	removed, err := events.Downsample("group", "device", cutoff, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("unexpected removed: %d", removed)
+	}
+	if _, err := events.Get("group", "device", median.ID.Hex()); err != nil {
+		t.Errorf("median event is removed: %v", err)
+	}
+	if n, err := events.Count("group", "device"); err != nil || n != 4 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+	if removed, err = events.Downsample("group", "device", cutoff, time.Hour); err != nil || removed != 0 {
+		t.Errorf("unexpected second run: %d, %v", removed, err)
+	}
+}
+
+func TestEventsDedupeKeepsLive(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	now := time.Now().UTC().Truncate(time.Second)
+	// удаленный повтор добавлен первым и имеет меньший идентификатор
+	deleted := &Event{ID: bson.NewObjectId(), Time: now, Location: &geo.Point{37.57, 55.71}}
+	live := &Event{ID: bson.NewObjectId(), Time: now, Location: &geo.Point{37.57, 55.71}}
+	if deleted.ID >= live.ID {
+		t.Fatal("unexpected object id order")
+	}
+	if err := events.Create("group", "device", deleted, live); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "device", deleted.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := events.Dedupe("group", "device"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := events.Get("group", "device", live.ID.Hex()); err != nil {
+		t.Errorf("live event is removed: %v", err)
+	}
+	if n, err := events.Count("group", "device"); err != nil || n != 1 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+	if list, err := events.ListDeleted("group", "device"); err != nil || len(list) != 0 {
+		t.Errorf("deleted duplicate is kept: %v, %v", list, err)
+	}
+}
+
+func TestValidatePatch(t *testing.T) {
+	point := geo.Point{37.6173, 55.7558}
+	for _, fields := range []bson.M{
+		nil,
+		{"comment": "comment", "power": 50},
+		{"time": time.Now()},
+		{"type": EventTypeArrive},
+		{"type": ""},
+		{"emoji": '🚗'},
+		{"emoji": 0x1F697},
+		{"emoji": 0},
+		{"location": point},
+		{"location": &point},
+		{"location": (*geo.Point)(nil)},
+	} {
+		if err := validatePatch(fields); err != nil {
+			t.Errorf("%v: unexpected error: %v", fields, err)
+		}
+	}
+	for _, test := range []struct {
+		fields bson.M
+		err    error
+	}{
+		{bson.M{"_id": "value"}, ErrImmutableField},
+		{bson.M{"groupId": "value"}, ErrImmutableField},
+		{bson.M{"deviceId": "value"}, ErrImmutableField},
+		{bson.M{"createdAt": time.Now()}, ErrImmutableField},
+		{bson.M{"updatedAt": time.Now()}, ErrImmutableField},
+		{bson.M{"deletedAt": nil}, ErrImmutableField},
+		{bson.M{"time": time.Now().Add(MaxEventTimeAhead + time.Hour)}, ErrEventTimeInFuture},
+		{bson.M{"time": time.Time{}}, ErrBadEventTime},
+		{bson.M{"time": "2016-08-01T07:00:00Z"}, ErrBadEventTime},
+		{bson.M{"type": "Unknown"}, ErrUnknownEventType},
+		{bson.M{"type": 1}, ErrUnknownEventType},
+		{bson.M{"emoji": 'a'}, ErrBadEmoji},
+		{bson.M{"emoji": "🚗"}, ErrBadEmoji},
+		{bson.M{"location": geo.Point{500, 500}}, ErrInvalidLocation},
+		{bson.M{"location": &geo.Point{0, 91}}, ErrInvalidLocation},
+		{bson.M{"location": []interface{}{500, 500}}, ErrInvalidLocation},
+		{bson.M{"location": nil}, ErrInvalidLocation},
+	} {
+		if err := validatePatch(test.fields); err != test.err {
+			t.Errorf("%v: unexpected error: %v", test.fields, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package model
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GroupExport содержит все данные группы: пользователей, устройства, места и
+// события, включая помеченные как удаленные. Хеши паролей пользователей и
+// устройств в него не попадают. Используется для выгрузки данных по запросу
+// пользователя и для резервного копирования.
+type GroupExport struct {
+	GroupID string    `json:"group"`
+	Users   []User    `json:"users"`
+	Devices []*Device `json:"devices"`
+	Places  []*Place  `json:"places"`
+	Events  []*Event  `json:"events"`
+}
+
+// ExportGroup возвращает все данные указанной группы. Все события группы при
+// этом загружаются в память, поэтому для групп с большим количеством событий
+// лучше использовать WriteGroupJSON.
+func (db *DB) ExportGroup(groupId string) (export *GroupExport, err error) {
+	return db.ExportGroupContext(context.Background(), groupId)
+}
+
+// ExportGroupContext работает как ExportGroup, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *DB) ExportGroupContext(ctx context.Context, groupId string) (export *GroupExport, err error) {
+	result, err := db.exportGroup(ctx, groupId, true)
+	if err == nil {
+		export = result
+	}
+	return
+}
+
+// exportGroup возвращает данные группы. События загружаются, только если
+// withEvents равен true.
+func (db *DB) exportGroup(ctx context.Context, groupId string, withEvents bool) (*GroupExport, error) {
+	result := &GroupExport{
+		GroupID: groupId,
+		Users:   make([]User, 0),
+		Devices: make([]*Device, 0),
+		Places:  make([]*Place, 0),
+		Events:  make([]*Event, 0),
+	}
+	query := bson.M{"groupId": groupId}
+	err := db.execDB(ctx, func(mdb *mgo.Database) error {
+		err := db.c(mdb, CollectionUsers).Find(query).
+			Select(bson.M{"password": 0}).All(&result.Users)
+		if err != nil {
+			return err
+		}
+		err = db.c(mdb, CollectionDevices).Find(query).
+			Select(bson.M{"password": 0}).All(&result.Devices)
+		if err != nil {
+			return err
+		}
+		err = db.c(mdb, CollectionPlaces).Find(query).
+			Select(bson.M{"geo": 0}).All(&result.Places)
+		if err != nil || !withEvents {
+			return err
+		}
+		return db.c(mdb, CollectionEvents).Find(query).Sort("time").All(&result.Events)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WriteJSON записывает данные группы в формате JSON.
+func (e *GroupExport) WriteJSON(w io.Writer) error {
+	i := 0
+	return e.writeJSON(w, func(event *Event) bool {
+		if i >= len(e.Events) {
+			return false
+		}
+		*event = *e.Events[i]
+		i++
+		return true
+	})
+}
+
+// writeJSON записывает данные группы в формате JSON, получая события по одному
+// с помощью функции next. Поле Events при этом не используется.
+func (e *GroupExport) writeJSON(w io.Writer, next func(event *Event) bool) error {
+	header, err := json.Marshal(struct {
+		GroupID string    `json:"group"`
+		Users   []User    `json:"users"`
+		Devices []*Device `json:"devices"`
+		Places  []*Place  `json:"places"`
+	}{e.GroupID, e.Users, e.Devices, e.Places})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	// заменяем закрывающую скобку объекта на список событий
+	bw.Write(header[:len(header)-1])
+	bw.WriteString(`,"events":[`)
+	var event Event
+	for i := 0; next(&event); i++ {
+		data, err := json.Marshal(&event)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(data)
+		event = Event{}
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
+
+// WriteGroupJSON записывает все данные указанной группы в формате JSON так же,
+// как GroupExport.WriteJSON, но, в отличие от ExportGroup, не загружает все
+// события в память, а читает их из хранилища по мере записи.
+func (db *DB) WriteGroupJSON(w io.Writer, groupId string) error {
+	return db.WriteGroupJSONContext(context.Background(), w, groupId)
+}
+
+// WriteGroupJSONContext работает как WriteGroupJSON, но позволяет прервать
+// выполнение с помощью контекста.
+func (db *DB) WriteGroupJSONContext(ctx context.Context, w io.Writer, groupId string) error {
+	export, err := db.exportGroup(ctx, groupId, false)
+	if err != nil {
+		return err
+	}
+	iter, err := db.Events().newEventIter(ctx, bson.M{"groupId": groupId}, nil)
+	if err != nil {
+		return err
+	}
+	if err = export.writeJSON(w, iter.Next); err != nil {
+		iter.Close()
+		return err
+	}
+	return iter.Close()
+}
+
+// eventsCSVHeader задает заголовок таблицы событий в формате CSV.
+var eventsCSVHeader = []string{
+	"time", "lat", "lng", "accuracy", "power", "type", "comment",
+}
+
+// csvRecord возвращает строку таблицы событий в формате CSV. Время
+// записывается в UTC в формате RFC 3339. Для событий без координат, без
+// указания точности или уровня заряда соответствующие колонки остаются
+// пустыми.
+func (e *Event) csvRecord() []string {
+	record := make([]string, len(eventsCSVHeader))
+	record[0] = e.Time.UTC().Format(time.RFC3339Nano)
+	if e.Location != nil {
+		record[1] = strconv.FormatFloat(e.Location[1], 'f', -1, 64)
+		record[2] = strconv.FormatFloat(e.Location[0], 'f', -1, 64)
+	}
+	if e.Accuracy != 0 {
+		record[3] = strconv.FormatFloat(e.Accuracy, 'f', -1, 64)
+	}
+	if e.Power != 0 {
+		record[4] = strconv.Itoa(int(e.Power))
+	}
+	record[5] = e.Type
+	record[6] = e.Comment
+	return record
+}
+
+// writeEventsCSV записывает таблицу событий в формате CSV, получая события по
+// одному с помощью функции next.
+func writeEventsCSV(w io.Writer, next func(event *Event) bool) error {
+	cw := csv.NewWriter(w)
+	cw.Write(eventsCSVHeader)
+	var event Event
+	for next(&event) {
+		if err := cw.Write(event.csvRecord()); err != nil {
+			return err
+		}
+		event = Event{}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportCSV записывает отсортированные по времени события устройства за
+// указанный интервал времени (границы интервала задаются так же, как в
+// CountByTime) в формате CSV: строку заголовка и по одной строке на событие с
+// колонками time, lat, lng, accuracy, power, type и comment. События читаются
+// из хранилища по мере записи и не загружаются в память все сразу.
+func (db *Events) ExportCSV(groupID, deviceId string, from, to time.Time, w io.Writer) error {
+	return db.ExportCSVContext(context.Background(), groupID, deviceId, from, to, w)
+}
+
+// ExportCSVContext работает как ExportCSV, но позволяет прервать выполнение с
+// помощью контекста.
+func (db *Events) ExportCSVContext(ctx context.Context, groupID, deviceId string, from, to time.Time, w io.Writer) error {
+	query := bson.M{"groupId": groupID, "deviceId": deviceId}
+	if period := timeRange(from, to); period != nil {
+		query["time"] = period
+	}
+	iter, err := db.newEventIter(ctx, notDeleted(query), bson.M{
+		"time": 1, "location": 1, "accuracy": 1, "power": 1, "type": 1, "comment": 1,
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeEventsCSV(w, iter.Next); err != nil {
+		iter.Close()
+		return err
+	}
+	return iter.Close()
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+func TestGroupExportWriteJSON(t *testing.T) {
+	for _, events := range [][]*Event{
+		{},
+		{{DeviceID: "device", Comment: "first"}, {DeviceID: "device", Comment: "second"}},
+	} {
+		export := &GroupExport{
+			GroupID: "group",
+			Users:   []User{{Login: "login"}},
+			Devices: []*Device{},
+			Places:  []*Place{},
+			Events:  events,
+		}
+		var buf bytes.Buffer
+		if err := export.WriteJSON(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var decoded GroupExport
+		if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatalf("bad json %s: %v", buf.Bytes(), err)
+		}
+		if decoded.GroupID != "group" || len(decoded.Users) != 1 ||
+			len(decoded.Events) != len(events) {
+			t.Errorf("unexpected export: %s", buf.Bytes())
+		}
+	}
+}
+
+func TestExportGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Users().Create(&User{Login: "login", GroupID: "group", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Devices().Create("group", &Device{ID: "device", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	if err := db.Places().Create("group", &Place{ID: "place", Circle: &circle}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Events().Create("group", "device", new(Event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Events().Create("other", "device", new(Event)); err != nil {
+		t.Fatal(err)
+	}
+	export, err := db.ExportGroup("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Users) != 1 || len(export.Devices) != 1 ||
+		len(export.Places) != 1 || len(export.Events) != 3 {
+		t.Errorf("unexpected export: %+v", export)
+	}
+	if len(export.Users[0].Password) != 0 || len(export.Devices[0].Password) != 0 {
+		t.Error("password hashes are exported")
+	}
+	var loaded, streamed bytes.Buffer
+	if err := export.WriteJSON(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteGroupJSON(&streamed, "group"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Bytes(), streamed.Bytes()) {
+		t.Errorf("streamed export differs:\n%s\n%s", loaded.Bytes(), streamed.Bytes())
+	}
+}
+
+func TestWriteEventsCSV(t *testing.T) {
+	events := []*Event{
+		{
+			Time:     time.Date(2016, 8, 1, 7, 0, 0, 0, time.UTC),
+			Type:     EventTypeTravel,
+			Location: &geo.Point{37.6184, 55.7512},
+			Accuracy: 12.5,
+			Power:    80,
+			Comment:  "Hello, \"world\"",
+		},
+		{
+			Time:    time.Date(2016, 8, 1, 8, 0, 0, 0, time.UTC),
+			Comment: "no location",
+		},
+	}
+	i := 0
+	var buf bytes.Buffer
+	err := writeEventsCSV(&buf, func(event *Event) bool {
+		if i >= len(events) {
+			return false
+		}
+		*event = *events[i]
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,lat,lng,accuracy,power,type,comment\n" +
+		"2016-08-01T07:00:00Z,55.7512,37.6184,12.5,80,Travel,\"Hello, \"\"world\"\"\"\n" +
+		"2016-08-01T08:00:00Z,,,,,,no location\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected csv:\n%s", buf.String())
+	}
+}
+
+func TestEventsExportCSV(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err := events.Create("group", "device",
+		&Event{Time: start, Location: &geo.Point{37.6, 55.7}, Comment: "first"},
+		&Event{Time: start.Add(time.Minute), Comment: "second"},
+		&Event{Time: start.Add(2 * time.Minute), Comment: "late"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = events.ExportCSV("group", "device", start, start.Add(2*time.Minute), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "55.7,37.6,,,,first") ||
+		!strings.HasSuffix(lines[2], ",,,,,second") {
+		t.Errorf("unexpected csv:\n%s", buf.String())
+	}
+}
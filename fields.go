@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrBadField возвращается методами GetFields и ListFields, если запрошено
+// поле, которого нет в описании, или поле, которое не может быть возвращено,
+// например, хеш пароля.
+var ErrBadField = errors.New("bad field name")
+
+// fieldSelector возвращает проекцию MongoDB, которая включает только
+// указанные поля описания v. Названия полей проверяются по тегам bson
+// структуры; поля из списка hidden считаются отсутствующими и в проекцию
+// никогда не попадают. Идентификатор (_id) MongoDB возвращает всегда, даже
+// если он не запрошен.
+func fieldSelector(v interface{}, fields []string, hidden ...string) (bson.M, error) {
+	known := bsonFields(v)
+	for _, name := range hidden {
+		delete(known, name)
+	}
+	selector := bson.M{"_id": 1}
+	for _, name := range fields {
+		if !known[name] {
+			return nil, ErrBadField
+		}
+		selector[name] = 1
+	}
+	return selector, nil
+}
+
+// bsonFields возвращает названия полей, под которыми описание v, заданное
+// указателем на структуру, сохраняется в хранилище. Встроенные (inline) поля
+// не учитываются.
+func bsonFields(v interface{}) map[string]bool {
+	fields := make(map[string]bool)
+	typ := reflect.TypeOf(v).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("bson")
+		if tag == "-" || strings.Contains(tag, ",inline") {
+			continue
+		}
+		if n := strings.IndexByte(tag, ','); n >= 0 {
+			tag = tag[:n]
+		}
+		if tag == "" {
+			tag = strings.ToLower(typ.Field(i).Name)
+		}
+		fields[tag] = true
+	}
+	return fields
+}
@@ -0,0 +1,29 @@
+package model
+
+import "testing"
+
+func TestFieldSelector(t *testing.T) {
+	selector, err := fieldSelector((*Device)(nil), []string{"name", "type"}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selector) != 3 || selector["_id"] != 1 || selector["name"] != 1 || selector["type"] != 1 {
+		t.Errorf("unexpected selector: %v", selector)
+	}
+	for _, fields := range [][]string{
+		{"password"},
+		{"name", "unknown"},
+		{"Name"},
+	} {
+		if _, err := fieldSelector((*Device)(nil), fields, "password"); err != ErrBadField {
+			t.Errorf("%v: unexpected error: %v", fields, err)
+		}
+	}
+	// поля, встроенные в событие, не являются его полями
+	if _, err := fieldSelector((*Event)(nil), []string{"data"}); err != ErrBadField {
+		t.Errorf("unexpected error for inline field: %v", err)
+	}
+	if _, err := fieldSelector((*Event)(nil), []string{"location", "time"}); err != nil {
+		t.Error(err)
+	}
+}
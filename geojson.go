@@ -0,0 +1,149 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/geotrace/geo"
+)
+
+// geoJSONFeature описывает объект Feature в формате GeoJSON.
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id,omitempty"`
+	Geometry   interface{}            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// newGeoJSONFeature возвращает новый объект Feature с указанной геометрией.
+func newGeoJSONFeature(id, geometry interface{}) *geoJSONFeature {
+	return &geoJSONFeature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   geometry,
+		Properties: make(map[string]interface{}),
+	}
+}
+
+// geoJSONFeatureCollection описывает объект FeatureCollection в формате
+// GeoJSON.
+type geoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+// newGeoJSONFeatureCollection возвращает новую пустую коллекцию объектов
+// Feature.
+func newGeoJSONFeatureCollection() *geoJSONFeatureCollection {
+	return &geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*geoJSONFeature, 0),
+	}
+}
+
+// Bytes возвращает коллекцию в формате JSON.
+func (c *geoJSONFeatureCollection) Bytes() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// Ошибки разбора описания места в формате GeoJSON.
+var (
+	// данные не являются корректным объектом GeoJSON
+	ErrBadGeoJSON = errors.New("bad GeoJSON")
+	// тип геометрии не поддерживается: допустимы только Polygon и MultiPolygon
+	ErrUnsupportedGeometry = errors.New("unsupported GeoJSON geometry type")
+)
+
+// geoJSONObject описывает разбираемый объект GeoJSON: Feature или геометрию.
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Properties  json.RawMessage `json:"properties"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// PlaceFromGeoJSON возвращает описание места, созданное по описанию объекта
+// Feature или геометрии в формате GeoJSON, например, экспортированному из ГИС.
+// Геометрия Polygon становится полигоном места, а MultiPolygon — набором
+// полигонов. Для остальных типов геометрии возвращается ошибка,
+// соответствующая ErrUnsupportedGeometry, а для некорректных данных —
+// ErrBadGeoJSON или ErrInvalidPolygon. Если у объекта Feature задано
+// свойство name, то оно используется как имя места. Место при этом не
+// сохраняется в хранилище.
+func PlaceFromGeoJSON(data []byte) (*Place, error) {
+	var object geoJSONObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, ErrBadGeoJSON
+	}
+	place := new(Place)
+	if object.Type == "Feature" {
+		if len(object.Properties) > 0 {
+			var properties struct {
+				Name interface{} `json:"name"`
+			}
+			if err := json.Unmarshal(object.Properties, &properties); err != nil {
+				return nil, ErrBadGeoJSON
+			}
+			if name, ok := properties.Name.(string); ok {
+				place.Name = name
+			}
+		}
+		if object.Geometry == nil {
+			return nil, ErrBadGeoJSON
+		}
+		object = *object.Geometry
+	}
+	switch object.Type {
+	case "Polygon":
+		var coordinates [][][]float64
+		if err := json.Unmarshal(object.Coordinates, &coordinates); err != nil {
+			return nil, ErrBadGeoJSON
+		}
+		polygon, err := geoJSONPolygon(coordinates)
+		if err != nil {
+			return nil, err
+		}
+		place.Polygon = &polygon
+	case "MultiPolygon":
+		var coordinates [][][][]float64
+		if err := json.Unmarshal(object.Coordinates, &coordinates); err != nil {
+			return nil, ErrBadGeoJSON
+		}
+		if len(coordinates) == 0 {
+			return nil, ErrBadGeoJSON
+		}
+		place.Polygons = make([]geo.Polygon, len(coordinates))
+		for i, rings := range coordinates {
+			polygon, err := geoJSONPolygon(rings)
+			if err != nil {
+				return nil, err
+			}
+			place.Polygons[i] = polygon
+		}
+	case "":
+		return nil, ErrBadGeoJSON
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedGeometry, object.Type)
+	}
+	return place, nil
+}
+
+// geoJSONPolygon преобразует координаты полигона GeoJSON в полигон и проверяет
+// его корректность. Высота, если указана, отбрасывается.
+func geoJSONPolygon(rings [][][]float64) (geo.Polygon, error) {
+	polygon := make(geo.Polygon, len(rings))
+	for i, ring := range rings {
+		polygon[i] = make([]geo.Point, len(ring))
+		for j, point := range ring {
+			if len(point) < 2 {
+				return nil, ErrBadGeoJSON
+			}
+			polygon[i][j] = geo.Point{point[0], point[1]}
+		}
+	}
+	if err := validatePolygon(polygon); err != nil {
+		return nil, err
+	}
+	return polygon, nil
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlaceFromGeoJSON(t *testing.T) {
+	place, err := PlaceFromGeoJSON([]byte(`{
+		"type": "Feature",
+		"properties": {"name": "Офис", "color": "red"},
+		"geometry": {
+			"type": "Polygon",
+			"coordinates": [[[37.61, 55.75], [37.62, 55.75, 150], [37.62, 55.76], [37.61, 55.75]]]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place.Name != "Офис" || place.Polygon == nil || len(*place.Polygon) != 1 ||
+		len((*place.Polygon)[0]) != 4 || (*place.Polygon)[0][1][0] != 37.62 {
+		t.Errorf("unexpected place: %#v", place)
+	}
+	if err := place.prepare(); err != nil {
+		t.Errorf("imported place is invalid: %v", err)
+	}
+
+	place, err = PlaceFromGeoJSON([]byte(`{
+		"type": "MultiPolygon",
+		"coordinates": [
+			[[[0, 0], [1, 0], [1, 1], [0, 0]]],
+			[[[5, 5], [6, 5], [6, 6], [5, 5]]]
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place.Name != "" || place.Polygon != nil || len(place.Polygons) != 2 {
+		t.Errorf("unexpected place: %#v", place)
+	}
+
+	for name, test := range map[string]struct {
+		data string
+		err  error
+	}{
+		"point": {`{"type": "Point", "coordinates": [0, 0]}`, ErrUnsupportedGeometry},
+		"feature line": {`{"type": "Feature", "geometry": {"type": "LineString",
+			"coordinates": [[0, 0], [1, 1]]}}`, ErrUnsupportedGeometry},
+		"collection":   {`{"type": "FeatureCollection", "features": []}`, ErrUnsupportedGeometry},
+		"no geometry":  {`{"type": "Feature", "properties": {"name": "x"}}`, ErrBadGeoJSON},
+		"not json":     {`polygon`, ErrBadGeoJSON},
+		"no type":      {`{"coordinates": []}`, ErrBadGeoJSON},
+		"short point":  {`{"type": "Polygon", "coordinates": [[[0], [1, 0], [1, 1], [0]]]}`, ErrBadGeoJSON},
+		"open ring":    {`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1]]]}`, ErrInvalidPolygon},
+		"empty multi":  {`{"type": "MultiPolygon", "coordinates": []}`, ErrBadGeoJSON},
+		"bad property": {`{"type": "Feature", "properties": [], "geometry": {}}`, ErrBadGeoJSON},
+	} {
+		if _, err := PlaceFromGeoJSON([]byte(test.data)); !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
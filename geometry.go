@@ -0,0 +1,423 @@
+package model
+
+import (
+	"errors"
+	"math"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrInvalidPolygon возвращается, если описание полигона некорректно: кольцо не
+// замкнуто, содержит меньше четырех точек или пересекает само себя.
+var ErrInvalidPolygon = errors.New("invalid polygon")
+
+// validatePolygon проверяет корректность всех колец полигона и возвращает
+// ErrInvalidPolygon, если хотя бы одно из них некорректно.
+func validatePolygon(polygon geo.Polygon) error {
+	if len(polygon) == 0 {
+		return ErrInvalidPolygon
+	}
+	for _, ring := range polygon {
+		if !validRing(ring) {
+			return ErrInvalidPolygon
+		}
+	}
+	return nil
+}
+
+// validRing возвращает true, если кольцо полигона замкнуто (первая точка
+// совпадает с последней), содержит не меньше четырех точек и не пересекает
+// само себя.
+func validRing(ring []geo.Point) bool {
+	n := len(ring)
+	if n < 4 || ring[0] != ring[n-1] {
+		return false
+	}
+	// проверяем попарно все несмежные отрезки кольца на пересечение
+	segments := n - 1
+	for i := 0; i < segments; i++ {
+		for j := i + 1; j < segments; j++ {
+			if j == i+1 || (i == 0 && j == segments-1) {
+				continue // смежные отрезки имеют общую точку
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// segmentsIntersect возвращает true, если отрезки p1-p2 и p3-p4 имеют хотя бы
+// одну общую точку.
+func segmentsIntersect(p1, p2, p3, p4 geo.Point) bool {
+	d1 := orientation(p3, p4, p1)
+	d2 := orientation(p3, p4, p2)
+	d3 := orientation(p1, p2, p3)
+	d4 := orientation(p1, p2, p4)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(p3, p4, p1)) ||
+		(d2 == 0 && onSegment(p3, p4, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, p3)) ||
+		(d4 == 0 && onSegment(p1, p2, p4))
+}
+
+// orientation возвращает знак векторного произведения (b - a) × (c - a):
+// положительное значение, если точка c лежит слева от направления a-b,
+// отрицательное — справа и ноль, если все три точки лежат на одной прямой.
+func orientation(a, b, c geo.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment возвращает true, если точка p, лежащая на одной прямой с отрезком
+// a-b, находится в его пределах.
+func onSegment(a, b, p geo.Point) bool {
+	return p[0] >= math.Min(a[0], b[0]) && p[0] <= math.Max(a[0], b[0]) &&
+		p[1] >= math.Min(a[1], b[1]) && p[1] <= math.Max(a[1], b[1])
+}
+
+// earthRadius задает средний радиус Земли в метрах.
+const earthRadius = 6371008.8
+
+// CircleSegments задает количество вершин многоугольника, которым
+// аппроксимируется окружность в описании места для индексации. Большее
+// количество вершин точнее описывает окружность, но увеличивает размер
+// сохраняемых данных. Нулевое значение означает, что используется
+// преобразование по умолчанию из пакета geo.
+var CircleSegments = 0
+
+// circleGeo возвращает описание окружности в формате GeoJSON в виде
+// многоугольника с количеством вершин, заданным CircleSegments.
+func circleGeo(circle *geo.Circle) interface{} {
+	if CircleSegments < 3 {
+		return circle.Geo()
+	}
+	ring := make([]geo.Point, CircleSegments+1)
+	for i := 0; i < CircleSegments; i++ {
+		bearing := 2 * math.Pi * float64(i) / float64(CircleSegments)
+		ring[i] = destination(circle.Center, bearing, circle.Radius)
+	}
+	ring[CircleSegments] = ring[0] // кольцо должно быть замкнуто
+	return bson.M{"type": "Polygon", "coordinates": [][]geo.Point{ring}}
+}
+
+// ErrInvalidLine возвращается, если описание маршрута некорректно: содержит
+// меньше двух различных точек или ширина коридора отрицательна либо превышает
+// MaxCircleRadius.
+var ErrInvalidLine = errors.New("invalid line")
+
+// Line описывает маршрут в виде ломаной линии и ширины коридора вокруг нее.
+type Line struct {
+	// точки ломаной линии маршрута
+	Points []geo.Point `bson:"points" json:"points"`
+	// ширина коридора вокруг маршрута в метрах
+	Width float64 `bson:"width,omitempty" json:"width,omitempty"`
+}
+
+// geo возвращает описание маршрута в формате GeoJSON для индексации.
+//
+// Если ширина коридора не задана, то маршрут сохраняется как LineString. С
+// такой геометрией работают запросы на пересечение, но точка практически
+// никогда не оказывается внутри линии. Если же ширина задана, то коридор
+// сохраняется как набор (GeometryCollection) прямоугольников вокруг каждого
+// отрезка ломаной, продленных на половину ширины с каждой стороны, чтобы
+// перекрыть изломы маршрута.
+func (l *Line) geo() (interface{}, error) {
+	if l.Width < 0 || l.Width > MaxCircleRadius {
+		return nil, ErrInvalidLine
+	}
+	// пропускаем повторяющиеся точки, чтобы не получить вырожденные отрезки
+	points := make([]geo.Point, 0, len(l.Points))
+	for i, point := range l.Points {
+		if i == 0 || point != l.Points[i-1] {
+			points = append(points, point)
+		}
+	}
+	if len(points) < 2 {
+		return nil, ErrInvalidLine
+	}
+	if l.Width == 0 {
+		return bson.M{"type": "LineString", "coordinates": points}, nil
+	}
+	half := l.Width / 2
+	geometries := make([]bson.M, len(points)-1)
+	for i := range geometries {
+		a, b := points[i], points[i+1]
+		forward := bearing(a, b)
+		a = destination(a, forward+math.Pi, half)
+		b = destination(b, forward, half)
+		left, right := forward-math.Pi/2, forward+math.Pi/2
+		ring := []geo.Point{
+			destination(a, left, half),
+			destination(b, left, half),
+			destination(b, right, half),
+			destination(a, right, half),
+		}
+		ring = append(ring, ring[0]) // кольцо должно быть замкнуто
+		geometries[i] = bson.M{"type": "Polygon", "coordinates": [][]geo.Point{ring}}
+	}
+	return bson.M{"type": "GeometryCollection", "geometries": geometries}, nil
+}
+
+// bearing возвращает начальное направление (в радианах, отсчитывается от
+// севера по часовой стрелке) от точки p1 на точку p2.
+func bearing(p1, p2 geo.Point) float64 {
+	lat1, lat2 := p1[1]*math.Pi/180, p2[1]*math.Pi/180
+	dlon := (p2[0] - p1[0]) * math.Pi / 180
+	return math.Atan2(math.Sin(dlon)*math.Cos(lat2),
+		math.Cos(lat1)*math.Sin(lat2)-math.Sin(lat1)*math.Cos(lat2)*math.Cos(dlon))
+}
+
+// destination возвращает точку, находящуюся на указанном расстоянии в метрах
+// от заданной по направлению bearing (в радианах, отсчитывается от севера по
+// часовой стрелке).
+func destination(p geo.Point, bearing, distance float64) geo.Point {
+	lat1, lon1 := p[1]*math.Pi/180, p[0]*math.Pi/180
+	d := distance / earthRadius
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) +
+		math.Cos(lat1)*math.Sin(d)*math.Cos(bearing))
+	lon2 := lon1 + math.Atan2(math.Sin(bearing)*math.Sin(d)*math.Cos(lat1),
+		math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	// нормализуем долготу в диапазон [-180, 180)
+	lon := math.Mod(lon2*180/math.Pi+540, 360) - 180
+	return geo.Point{lon, lat2 * 180 / math.Pi}
+}
+
+// DistanceTo возвращает расстояние в метрах по поверхности Земли между местами
+// регистрации двух событий. Если хотя бы для одного из них координаты не
+// заданы, то возвращается false.
+func (e *Event) DistanceTo(other *Event) (float64, bool) {
+	if e.Location == nil || other == nil || other.Location == nil {
+		return 0, false
+	}
+	return distance(*e.Location, *other.Location), true
+}
+
+// AccuracyCircle возвращает круг с центром в месте регистрации события и
+// радиусом, равным точности определения координат, т.е. область, в которой
+// находилось устройство. Если координаты или точность не заданы, то
+// возвращается false.
+func (e *Event) AccuracyCircle() (*geo.Circle, bool) {
+	if e.Location == nil || e.Accuracy <= 0 {
+		return nil, false
+	}
+	return &geo.Circle{Center: *e.Location, Radius: e.Accuracy}, true
+}
+
+// distance возвращает расстояние в метрах между двумя точками по поверхности
+// Земли, вычисленное по формуле гаверсинусов.
+func distance(p1, p2 geo.Point) float64 {
+	lat1, lat2 := p1[1]*math.Pi/180, p2[1]*math.Pi/180
+	dlat, dlon := lat2-lat1, (p2[0]-p1[0])*math.Pi/180
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Contains возвращает true, если точка находится внутри места. Проверка
+// выполняется локально, без обращения к хранилищу, по описанию места с тем же
+// приоритетом, что и на сервере: круг, полигон, набор полигонов, маршрут. Для
+// круга проверяется расстояние до центра, а для полигонов используется
+// трассировка луча. Описание места не обязательно должно быть сохранено.
+func (p *Place) Contains(point geo.Point) bool {
+	switch {
+	case p.Circle != nil:
+		return distance(p.Circle.Center, point) <= p.Circle.Radius
+	case p.Polygon != nil:
+		return polygonContains(*p.Polygon, point)
+	case len(p.Polygons) > 0:
+		for _, polygon := range p.Polygons {
+			if polygonContains(polygon, point) {
+				return true
+			}
+		}
+	case p.Line != nil:
+		return p.Line.contains(point)
+	}
+	return false
+}
+
+// polygonContains возвращает true, если точка находится внутри внешнего кольца
+// полигона и не попадает ни в одно из внутренних колец (отверстий).
+func polygonContains(polygon geo.Polygon, point geo.Point) bool {
+	if len(polygon) == 0 || !ringContains(polygon[0], point) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, point) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains проверяет попадание точки внутрь кольца методом трассировки
+// луча. Координаты рассматриваются как плоские, что допустимо для мест
+// небольшого размера.
+func ringContains(ring []geo.Point, point geo.Point) (inside bool) {
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) &&
+			point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return
+}
+
+// contains возвращает true, если точка находится внутри коридора маршрута,
+// т.е. внутри одного из прямоугольников, построенных вокруг отрезков так же,
+// как и для индексации. Если ширина коридора не задана, то всегда возвращается
+// false.
+func (l *Line) contains(point geo.Point) bool {
+	if l.Width <= 0 {
+		return false
+	}
+	half := l.Width / 2
+	// переводим координаты в метры в локальной плоской системе с центром в
+	// проверяемой точке
+	scale := earthRadius * math.Pi / 180
+	cos := math.Cos(point[1] * math.Pi / 180)
+	local := func(p geo.Point) (x, y float64) {
+		return (p[0] - point[0]) * cos * scale, (p[1] - point[1]) * scale
+	}
+	for i := 1; i < len(l.Points); i++ {
+		ax, ay := local(l.Points[i-1])
+		bx, by := local(l.Points[i])
+		dx, dy := bx-ax, by-ay
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		// проекции вектора от начала отрезка до точки на отрезок и нормаль к нему
+		along := (-ax*dx - ay*dy) / length
+		across := (-ax*dy + ay*dx) / length
+		if along >= -half && along <= length+half && math.Abs(across) <= half {
+			return true
+		}
+	}
+	return false
+}
+
+// AreaSquareMeters возвращает площадь места в квадратных метрах. Для круга
+// площадь вычисляется как πr², а для полигонов — через сферический избыток
+// на сфере со средним радиусом Земли, за вычетом площади отверстий. Для
+// маршрута с коридором возвращается произведение длины маршрута на ширину
+// коридора, что без учета изломов дает приближенное значение, а для маршрута
+// без коридора — ноль. Если описание места некорректно, то возвращается
+// ошибка. Обращения к хранилищу не выполняются.
+func (p *Place) AreaSquareMeters() (float64, error) {
+	switch {
+	case p.Circle != nil:
+		return math.Pi * p.Circle.Radius * p.Circle.Radius, nil
+	case p.Polygon != nil:
+		return polygonArea(*p.Polygon)
+	case len(p.Polygons) > 0:
+		var total float64
+		for _, polygon := range p.Polygons {
+			area, err := polygonArea(polygon)
+			if err != nil {
+				return 0, err
+			}
+			total += area
+		}
+		return total, nil
+	case p.Line != nil:
+		length, err := p.Line.length()
+		if err != nil {
+			return 0, err
+		}
+		return length * p.Line.Width, nil
+	}
+	return 0, ErrBadPlaceData
+}
+
+// Perimeter возвращает длину границы места в метрах: длину окружности для
+// круга и сумму длин всех колец, включая отверстия, для полигонов. Для
+// маршрута возвращается периметр прямоугольника с длиной маршрута и шириной
+// коридора, а если коридор не задан, — удвоенная длина маршрута. Если
+// описание места некорректно, то возвращается ошибка.
+func (p *Place) Perimeter() (float64, error) {
+	switch {
+	case p.Circle != nil:
+		return 2 * math.Pi * p.Circle.Radius, nil
+	case p.Polygon != nil:
+		return polygonPerimeter(*p.Polygon)
+	case len(p.Polygons) > 0:
+		var total float64
+		for _, polygon := range p.Polygons {
+			perimeter, err := polygonPerimeter(polygon)
+			if err != nil {
+				return 0, err
+			}
+			total += perimeter
+		}
+		return total, nil
+	case p.Line != nil:
+		length, err := p.Line.length()
+		if err != nil {
+			return 0, err
+		}
+		return 2 * (length + p.Line.Width), nil
+	}
+	return 0, ErrBadPlaceData
+}
+
+// polygonArea возвращает площадь полигона в квадратных метрах: площадь
+// внешнего кольца за вычетом площадей внутренних.
+func polygonArea(polygon geo.Polygon) (float64, error) {
+	if err := validatePolygon(polygon); err != nil {
+		return 0, err
+	}
+	area := ringArea(polygon[0])
+	for _, hole := range polygon[1:] {
+		area -= ringArea(hole)
+	}
+	return math.Max(area, 0), nil
+}
+
+// ringArea возвращает площадь, ограниченную замкнутым кольцом, на сфере.
+// Используется выражение сферического избытка через сумму по ребрам кольца
+// (Chamberlain, Duquette, 2007), которое не зависит от направления обхода.
+func ringArea(ring []geo.Point) float64 {
+	var sum float64
+	for i := 1; i < len(ring); i++ {
+		lon1, lat1 := ring[i-1][0]*math.Pi/180, ring[i-1][1]*math.Pi/180
+		lon2, lat2 := ring[i][0]*math.Pi/180, ring[i][1]*math.Pi/180
+		sum += (lon2 - lon1) * (2 + math.Sin(lat1) + math.Sin(lat2))
+	}
+	return math.Abs(sum) * earthRadius * earthRadius / 2
+}
+
+// polygonPerimeter возвращает сумму длин всех колец полигона в метрах.
+func polygonPerimeter(polygon geo.Polygon) (float64, error) {
+	if err := validatePolygon(polygon); err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, ring := range polygon {
+		total += pathLength(ring)
+	}
+	return total, nil
+}
+
+// pathLength возвращает длину ломаной в метрах.
+func pathLength(points []geo.Point) (length float64) {
+	for i := 1; i < len(points); i++ {
+		length += distance(points[i-1], points[i])
+	}
+	return
+}
+
+// length возвращает длину маршрута в метрах или ErrInvalidLine, если описание
+// маршрута некорректно.
+func (l *Line) length() (float64, error) {
+	if _, err := l.geo(); err != nil {
+		return 0, err
+	}
+	return pathLength(l.Points), nil
+}
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCircleGeoSegments(t *testing.T) {
+	defer func(segments int) { CircleSegments = segments }(CircleSegments)
+	CircleSegments = 16
+	circle := &geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 1000}
+	polygon, ok := circleGeo(circle).(bson.M)
+	if !ok {
+		t.Fatalf("unexpected geo type: %T", circleGeo(circle))
+	}
+	rings := polygon["coordinates"].([][]geo.Point)
+	if len(rings) != 1 || len(rings[0]) != CircleSegments+1 {
+		t.Fatalf("unexpected rings: %v", rings)
+	}
+	if !validRing(rings[0]) {
+		t.Error("invalid circle ring")
+	}
+	// все вершины должны лежать на окружности
+	for _, p := range rings[0] {
+		if d := distance(circle.Center, p); math.Abs(d-circle.Radius) > 0.01 {
+			t.Errorf("vertex %v is %v meters from the center", p, d)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2 geo.Point
+		meters float64
+	}{
+		{geo.Point{37.6173, 55.7558}, geo.Point{37.6173, 55.7558}, 0},
+		// Москва — Санкт-Петербург
+		{geo.Point{37.6173, 55.7558}, geo.Point{30.3141, 59.9386}, 634000},
+		// один градус по экватору
+		{geo.Point{0, 0}, geo.Point{1, 0}, 111195},
+	} {
+		if d := distance(test.p1, test.p2); math.Abs(d-test.meters) > 1000 {
+			t.Errorf("distance(%v, %v) = %v, want %v", test.p1, test.p2, d, test.meters)
+		}
+	}
+}
+
+func TestPlaceContains(t *testing.T) {
+	circle := &Place{Circle: &geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}}
+	// вогнутый полигон в форме буквы «П»
+	concave := &Place{Polygon: &geo.Polygon{{
+		{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}, {0, 0},
+	}}}
+	for _, test := range []struct {
+		place *Place
+		point geo.Point
+		in    bool
+	}{
+		{circle, geo.Point{37.6173, 55.7558}, true},
+		{circle, geo.Point{37.6200, 55.7570}, true},
+		{circle, geo.Point{37.6300, 55.7558}, false},
+		{concave, geo.Point{0.5, 2}, true},
+		{concave, geo.Point{2.5, 2}, true},
+		{concave, geo.Point{1.5, 0.5}, true},
+		{concave, geo.Point{1.5, 2}, false},
+		{concave, geo.Point{4, 1}, false},
+		{&Place{}, geo.Point{0, 0}, false},
+	} {
+		if in := test.place.Contains(test.point); in != test.in {
+			t.Errorf("%v in %v: got %v", test.point, test.place, in)
+		}
+	}
+	// круг имеет приоритет перед полигоном
+	place := &Place{Circle: circle.Circle, Polygon: concave.Polygon}
+	if place.Contains(geo.Point{0.5, 2}) {
+		t.Error("polygon is used instead of circle")
+	}
+}
+
+func TestEventDistanceTo(t *testing.T) {
+	moscow, london := geo.Point{37.6173, 55.7558}, geo.Point{-0.1276, 51.5072}
+	for _, test := range []struct {
+		e1, e2 *Event
+		meters float64
+		ok     bool
+	}{
+		{&Event{Location: &moscow}, &Event{Location: &london}, 2500000, true},
+		{&Event{Location: &london}, &Event{Location: &london}, 0, true},
+		{&Event{Location: &moscow}, &Event{}, 0, false},
+		{&Event{}, &Event{Location: &moscow}, 0, false},
+		{&Event{Location: &moscow}, nil, 0, false},
+	} {
+		meters, ok := test.e1.DistanceTo(test.e2)
+		if ok != test.ok || math.Abs(meters-test.meters) > 5000 {
+			t.Errorf("%v -> %v: got %v, %v", test.e1.Location, test.e2, meters, ok)
+		}
+	}
+}
+
+func TestEventAccuracyCircle(t *testing.T) {
+	point := geo.Point{37.6173, 55.7558}
+	circle, ok := (&Event{Location: &point, Accuracy: 25}).AccuracyCircle()
+	if !ok || circle.Center != point || circle.Radius != 25 {
+		t.Errorf("unexpected circle: %v, %v", circle, ok)
+	}
+	for _, event := range []*Event{
+		{Location: &point},
+		{Accuracy: 25},
+	} {
+		if circle, ok := event.AccuracyCircle(); ok {
+			t.Errorf("unexpected circle: %v", circle)
+		}
+	}
+}
+
+func TestPlaceAreaPerimeter(t *testing.T) {
+	square := func(lon, lat, size float64) []geo.Point {
+		return []geo.Point{
+			{lon, lat}, {lon + size, lat}, {lon + size, lat + size},
+			{lon, lat + size}, {lon, lat},
+		}
+	}
+	// площадь сферической трапеции 1°×1° у экватора и длина градуса дуги
+	degree := earthRadius * math.Pi / 180
+	cell := earthRadius * earthRadius * math.Pi / 180 * math.Sin(math.Pi/180)
+	for _, test := range []struct {
+		name      string
+		place     Place
+		area      float64
+		perimeter float64
+	}{
+		{"circle", Place{Circle: &geo.Circle{Radius: 100}}, math.Pi * 1e4, 200 * math.Pi},
+		{"polygon", Place{Polygon: &geo.Polygon{square(0, 0, 1)}}, cell, 4 * degree},
+		{"hole", Place{Polygon: &geo.Polygon{square(0, 0, 2), square(0.5, 0.5, 1)}},
+			4*cell - cell, 8*degree + 4*degree},
+		{"polygons", Place{Polygons: []geo.Polygon{{square(0, 0, 1)}, {square(5, 0, 1)}}},
+			2 * cell, 8 * degree},
+		{"line", Place{Line: &Line{Points: []geo.Point{{0, 0}, {0.01, 0}}, Width: 100}},
+			degree / 100 * 100, 2 * (degree/100 + 100)},
+	} {
+		area, err := test.place.AreaSquareMeters()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		// допускаем погрешность сферического приближения в 1%
+		if math.Abs(area-test.area) > test.area*0.01 {
+			t.Errorf("%s: unexpected area: %.0f, expected %.0f", test.name, area, test.area)
+		}
+		perimeter, err := test.place.Perimeter()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if math.Abs(perimeter-test.perimeter) > test.perimeter*0.01 {
+			t.Errorf("%s: unexpected perimeter: %.0f, expected %.0f",
+				test.name, perimeter, test.perimeter)
+		}
+	}
+	if _, err := new(Place).AreaSquareMeters(); err != ErrBadPlaceData {
+		t.Errorf("unexpected error: %v", err)
+	}
+	open := &Place{Polygon: &geo.Polygon{square(0, 0, 1)[:4]}}
+	if _, err := open.Perimeter(); err != ErrInvalidPolygon {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
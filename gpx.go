@@ -0,0 +1,203 @@
+package model
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+// ErrBadGPX возвращается, если данные не являются корректным документом GPX.
+// Возвращаемая ошибка дополнительно описывает, что именно не так и в какой
+// точке трека.
+var ErrBadGPX = errors.New("bad GPX")
+
+// gpxBatchSize задает количество точек трека, сохраняемых в хранилище за одну
+// пакетную вставку при импорте GPX.
+const gpxBatchSize = 1000
+
+// gpxPoint описывает точку трека GPX (элемент trkpt).
+type gpxPoint struct {
+	Lat        string `xml:"lat,attr"`
+	Lon        string `xml:"lon,attr"`
+	Elevation  string `xml:"ele"`
+	Time       string `xml:"time"`
+	Extensions struct {
+		Nodes []gpxNode `xml:",any"`
+	} `xml:"extensions"`
+}
+
+// gpxNode описывает произвольный элемент расширений GPX.
+type gpxNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []gpxNode `xml:",any"`
+}
+
+// gpxReservedData содержит названия полей события, которые не могут быть
+// заняты дополнительными данными из расширений GPX.
+var gpxReservedData = bsonFields(new(Event))
+
+// event возвращает событие Travel, описывающее точку трека. Высота и значения
+// расширений точки сохраняются в дополнительных данных события.
+func (p *gpxPoint) event() (*Event, error) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(p.Lat), 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad latitude %q", p.Lat)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(p.Lon), 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad longitude %q", p.Lon)
+	}
+	if strings.TrimSpace(p.Time) == "" {
+		return nil, errors.New("missing time")
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(p.Time))
+	if err != nil {
+		return nil, fmt.Errorf("bad time %q", p.Time)
+	}
+	event := &Event{
+		Time:     t.UTC(),
+		Type:     EventTypeTravel,
+		Location: &geo.Point{lon, lat},
+	}
+	data := make(map[string]interface{})
+	if ele := strings.TrimSpace(p.Elevation); ele != "" {
+		value, err := strconv.ParseFloat(ele, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad elevation %q", p.Elevation)
+		}
+		data["elevation"] = value
+	}
+	gpxExtensions(data, p.Extensions.Nodes)
+	if len(data) > 0 {
+		event.Data = data
+	}
+	return event, nil
+}
+
+// gpxExtensions добавляет в data значения конечных элементов расширений GPX,
+// используя в качестве ключа локальное имя элемента без пространства имен.
+// Числовые значения сохраняются как числа, остальные — как строки. Элементы,
+// имена которых совпадают с полями события, пропускаются.
+func gpxExtensions(data map[string]interface{}, nodes []gpxNode) {
+	for _, node := range nodes {
+		if len(node.Nodes) > 0 {
+			gpxExtensions(data, node.Nodes)
+			continue
+		}
+		name, content := node.XMLName.Local, strings.TrimSpace(node.Content)
+		if content == "" || gpxReservedData[name] || strings.ContainsAny(name, ".$") {
+			continue
+		}
+		if value, err := strconv.ParseFloat(content, 64); err == nil {
+			data[name] = value
+		} else {
+			data[name] = content
+		}
+	}
+}
+
+// parseGPX последовательно разбирает точки треков документа GPX и вызывает для
+// каждого полученного события функцию fn. Документ читается потоком и не
+// загружается в память целиком. Разбор прекращается на первой ошибке.
+func parseGPX(r io.Reader, fn func(event *Event) error) error {
+	decoder := xml.NewDecoder(r)
+	root, n := false, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if !root {
+				return fmt.Errorf("%w: empty document", ErrBadGPX)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadGPX, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !root {
+			if start.Name.Local != "gpx" {
+				return fmt.Errorf("%w: unexpected root element <%s>", ErrBadGPX, start.Name.Local)
+			}
+			root = true
+			continue
+		}
+		if start.Name.Local != "trkpt" {
+			continue
+		}
+		n++
+		var point gpxPoint
+		if err := decoder.DecodeElement(&point, &start); err != nil {
+			return fmt.Errorf("%w: track point %d: %v", ErrBadGPX, n, err)
+		}
+		event, err := point.event()
+		if err != nil {
+			return fmt.Errorf("%w: track point %d: %v", ErrBadGPX, n, err)
+		}
+		if err := event.Validate(); err != nil {
+			return fmt.Errorf("track point %d: %w", n, err)
+		}
+		if err := event.prepare(); err != nil {
+			return fmt.Errorf("track point %d: %w", n, err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// ImportGPX сохраняет точки треков из документа GPX в виде событий Travel
+// устройства, например, для загрузки истории перемещений, записанной
+// сторонним трекером. Высота точки сохраняется в дополнительных данных
+// события под именем elevation, а значения расширений GPX — под их локальными
+// именами. Возвращается количество сохраненных событий.
+//
+// Документ читается потоком, а события сохраняются пакетами, поэтому при
+// ошибке в середине документа уже сохраненные события остаются в хранилище и
+// учитываются в возвращаемом количестве. Для некорректного документа
+// возвращается ошибка, соответствующая ErrBadGPX и описывающая проблему, а
+// для точки с недопустимыми координатами или временем — ErrInvalidLocation или
+// ErrEventTimeInFuture.
+func (db *Events) ImportGPX(groupId, deviceId string, r io.Reader) (imported int, err error) {
+	return db.ImportGPXContext(context.Background(), groupId, deviceId, r)
+}
+
+// ImportGPXContext работает как ImportGPX, но позволяет прервать выполнение
+// запросов с помощью контекста.
+func (db *Events) ImportGPXContext(ctx context.Context, groupId, deviceId string, r io.Reader) (imported int, err error) {
+	batch := make([]*Event, 0, gpxBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := db.BulkCreateContext(ctx, groupId, deviceId, true, batch...); err != nil {
+			// события пакета до ошибочного уже сохранены
+			imported += len(bulkInserted(len(batch), true, err))
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err = parseGPX(r, func(event *Event) error {
+		batch = append(batch, event)
+		if len(batch) < gpxBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1"
+	xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1">
+	<wpt lat="10" lon="10"><name>ignored</name></wpt>
+	<trk><name>Morning</name><trkseg>
+		<trkpt lat="55.7512" lon="37.6184">
+			<ele>151.5</ele>
+			<time>2016-08-01T07:00:00Z</time>
+			<extensions><gpxtpx:TrackPointExtension>
+				<gpxtpx:hr>112</gpxtpx:hr>
+				<gpxtpx:course>north</gpxtpx:course>
+				<gpxtpx:time>ignored</gpxtpx:time>
+			</gpxtpx:TrackPointExtension></extensions>
+		</trkpt>
+		<trkpt lat="55.7520" lon="37.6190">
+			<time>2016-08-01T07:00:05.5+03:00</time>
+		</trkpt>
+	</trkseg></trk>
+</gpx>`
+
+func TestParseGPX(t *testing.T) {
+	var events []*Event
+	err := parseGPX(strings.NewReader(testGPX), func(event *Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("unexpected events count: %d", len(events))
+	}
+	first, second := events[0], events[1]
+	if first.Type != EventTypeTravel || first.Location == nil ||
+		first.Location[0] != 37.6184 || first.Location[1] != 55.7512 ||
+		!first.Time.Equal(time.Date(2016, 8, 1, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first event: %v", first)
+	}
+	if first.Data["elevation"] != 151.5 || first.Data["hr"] != 112.0 ||
+		first.Data["course"] != "north" || len(first.Data) != 3 {
+		t.Errorf("unexpected first event data: %v", first.Data)
+	}
+	if second.Data != nil ||
+		!second.Time.Equal(time.Date(2016, 8, 1, 4, 0, 5, 5e8, time.UTC)) {
+		t.Errorf("unexpected second event: %v", second)
+	}
+
+	for name, test := range map[string]struct {
+		data string
+		err  error
+	}{
+		"empty":     {``, ErrBadGPX},
+		"not gpx":   {`<kml></kml>`, ErrBadGPX},
+		"broken":    {`<gpx><trk><trkseg><trkpt lat="1" lon="1">`, ErrBadGPX},
+		"bad lat":   {`<gpx><trk><trkseg><trkpt lat="north" lon="1"><time>2016-08-01T07:00:00Z</time></trkpt></trkseg></trk></gpx>`, ErrBadGPX},
+		"no time":   {`<gpx><trk><trkseg><trkpt lat="1" lon="1"></trkpt></trkseg></trk></gpx>`, ErrBadGPX},
+		"bad time":  {`<gpx><trk><trkseg><trkpt lat="1" lon="1"><time>today</time></trkpt></trkseg></trk></gpx>`, ErrBadGPX},
+		"bad ele":   {`<gpx><trk><trkseg><trkpt lat="1" lon="1"><ele>high</ele><time>2016-08-01T07:00:00Z</time></trkpt></trkseg></trk></gpx>`, ErrBadGPX},
+		"range":     {`<gpx><trk><trkseg><trkpt lat="91" lon="1"><time>2016-08-01T07:00:00Z</time></trkpt></trkseg></trk></gpx>`, ErrInvalidLocation},
+		"in future": {`<gpx><trk><trkseg><trkpt lat="1" lon="1"><time>2999-01-01T00:00:00Z</time></trkpt></trkseg></trk></gpx>`, ErrEventTimeInFuture},
+	} {
+		err := parseGPX(strings.NewReader(test.data), func(*Event) error { return nil })
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	err = parseGPX(strings.NewReader(`<gpx><trk><trkseg>
+		<trkpt lat="1" lon="1"><time>2016-08-01T07:00:00Z</time></trkpt>
+		<trkpt lat="1" lon="x"><time>2016-08-01T07:00:00Z</time></trkpt>
+	</trkseg></trk></gpx>`), func(*Event) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "track point 2") {
+		t.Errorf("error does not describe the point: %v", err)
+	}
+}
+
+func TestEventsImportGPX(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	imported, err := events.ImportGPX("group", "device", strings.NewReader(testGPX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Errorf("unexpected imported count: %d", imported)
+	}
+	list, err := events.List("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected events: %v", list)
+	}
+	for _, event := range list {
+		if event.Type != EventTypeTravel || event.Location == nil {
+			t.Errorf("unexpected event: %v", event)
+		}
+	}
+	imported, err = events.ImportGPX("group", "device", strings.NewReader(`<gpx><trk><trkseg>
+		<trkpt lat="1" lon="1"><time>2016-08-01T07:00:00Z</time></trkpt>
+		<trkpt lat="1" lon="1"><time>`))
+	if !errors.Is(err, ErrBadGPX) || imported != 0 {
+		t.Errorf("unexpected result: %d, %v", imported, err)
+	}
+
+	// события пакета до ошибки вставки учитываются в количестве сохраненных
+	err = db.session.DB(db.name).C(CollectionEvents).EnsureIndex(mgo.Index{
+		Key:    []string{"time"},
+		Unique: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err = events.ImportGPX("group", "device", strings.NewReader(`<gpx><trk><trkseg>
+		<trkpt lat="1" lon="1"><time>2016-08-02T07:00:00Z</time></trkpt>
+		<trkpt lat="1" lon="1"><time>2016-08-01T07:00:00Z</time></trkpt>
+		<trkpt lat="1" lon="1"><time>2016-08-03T07:00:00Z</time></trkpt>
+	</trkseg></trk></gpx>`))
+	if err == nil || imported != 1 {
+		t.Errorf("unexpected result: %d, %v", imported, err)
+	}
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EventIter позволяет последовательно перебрать события, не загружая их все
+// сразу в память.
+//
+// Итератор удерживает отдельную сессию соединения с MongoDB до тех пор, пока не
+// будет вызван Close, поэтому по окончании работы с ним Close нужно вызывать
+// обязательно, даже если перебраны все события или произошла ошибка. В
+// противном случае соединения с сервером не будут освобождаться.
+type EventIter struct {
+	ctx     context.Context
+	session *mgo.Session
+	iter    *mgo.Iter
+	err     error
+	// для итераторов, ожидающих новые события (Events.Tail), — функция
+	// повторного запроса событий вместе с последним прочитанным событием last
+	retail func(last bson.ObjectId) *mgo.Iter
+	last   bson.ObjectId
+	// события пропускаются, пока не будет прочитано событие last
+	resume bool
+}
+
+// Next читает следующее событие и возвращает true, если оно было прочитано.
+// Если события закончились, произошла ошибка или контекст итератора был
+// отменен, то возвращается false. Узнать, что именно случилось, можно с
+// помощью Err или Close.
+func (i *EventIter) Next(event *Event) bool {
+	for {
+		if i.err != nil {
+			return false
+		}
+		if err := i.ctx.Err(); err != nil {
+			i.err = err
+			return false
+		}
+		if i.iter.Next(event) {
+			if i.resume {
+				// события до последнего прочитанного уже были возвращены
+				i.resume = event.ID != i.last
+				continue
+			}
+			i.last = event.ID
+			return true
+		}
+		if i.retail == nil || i.iter.Err() != nil {
+			return false
+		}
+		if i.resume {
+			// последнее прочитанное событие уже вытеснено из ограниченной
+			// коллекции вместе со всеми более ранними, поэтому все оставшиеся
+			// в ней события добавлены после него: читаем их с начала
+			i.iter.Close()
+			i.iter, i.resume = i.retail(""), false
+			continue
+		}
+		if !i.iter.Timeout() {
+			// сервер закрыл курсор, например, потому что коллекция была
+			// пуста: немного ждем и запрашиваем события заново
+			i.iter.Close()
+			select {
+			case <-time.After(tailTimeout):
+			case <-i.ctx.Done():
+			}
+			i.iter, i.resume = i.retail(i.last), i.last.Valid()
+		}
+	}
+}
+
+// Err возвращает ошибку, если она случилась при переборе событий.
+func (i *EventIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Err()
+}
+
+// Close завершает перебор событий, освобождает сессию соединения и
+// возвращает ошибку, если она случилась при переборе.
+func (i *EventIter) Close() error {
+	err := i.iter.Close()
+	i.session.Close()
+	if i.err != nil {
+		return i.err
+	}
+	return err
+}
+
+// newEventIter возвращает итератор по событиям, удовлетворяющим запросу,
+// отсортированным по времени. В событиях возвращаются только поля, заданные
+// selector.
+func (db *Events) newEventIter(ctx context.Context, query, selector bson.M) (*EventIter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := db.session.Copy()
+	iter := (*DB)(db).c(session.DB(db.name), CollectionEvents).Find(query).
+		Select(selector).Sort("time").Iter()
+	return &EventIter{ctx: ctx, session: session, iter: iter}, nil
+}
+
+// Iter возвращает итератор по всем событиям устройства, отсортированным по
+// времени. Это позволяет обработать или выгрузить очень большое количество
+// событий, не загружая их все в память. По окончании работы с итератором
+// обязательно должен быть вызван его метод Close.
+func (db *Events) Iter(groupID, deviceId string) (*EventIter, error) {
+	return db.IterContext(context.Background(), groupID, deviceId)
+}
+
+// IterContext работает как Iter, но перебор событий прекращается при отмене
+// контекста.
+func (db *Events) IterContext(ctx context.Context, groupID, deviceId string) (*EventIter, error) {
+	return db.newEventIter(ctx,
+		notDeleted(bson.M{"groupId": groupID, "deviceId": deviceId}),
+		bson.M{"groupId": 0, "deviceId": 0})
+}
@@ -0,0 +1,31 @@
+package model
+
+import "testing"
+
+func TestEventsIter(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	for i := 0; i < 10; i++ {
+		if err := events.Create("group", "device", new(Event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err := events.Iter("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		event Event
+		count int
+	)
+	for iter.Next(&event) {
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Errorf("unexpected count: %d", count)
+	}
+}
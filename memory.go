@@ -0,0 +1,785 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/uid"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Memory хранит все данные в памяти процесса и предоставляет к ним доступ
+// через те же интерфейсы, что и DB. Оно предназначено для тестирования
+// сервисов, использующих этот пакет, без запуска MongoDB, и поддерживает
+// только методы, описанные в UserStore, DeviceStore, EventStore и PlaceStore.
+// Поиск мест, содержащих точку, выполняется по описанию места, а не по
+// сохраненному для индексации многоугольнику, поэтому на границах мест
+// результат может незначительно отличаться от MongoDB.
+//
+// Memory можно безопасно использовать одновременно из нескольких потоков.
+type Memory struct {
+	mu      sync.Mutex
+	users   map[string]User
+	devices map[string]Device
+	places  map[string]Place
+	events  []Event // в порядке добавления, как и в MongoDB
+}
+
+// NewMemory возвращает новое пустое хранилище данных в памяти.
+func NewMemory() *Memory {
+	return &Memory{
+		users:   make(map[string]User),
+		devices: make(map[string]Device),
+		places:  make(map[string]Place),
+	}
+}
+
+// Users возвращает описание для работы с данными о пользователях.
+func (m *Memory) Users() UserStore {
+	return (*memoryUsers)(m)
+}
+
+// Devices возвращает описание для работы с данными об устройствах.
+func (m *Memory) Devices() DeviceStore {
+	return (*memoryDevices)(m)
+}
+
+// Events возвращает описание для работы с данными о событиях.
+func (m *Memory) Events() EventStore {
+	return (*memoryEvents)(m)
+}
+
+// Places возвращает описание для работы с данными о местах.
+func (m *Memory) Places() PlaceStore {
+	return (*memoryPlaces)(m)
+}
+
+// memoryUsers реализует UserStore для хранилища в памяти.
+type memoryUsers Memory
+
+func (m *memoryUsers) Login(login string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[login]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (m *memoryUsers) Authenticate(login, password string) (*User, error) {
+	user, err := m.Login(login)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Password.Compare(password) {
+		return nil, ErrWrongPassword
+	}
+	user.Password = nil
+	return user, nil
+}
+
+func (m *memoryUsers) Get(groupId, login string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[login]
+	if !ok || user.GroupID != groupId {
+		return nil, notFound(ErrNotFound, CollectionUsers, groupId, login)
+	}
+	user.Password, user.GroupID = nil, ""
+	return &user, nil
+}
+
+func (m *memoryUsers) List(groupId string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]User, 0)
+	for _, user := range m.users {
+		if user.GroupID == groupId {
+			user.Password, user.GroupID = nil, ""
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+	return users, nil
+}
+
+func (m *memoryUsers) Count(groupId string) (int, error) {
+	list, err := m.List(groupId)
+	return len(list), err
+}
+
+func (m *memoryUsers) Create(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := user.prepareRole(); err != nil {
+		return err
+	}
+	if user.Login == "" {
+		user.Login = uid.New()
+	}
+	if _, ok := m.users[user.Login]; ok {
+		return ErrDuplicate
+	}
+	now := time.Now().UTC()
+	user.CreatedAt, user.UpdatedAt = now, now
+	m.users[user.Login] = *user
+	return nil
+}
+
+func (m *memoryUsers) Update(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := user.prepareRole(); err != nil {
+		return err
+	}
+	stored, ok := m.users[user.Login]
+	if !ok {
+		return ErrNotFound
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = stored.CreatedAt
+	}
+	user.UpdatedAt = time.Now().UTC()
+	m.users[user.Login] = user
+	return nil
+}
+
+// modify вызывает функцию для изменения описания пользователя и сохраняет
+// результат, если функция не вернула ошибку.
+func (m *memoryUsers) modify(login string, change func(user *User) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[login]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := change(&user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now().UTC()
+	m.users[login] = user
+	return nil
+}
+
+func (m *memoryUsers) SetName(login, name string) error {
+	return m.modify(login, func(user *User) error {
+		user.Name = name
+		return nil
+	})
+}
+
+func (m *memoryUsers) ChangePassword(login, oldPassword, newPassword string) error {
+	passwd, err := NewPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return m.modify(login, func(user *User) error {
+		if !user.Password.Compare(oldPassword) {
+			return ErrWrongPassword
+		}
+		user.Password = passwd
+		return nil
+	})
+}
+
+func (m *memoryUsers) ChangeGroup(login, newGroupId string) error {
+	if newGroupId == "" {
+		return ErrBadGroupId
+	}
+	return m.modify(login, func(user *User) error {
+		user.GroupID = newGroupId
+		return nil
+	})
+}
+
+func (m *memoryUsers) Delete(login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[login]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, login)
+	return nil
+}
+
+// memoryDevices реализует DeviceStore для хранилища в памяти.
+type memoryDevices Memory
+
+func (m *memoryDevices) Login(id string) (*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &device, nil
+}
+
+func (m *memoryDevices) Authenticate(id, password string) (*Device, error) {
+	device, err := m.Login(id)
+	if err != nil {
+		return nil, err
+	}
+	if !device.Password.Compare(password) {
+		return nil, ErrWrongPassword
+	}
+	device.Password = nil
+	return device, nil
+}
+
+func (m *memoryDevices) Get(groupId, id string) (*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[id]
+	if !ok || device.GroupID != groupId {
+		return nil, notFound(ErrNotFound, CollectionDevices, groupId, id)
+	}
+	device.Password, device.GroupID = nil, ""
+	return &device, nil
+}
+
+// find возвращает отсортированный по идентификатору список устройств группы,
+// удовлетворяющих условию.
+func (m *memoryDevices) find(groupId string, match func(device *Device) bool) []*Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make([]*Device, 0)
+	for _, device := range m.devices {
+		if device.GroupID == groupId && match(&device) {
+			device := device
+			device.Password, device.GroupID = nil, ""
+			devices = append(devices, &device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+func (m *memoryDevices) List(groupId string) ([]*Device, error) {
+	return m.find(groupId, func(*Device) bool { return true }), nil
+}
+
+func (m *memoryDevices) Search(groupId, query string) ([]*Device, error) {
+	query = strings.ToLower(query)
+	return m.find(groupId, func(device *Device) bool {
+		return strings.Contains(strings.ToLower(device.Name), query)
+	}), nil
+}
+
+func (m *memoryDevices) Count(groupId string) (int, error) {
+	list, err := m.List(groupId)
+	return len(list), err
+}
+
+func (m *memoryDevices) LastSeen(groupId, id string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var lastSeen time.Time
+	found := false
+	for _, event := range m.events {
+		if event.GroupID == groupId && event.DeviceID == id && event.DeletedAt == nil &&
+			(!found || event.Time.After(lastSeen)) {
+			lastSeen, found = event.Time, true
+		}
+	}
+	if !found {
+		return lastSeen, ErrNotFound
+	}
+	return lastSeen, nil
+}
+
+func (m *memoryDevices) Create(groupId string, device *Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if device.ID == "" {
+		device.ID = uid.New()
+	}
+	if _, ok := m.devices[device.ID]; ok {
+		return ErrDuplicate
+	}
+	device.GroupID = groupId
+	now := time.Now().UTC()
+	device.CreatedAt, device.UpdatedAt = now, now
+	m.devices[device.ID] = *device
+	return nil
+}
+
+// apply изменяет сохраненное описание устройства так же, как это делает
+// Device.update: имя и тип заменяются, а пароль — только если задан.
+func (d *Device) apply(stored *Device, now time.Time) {
+	stored.Name, stored.Type = d.Name, d.Type
+	if len(d.Password) > 0 {
+		stored.Password = d.Password
+	}
+	stored.Version++
+	stored.UpdatedAt = now
+}
+
+func (m *memoryDevices) Update(groupId string, device *Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.devices[device.ID]
+	if !ok || stored.GroupID != groupId {
+		return ErrNotFound
+	}
+	if stored.Version != device.Version {
+		return ErrVersionConflict
+	}
+	now := time.Now().UTC()
+	device.apply(&stored, now)
+	m.devices[device.ID] = stored
+	device.GroupID = groupId
+	device.Version++
+	device.UpdatedAt = now
+	return nil
+}
+
+func (m *memoryDevices) Upsert(groupId string, device *Device) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if device.ID == "" {
+		device.ID = uid.New()
+	}
+	now := time.Now().UTC()
+	stored, ok := m.devices[device.ID]
+	if ok && stored.GroupID != groupId {
+		return false, ErrDuplicate
+	}
+	if !ok {
+		stored = Device{ID: device.ID, GroupID: groupId, CreatedAt: now}
+		device.CreatedAt = now
+	}
+	device.apply(&stored, now)
+	m.devices[device.ID] = stored
+	device.GroupID = groupId
+	device.UpdatedAt = now
+	return !ok, nil
+}
+
+// modify вызывает функцию для изменения описания устройства группы и
+// сохраняет результат, увеличивая версию описания.
+func (m *memoryDevices) modify(groupId, id string, change func(device *Device)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[id]
+	if !ok || device.GroupID != groupId {
+		return ErrNotFound
+	}
+	change(&device)
+	device.Version++
+	device.UpdatedAt = time.Now().UTC()
+	m.devices[id] = device
+	return nil
+}
+
+func (m *memoryDevices) Rename(groupId, id, name string) error {
+	return m.modify(groupId, id, func(device *Device) { device.Name = name })
+}
+
+func (m *memoryDevices) SetPassword(groupId, id, password string) error {
+	passwd, err := NewPassword(password)
+	if err != nil {
+		return err
+	}
+	return m.modify(groupId, id, func(device *Device) { device.Password = passwd })
+}
+
+func (m *memoryDevices) ChangeGroup(oldGroupId, id, newGroupId string) error {
+	return m.modify(oldGroupId, id, func(device *Device) { device.GroupID = newGroupId })
+}
+
+func (m *memoryDevices) Delete(groupId, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[id]
+	if !ok || device.GroupID != groupId {
+		return ErrNotFound
+	}
+	delete(m.devices, id)
+	return nil
+}
+
+func (m *memoryDevices) DeleteWithEvents(groupId, id string) error {
+	if err := m.Delete(groupId, id); err != nil {
+		return err
+	}
+	_, err := (*memoryEvents)(m).DeletePurgeForDevice(groupId, id)
+	return err
+}
+
+// memoryEvents реализует EventStore для хранилища в памяти.
+type memoryEvents Memory
+
+// find возвращает список не удаленных событий устройства, удовлетворяющих
+// условию. Идентификаторы группы и устройства в событиях не заполняются.
+func (m *memoryEvents) find(groupId, deviceId string, match func(event *Event) bool) []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := make([]*Event, 0)
+	for _, event := range m.events {
+		if event.GroupID == groupId && event.DeviceID == deviceId && match(&event) {
+			event := event
+			event.GroupID, event.DeviceID = "", ""
+			events = append(events, &event)
+		}
+	}
+	return events
+}
+
+// sortByTime сортирует список событий по времени.
+func sortByTime(events []*Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+}
+
+func (m *memoryEvents) Get(groupId, deviceId, id string) (*Event, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrBadObjectId
+	}
+	objID := bson.ObjectIdHex(id)
+	events := m.find(groupId, deviceId, func(event *Event) bool {
+		return event.ID == objID && event.DeletedAt == nil
+	})
+	if len(events) == 0 {
+		return nil, notFound(ErrNotFound, CollectionEvents, groupId, id)
+	}
+	return events[0], nil
+}
+
+func (m *memoryEvents) List(groupId, deviceId string) ([]*Event, error) {
+	return m.find(groupId, deviceId, func(event *Event) bool {
+		return event.DeletedAt == nil
+	}), nil
+}
+
+func (m *memoryEvents) ListByType(groupId, deviceId string, types ...string) ([]*Event, error) {
+	for _, eventType := range types {
+		if !validEventType(eventType) {
+			return nil, ErrUnknownEventType
+		}
+	}
+	events := m.find(groupId, deviceId, func(event *Event) bool {
+		if event.DeletedAt != nil {
+			return false
+		}
+		if len(types) == 0 {
+			return true
+		}
+		for _, eventType := range types {
+			if event.Type == eventType {
+				return true
+			}
+		}
+		return false
+	})
+	sortByTime(events)
+	return events, nil
+}
+
+func (m *memoryEvents) Count(groupId, deviceId string) (int, error) {
+	return m.CountByTime(groupId, deviceId, time.Time{}, time.Time{})
+}
+
+func (m *memoryEvents) CountByTime(groupId, deviceId string, from, to time.Time) (int, error) {
+	events := m.find(groupId, deviceId, func(event *Event) bool {
+		return event.DeletedAt == nil &&
+			(from.IsZero() || !event.Time.Before(from)) &&
+			(to.IsZero() || event.Time.Before(to))
+	})
+	return len(events), nil
+}
+
+func (m *memoryEvents) LatestPerDevice(groupId string) (map[string]*Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latest := make(map[string]*Event)
+	for _, event := range m.events {
+		if event.GroupID != groupId || event.DeletedAt != nil {
+			continue
+		}
+		if last, ok := latest[event.DeviceID]; !ok || event.Time.After(last.Time) {
+			event := event
+			latest[event.DeviceID] = &event
+		}
+	}
+	return latest, nil
+}
+
+func (m *memoryEvents) Devices(groupId string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool)
+	deviceIds := make([]string, 0)
+	for _, event := range m.events {
+		if event.GroupID == groupId && event.DeletedAt == nil && !seen[event.DeviceID] {
+			seen[event.DeviceID] = true
+			deviceIds = append(deviceIds, event.DeviceID)
+		}
+	}
+	sort.Strings(deviceIds)
+	return deviceIds, nil
+}
+
+func (m *memoryEvents) Create(groupId, deviceId string, events ...*Event) error {
+	if _, err := prepareEvents(groupId, deviceId, events); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, event := range events {
+		for _, stored := range m.events {
+			if stored.ID == event.ID {
+				return ErrDuplicate
+			}
+		}
+	}
+	for _, event := range events {
+		m.events = append(m.events, *event)
+	}
+	return nil
+}
+
+// index возвращает индекс события в списке или -1, если оно не найдено.
+func (m *memoryEvents) index(id bson.ObjectId) int {
+	for i := range m.events {
+		if m.events[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryEvents) Update(groupId, deviceId string, event *Event) error {
+	if err := event.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(event.ID)
+	if i < 0 || m.events[i].GroupID != groupId || m.events[i].DeviceID != deviceId ||
+		m.events[i].DeletedAt != nil {
+		return ErrNotFound
+	}
+	event.GroupID, event.DeviceID = groupId, deviceId
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = m.events[i].CreatedAt
+	}
+	event.UpdatedAt = time.Now().UTC()
+	m.events[i] = *event
+	m.events[i].DeletedAt = nil
+	return nil
+}
+
+// stored возвращает индекс события устройства или ошибку, если оно не найдено.
+func (m *memoryEvents) stored(groupId, deviceId, id string) (int, error) {
+	if !bson.IsObjectIdHex(id) {
+		return -1, ErrBadObjectId
+	}
+	i := m.index(bson.ObjectIdHex(id))
+	if i < 0 || m.events[i].GroupID != groupId || m.events[i].DeviceID != deviceId {
+		return -1, ErrNotFound
+	}
+	return i, nil
+}
+
+func (m *memoryEvents) SoftDelete(groupId, deviceId, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, err := m.stored(groupId, deviceId, id)
+	if err != nil {
+		return err
+	}
+	if m.events[i].DeletedAt != nil {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	m.events[i].DeletedAt, m.events[i].UpdatedAt = &now, now
+	return nil
+}
+
+func (m *memoryEvents) ListDeleted(groupId, deviceId string) ([]*Event, error) {
+	return m.find(groupId, deviceId, func(event *Event) bool {
+		return event.DeletedAt != nil
+	}), nil
+}
+
+func (m *memoryEvents) Delete(groupId, deviceId, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, err := m.stored(groupId, deviceId, id)
+	if err != nil {
+		return err
+	}
+	m.events = append(m.events[:i], m.events[i+1:]...)
+	return nil
+}
+
+func (m *memoryEvents) DeletePurgeForDevice(groupId, deviceId string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := m.events[:0]
+	for _, event := range m.events {
+		if event.GroupID != groupId || event.DeviceID != deviceId {
+			events = append(events, event)
+		}
+	}
+	removed := len(m.events) - len(events)
+	m.events = events
+	return removed, nil
+}
+
+// memoryPlaces реализует PlaceStore для хранилища в памяти.
+type memoryPlaces Memory
+
+func (m *memoryPlaces) Get(groupId, id string) (*Place, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	place, ok := m.places[id]
+	if !ok || place.GroupID != groupId {
+		return nil, notFound(ErrNotFound, CollectionPlaces, groupId, id)
+	}
+	place.GroupID, place.Geo = "", nil
+	return &place, nil
+}
+
+// find возвращает отсортированный по идентификатору список мест группы,
+// удовлетворяющих условию.
+func (m *memoryPlaces) find(groupId string, match func(place *Place) bool) []*Place {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	places := make([]*Place, 0)
+	for _, place := range m.places {
+		if place.GroupID == groupId && match(&place) {
+			place := place
+			place.GroupID, place.Geo = "", nil
+			places = append(places, &place)
+		}
+	}
+	sort.Slice(places, func(i, j int) bool { return places[i].ID < places[j].ID })
+	return places
+}
+
+func (m *memoryPlaces) List(groupId string) ([]*Place, error) {
+	return m.find(groupId, func(*Place) bool { return true }), nil
+}
+
+func (m *memoryPlaces) Search(groupId, query string) ([]*Place, error) {
+	query = strings.ToLower(query)
+	return m.find(groupId, func(place *Place) bool {
+		return strings.Contains(strings.ToLower(place.Name), query)
+	}), nil
+}
+
+func (m *memoryPlaces) Count(groupId string) (int, error) {
+	list, err := m.List(groupId)
+	return len(list), err
+}
+
+func (m *memoryPlaces) Containing(groupId string, p geo.Point) ([]*Place, error) {
+	return m.find(groupId, func(place *Place) bool { return place.Contains(p) }), nil
+}
+
+func (m *memoryPlaces) ContainingAny(groupId string, points []geo.Point) (map[int][]*Place, error) {
+	places := make(map[int][]*Place, len(points))
+	for i, p := range points {
+		places[i], _ = m.Containing(groupId, p)
+	}
+	return places, nil
+}
+
+func (m *memoryPlaces) Create(groupId string, place *Place) error {
+	if err := place.prepare(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if place.ID == "" {
+		place.ID = uid.New()
+	}
+	if _, ok := m.places[place.ID]; ok {
+		return ErrDuplicate
+	}
+	place.GroupID = groupId
+	now := time.Now().UTC()
+	place.CreatedAt, place.UpdatedAt = now, now
+	m.places[place.ID] = *place
+	return nil
+}
+
+func (m *memoryPlaces) Update(groupId string, place *Place) error {
+	if err := place.prepare(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.places[place.ID]
+	if !ok || stored.GroupID != groupId {
+		return ErrNotFound
+	}
+	if stored.Version != place.Version {
+		return ErrVersionConflict
+	}
+	place.GroupID = groupId
+	place.Version++
+	if place.CreatedAt.IsZero() {
+		place.CreatedAt = stored.CreatedAt
+	}
+	place.UpdatedAt = time.Now().UTC()
+	m.places[place.ID] = *place
+	return nil
+}
+
+func (m *memoryPlaces) Rename(groupId, id, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	place, ok := m.places[id]
+	if !ok || place.GroupID != groupId {
+		return ErrNotFound
+	}
+	place.Name = name
+	place.Version++
+	place.UpdatedAt = time.Now().UTC()
+	m.places[id] = place
+	return nil
+}
+
+func (m *memoryPlaces) Upsert(groupId string, place *Place) (bool, error) {
+	if err := place.prepare(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if place.ID == "" {
+		place.ID = uid.New()
+	}
+	stored, ok := m.places[place.ID]
+	if ok && stored.GroupID != groupId {
+		return false, ErrDuplicate
+	}
+	place.GroupID = groupId
+	place.Version = stored.Version + 1
+	place.UpdatedAt = time.Now().UTC()
+	if ok {
+		place.CreatedAt = stored.CreatedAt
+	} else {
+		place.CreatedAt = place.UpdatedAt
+	}
+	m.places[place.ID] = *place
+	return !ok, nil
+}
+
+func (m *memoryPlaces) Delete(groupId, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	place, ok := m.places[id]
+	if !ok || place.GroupID != groupId {
+		return ErrNotFound
+	}
+	delete(m.places, id)
+	return nil
+}
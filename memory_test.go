@@ -0,0 +1,219 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	users := NewMemory().Users()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(&User{Login: "login", GroupID: "group", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(&User{Login: "login"}); err != ErrDuplicate {
+		t.Errorf("unexpected duplicate login error: %v", err)
+	}
+	if _, err := users.Authenticate("login", "wrong"); err != ErrWrongPassword {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.ChangePassword("login", "password", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Authenticate("login", "new"); err != nil {
+		t.Error(err)
+	}
+	if err := users.SetName("login", "Name"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.Get("group", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Name" || len(user.Password) != 0 {
+		t.Errorf("unexpected user: %#v", user)
+	}
+	_, err = users.Get("other", "login")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Collection != CollectionUsers ||
+		notFound.ID != "login" || notFound.GroupID != "other" {
+		t.Errorf("unexpected not found error: %#v", err)
+	}
+	if err := users.Delete("login"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := users.Count("group"); err != nil || n != 0 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+}
+
+func TestMemoryDevices(t *testing.T) {
+	memory := NewMemory()
+	devices, events := memory.Devices(), memory.Events()
+	if err := devices.Create("group", &Device{ID: "device", Name: "Tracker"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := *first
+	if err := devices.Update("group", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Update("group", &second); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	list, err := devices.Search("group", "TRACK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("unexpected search result: %v", list)
+	}
+	stale, err := devices.Get("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Rename("group", "device", "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Update("group", stale); err != ErrVersionConflict {
+		t.Errorf("unexpected error after rename: %v", err)
+	}
+	if stale, err = devices.Get("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.SetPassword("group", "device", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Update("group", stale); err != ErrVersionConflict {
+		t.Errorf("unexpected error after password change: %v", err)
+	}
+	now := time.Now().UTC()
+	if err := events.Create("group", "device", &Event{Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen, err := devices.LastSeen("group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastSeen.Equal(now) {
+		t.Errorf("unexpected last seen: %v", lastSeen)
+	}
+	if err := devices.DeleteWithEvents("group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := events.Count("group", "device"); err != nil || n != 0 {
+		t.Errorf("unexpected events count: %d, %v", n, err)
+	}
+}
+
+func TestMemoryEvents(t *testing.T) {
+	events := NewMemory().Events()
+	now := time.Now().UTC()
+	for i, eventType := range []string{EventTypeArrive, EventTypeLeave, EventTypeArrive} {
+		event := &Event{Type: eventType, Time: now.Add(time.Duration(-i) * time.Minute)}
+		if err := events.Create("group", "device", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := events.ListByType("group", "device", EventTypeArrive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Time.Before(list[1].Time) {
+		t.Errorf("unexpected events: %v", list)
+	}
+	if _, err := events.Get("group", "device", "bad"); err != ErrBadObjectId {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.SoftDelete("group", "device", list[0].ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Update("group", "device", &Event{ID: list[0].ID}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := events.Update("other", "device", &Event{ID: list[1].ID}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	update := *list[1]
+	update.Comment = "updated"
+	if err := events.Update("group", "device", &update); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Get("group", "device", list[0].ID.Hex()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n, err := events.CountByTime("group", "device", now.Add(-90*time.Second), time.Time{}); err != nil || n != 2 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+	if deleted, err := events.ListDeleted("group", "device"); err != nil || len(deleted) != 1 {
+		t.Errorf("unexpected deleted events: %v, %v", deleted, err)
+	}
+	removed, err := events.DeletePurgeForDevice("group", "device")
+	if err != nil || removed != 3 {
+		t.Errorf("unexpected removed count: %d, %v", removed, err)
+	}
+}
+
+func TestMemoryPlaces(t *testing.T) {
+	places := NewMemory().Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	if err := places.Create("group", &Place{ID: "circle", Circle: &circle}); err != nil {
+		t.Fatal(err)
+	}
+	polygon := geo.Polygon{{{37.60, 55.75}, {37.61, 55.75}, {37.61, 55.76}, {37.60, 55.76}, {37.60, 55.75}}}
+	if err := places.Create("group", &Place{ID: "polygon", Polygon: &polygon}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := places.ContainingAny("group", []geo.Point{
+		{37.6173, 55.7558}, {37.605, 55.755}, {30.3141, 59.9386},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"circle", "polygon", ""} {
+		if id == "" {
+			if len(found[i]) != 0 {
+				t.Errorf("point %d: unexpected places: %v", i, found[i])
+			}
+		} else if len(found[i]) != 1 || found[i][0].ID != id {
+			t.Errorf("point %d: unexpected places: %v", i, found[i])
+		}
+	}
+	if err := places.Update("other", &Place{ID: "circle", Circle: &circle}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	stale, err := places.Get("group", "circle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created, err := places.Upsert("group", &Place{ID: "circle", Circle: &circle}); err != nil || created {
+		t.Errorf("unexpected upsert result: %v, %v", created, err)
+	}
+	if err := places.Update("group", stale); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := places.Rename("group", "polygon", "Office"); err != nil {
+		t.Fatal(err)
+	}
+	if err := places.Rename("other", "polygon", "Office"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if place, err := places.Get("group", "polygon"); err != nil || place.Name != "Office" {
+		t.Errorf("unexpected renamed place: %v, %v", place, err)
+	}
+	if list, err := places.Search("group", "OFF"); err != nil || len(list) != 1 || list[0].ID != "polygon" {
+		t.Errorf("unexpected search result: %v, %v", list, err)
+	}
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// legacyFields содержит прежние названия полей, под которыми идентификаторы
+// группы и устройства сохранялись до перехода на groupId и deviceId, для
+// каждой коллекции.
+var legacyFields = []struct {
+	collection string
+	rename     bson.M
+}{
+	{CollectionUsers, bson.M{"group": "groupId"}},
+	{CollectionDevices, bson.M{"group": "groupId"}},
+	{CollectionPlaces, bson.M{"group": "groupId"}},
+	{CollectionEvents, bson.M{"group": "groupId", "device": "deviceId"}},
+}
+
+// MigrateFieldNames переводит документы, сохраненные прежними версиями
+// библиотеки, на новые названия полей: идентификатор группы пользователей,
+// устройств, мест и событий раньше сохранялся в поле group, а идентификатор
+// устройства события — в поле device. Теперь они сохраняются в полях groupId и
+// deviceId, и документы со старыми названиями полей не находятся ни одним
+// запросом, поэтому после обновления библиотеки метод нужно вызвать один раз
+// до начала работы с данными. Возвращается количество измененных документов
+// с названием коллекции в качестве ключа.
+//
+// Метод можно безопасно вызывать повторно: документы с новыми названиями полей
+// не изменяются. Коллекция CollectionEventsTail не обрабатывается: ее
+// содержимое быстро заменяется новыми событиями. Ошибка обработки одной
+// коллекции не прерывает обработку остальных: в этом случае возвращается
+// CollectionErrors, как в DeleteGroup.
+func (db *DB) MigrateFieldNames() (migrated map[string]int, err error) {
+	return db.MigrateFieldNamesContext(context.Background())
+}
+
+// MigrateFieldNamesContext работает как MigrateFieldNames, но позволяет
+// прервать выполнение запроса с помощью контекста.
+func (db *DB) MigrateFieldNamesContext(ctx context.Context) (migrated map[string]int, err error) {
+	result := make(map[string]int, len(legacyFields))
+	errs := make(CollectionErrors)
+	err = db.execDB(ctx, func(mdb *mgo.Database) error {
+		for _, legacy := range legacyFields {
+			exists := make([]bson.M, 0, len(legacy.rename))
+			for name := range legacy.rename {
+				exists = append(exists, bson.M{name: bson.M{"$exists": true}})
+			}
+			info, err := db.c(mdb, legacy.collection).UpdateAll(
+				bson.M{"$or": exists}, bson.M{"$rename": legacy.rename})
+			if err != nil {
+				errs[legacy.collection] = err
+				continue
+			}
+			result[legacy.collection] = info.Updated
+			db.auditCount(ctx, AuditUpdate, legacy.collection, "", info.Updated)
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
+	// при отмене контекста результат может быть еще не заполнен
+	if _, partial := err.(CollectionErrors); err == nil || partial {
+		migrated = result
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMigrateFieldNames(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	mdb := db.session.DB(db.name)
+	eventID := bson.NewObjectId()
+	for _, doc := range []struct {
+		collection string
+		doc        bson.M
+	}{
+		{CollectionUsers, bson.M{"_id": "login", "group": "group"}},
+		{CollectionDevices, bson.M{"_id": "device", "group": "group"}},
+		{CollectionPlaces, bson.M{"_id": "place", "group": "group"}},
+		{CollectionEvents, bson.M{"_id": eventID, "group": "group", "device": "device", "time": time.Now()}},
+		// документы с новыми названиями полей не изменяются
+		{CollectionEvents, bson.M{"_id": bson.NewObjectId(), "groupId": "group", "deviceId": "device", "time": time.Now()}},
+	} {
+		if err := mdb.C(doc.collection).Insert(doc.doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrated, err := db.MigrateFieldNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, collection := range []string{CollectionUsers, CollectionDevices, CollectionPlaces, CollectionEvents} {
+		if migrated[collection] != 1 {
+			t.Errorf("%s: unexpected migrated count: %v", collection, migrated)
+		}
+	}
+	if _, err := db.Users().Get("group", "login"); err != nil {
+		t.Errorf("user: %v", err)
+	}
+	if _, err := db.Devices().Get("group", "device"); err != nil {
+		t.Errorf("device: %v", err)
+	}
+	if _, err := db.Places().Get("group", "place"); err != nil {
+		t.Errorf("place: %v", err)
+	}
+	if _, err := db.Events().Get("group", "device", eventID.Hex()); err != nil {
+		t.Errorf("event: %v", err)
+	}
+	if migrated, err = db.MigrateFieldNames(); err != nil {
+		t.Fatal(err)
+	}
+	for collection, n := range migrated {
+		if n != 0 {
+			t.Errorf("%s: migrated again: %d", collection, n)
+		}
+	}
+}
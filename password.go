@@ -1,18 +1,127 @@
 package model
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"unicode/utf8"
+
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/bcrypt"
+)
 
 // Password описывает тип для пароля, хранящегося в виде хеш с использованием
 // алгоритма bcrypt.
 type Password []byte
 
-// NewPassword возвращает пароль в виде хеш.
-func NewPassword(password string) Password {
-	passwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// DefaultPasswordCost задает сложность вычисления хеш пароля, используемую по
+// умолчанию в NewPassword.
+var DefaultPasswordCost = bcrypt.DefaultCost
+
+// Ошибки, возвращаемые при создании пароля.
+var (
+	// сложность вычисления хеш выходит за допустимые для bcrypt пределы
+	ErrBadPasswordCost = errors.New("bad password hash cost")
+	// пароль длиннее, чем может обработать bcrypt
+	ErrPasswordTooLong = errors.New("password is too long")
+)
+
+// ErrWrongPassword возвращается, если указанный пароль не совпадает с
+// сохраненным.
+var ErrWrongPassword = errors.New("wrong password")
+
+// MaxPasswordLength задает максимальную длину пароля в байтах. Алгоритм bcrypt
+// молча отбрасывает все, что идет после первых 72 байт, поэтому более длинные
+// пароли не принимаются.
+const MaxPasswordLength = 72
+
+// PasswordPolicy проверяет пароль перед вычислением его хеш и возвращает
+// ошибку, если пароль не удовлетворяет требованиям. Политика применяется в
+// NewPassword и NewPasswordCost, а значит, и при смене паролей пользователей и
+// устройств. К паролям, которые создает сама библиотека (RandomPassword в
+// Devices.ResetAllPasswords), политика не применяется. По умолчанию
+// используется NoPasswordPolicy, не накладывающая никаких ограничений.
+var PasswordPolicy = NoPasswordPolicy
+
+// NoPasswordPolicy принимает любой пароль.
+func NoPasswordPolicy(password string) error {
+	return nil
+}
+
+// ErrPasswordTooShort возвращается политикой MinLengthPolicy, если пароль
+// короче заданной длины.
+var ErrPasswordTooShort = errors.New("password is too short")
+
+// MinLengthPolicy возвращает политику, которая требует, чтобы пароль содержал
+// не менее n символов.
+func MinLengthPolicy(n int) func(password string) error {
+	return func(password string) error {
+		if utf8.RuneCountInString(password) < n {
+			return ErrPasswordTooShort
+		}
+		return nil
+	}
+}
+
+// GeneratedPasswordLength задает длину паролей, создаваемых RandomPassword.
+const GeneratedPasswordLength = 20
+
+// passwordAlphabet содержит символы, из которых составляются случайные пароли.
+// Похожие друг на друга символы (0 и O, 1, l и I) исключены, чтобы пароль было
+// проще переписать вручную.
+const passwordAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+// RandomPassword возвращает случайный пароль длиной GeneratedPasswordLength,
+// созданный с помощью криптографически стойкого генератора случайных чисел.
+func RandomPassword() (string, error) {
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	password := make([]byte, GeneratedPasswordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// NewPassword возвращает пароль в виде хеш, вычисленного со сложностью
+// DefaultPasswordCost.
+func NewPassword(password string) (Password, error) {
+	return NewPasswordCost(password, DefaultPasswordCost)
+}
+
+// NewPasswordCost возвращает пароль в виде хеш, вычисленного с указанной
+// сложностью. Сложность должна находиться в пределах от bcrypt.MinCost до
+// bcrypt.MaxCost, в противном случае возвращается ошибка ErrBadPasswordCost.
+// Если пароль длиннее MaxPasswordLength, то возвращается ошибка
+// ErrPasswordTooLong, а если он не удовлетворяет PasswordPolicy — ошибка,
+// возвращенная политикой.
+func NewPasswordCost(password string, cost int) (Password, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, ErrBadPasswordCost
+	}
+	if len(password) > MaxPasswordLength {
+		return nil, ErrPasswordTooLong
+	}
+	if PasswordPolicy != nil {
+		if err := PasswordPolicy(password); err != nil {
+			return nil, err
+		}
+	}
+	return hashPassword(password, cost)
+}
+
+// hashPassword возвращает пароль в виде хеш, вычисленного с указанной
+// сложностью, без проверки PasswordPolicy. Используется для паролей, созданных
+// RandomPassword.
+func hashPassword(password string, cost int) (Password, error) {
+	passwd, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return Password(passwd)
+	return Password(passwd), nil
 }
 
 // Compare сравнивает сохраненный в виде хеш пароль с указанным в параметре и
@@ -21,3 +130,34 @@ func NewPassword(password string) Password {
 func (p Password) Compare(password string) bool {
 	return bcrypt.CompareHashAndPassword(p, []byte(password)) == nil
 }
+
+// NeedsRehash возвращает true, если хеш пароля был вычислен со сложностью
+// меньше указанной. Это позволяет после успешной проверки пароля при
+// авторизации прозрачно пересчитать его хеш с новой сложностью. Если
+// сохраненное значение не является корректным хеш bcrypt, то возвращается
+// false.
+func (p Password) NeedsRehash(desiredCost int) bool {
+	cost, err := bcrypt.Cost(p)
+	if err != nil {
+		return false
+	}
+	return cost < desiredCost
+}
+
+// MarshalJSON всегда возвращает null, чтобы хеш пароля ни при каких
+// обстоятельствах не попал в ответ клиенту, даже если в описании структуры
+// забыли исключить это поле.
+func (p Password) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// CodecEncodeSelf, как и MarshalJSON, никогда не кодирует хеш пароля, а
+// записывает вместо него пустое значение.
+func (p Password) CodecEncodeSelf(e *codec.Encoder) {
+	e.MustEncode(nil)
+}
+
+// CodecDecodeSelf декодирует пароль, как обычный набор байт.
+func (p *Password) CodecDecodeSelf(d *codec.Decoder) {
+	d.MustDecode((*[]byte)(p))
+}
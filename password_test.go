@@ -1,10 +1,135 @@
 package model
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/bcrypt"
+)
 
 func TestPassword(t *testing.T) {
-	passwd := NewPassword("test")
+	passwd, err := NewPassword("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwd.Compare("test") {
+		t.Fatal("bad compare password")
+	}
+	if _, err := NewPassword(strings.Repeat("x", MaxPasswordLength)); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewPassword(strings.Repeat("x", MaxPasswordLength+1)); err != ErrPasswordTooLong {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPasswordCost(t *testing.T) {
+	passwd, err := NewPasswordCost("test", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !passwd.Compare("test") {
 		t.Fatal("bad compare password")
 	}
+	if cost, err := bcrypt.Cost(passwd); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("unexpected cost: %d, %v", cost, err)
+	}
+	for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+		if _, err := NewPasswordCost("test", cost); err != ErrBadPasswordCost {
+			t.Errorf("cost %d: unexpected error: %v", cost, err)
+		}
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	passwd, err := NewPasswordCost("test", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwd.NeedsRehash(bcrypt.MinCost + 1) {
+		t.Error("password with lower cost does not need rehash")
+	}
+	if passwd.NeedsRehash(bcrypt.MinCost) {
+		t.Error("password with the same cost needs rehash")
+	}
+	if Password("invalid").NeedsRehash(bcrypt.MaxCost) {
+		t.Error("invalid password needs rehash")
+	}
+}
+
+func TestPasswordMarshal(t *testing.T) {
+	passwd, err := NewPasswordCost("secret", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := struct {
+		Name     string   `json:"name"`
+		Password Password `json:"password"`
+	}{"name", passwd}
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, passwd) {
+		t.Errorf("password hash leaked to json: %s", data)
+	}
+	for _, h := range []codec.Handle{new(codec.JsonHandle), new(codec.MsgpackHandle)} {
+		var data []byte
+		if err := codec.NewEncoderBytes(&data, h).Encode(value); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, passwd) {
+			t.Errorf("password hash leaked to %T: %q", h, data)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	defer func(policy func(string) error) { PasswordPolicy = policy }(PasswordPolicy)
+	if _, err := NewPassword("1"); err != nil {
+		t.Errorf("default policy rejects password: %v", err)
+	}
+	PasswordPolicy = MinLengthPolicy(6)
+	for password, want := range map[string]error{
+		"12345":  ErrPasswordTooShort,
+		"123456": nil,
+		// длина считается в символах, а не в байтах
+		"парол":  ErrPasswordTooShort,
+		"пароль": nil,
+	} {
+		if _, err := NewPassword(password); err != want {
+			t.Errorf("%q: unexpected error: %v", password, err)
+		}
+	}
+	errWeak := errors.New("weak password")
+	PasswordPolicy = func(string) error { return errWeak }
+	if _, err := NewPasswordCost("password", bcrypt.MinCost); err != errWeak {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPasswordRandom(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		password, err := RandomPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(password) != GeneratedPasswordLength {
+			t.Errorf("unexpected length: %q", password)
+		}
+		for _, r := range password {
+			if !strings.ContainsRune(passwordAlphabet, r) {
+				t.Errorf("unexpected character in %q", password)
+			}
+		}
+		if seen[password] {
+			t.Errorf("duplicate password: %q", password)
+		}
+		seen[password] = true
+	}
 }
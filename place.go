@@ -1,42 +1,429 @@
 package model
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/geotrace/geo"
 	"github.com/geotrace/uid"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-type Places DB // для обращения к данным об описании мест
+// Places предоставляет доступ к данным об описании мест. Получить его можно
+// с помощью метода DB.Places.
+type Places DB
 
 // Get возвращает описание места по его идентификатору. Кроме идентификатора
 // места, который является уникальным, необходимо так же указывать идентификатор
 // группы — это позволяет дополнительно ограничить даже случайный доступ
 // пользователей к чужой информации.
 func (db *Places) Get(groupId, id string) (place *Place, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionPlaces)
-	place = new(Place)
-	err = coll.Find(bson.M{"_id": id, "groupId": groupId}).
-		Select(bson.M{"groupId": 0, "geo": 0}).One(place)
-	session.Close()
+	return db.GetContext(context.Background(), groupId, id)
+}
+
+// GetContext работает как Get, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) GetContext(ctx context.Context, groupId, id string) (place *Place, err error) {
+	result := new(Place)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": id, "groupId": groupId}).
+			Select(bson.M{"groupId": 0, "geo": 0}).One(result)
+	})
+	if err == nil {
+		place = result
+	} else {
+		err = notFound(err, CollectionPlaces, groupId, id)
+	}
+	return
+}
+
+// GetFields работает как Get, но возвращает только указанные поля места
+// (названия задаются так же, как в хранилище), что позволяет сократить объем
+// передаваемых данных. Служебное поле geo запросить нельзя: для
+// него, как и для неизвестных полей, возвращается ErrBadField.
+func (db *Places) GetFields(groupId, id string, fields ...string) (place *Place, err error) {
+	return db.GetFieldsContext(context.Background(), groupId, id, fields...)
+}
+
+// GetFieldsContext работает как GetFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) GetFieldsContext(ctx context.Context, groupId, id string, fields ...string) (place *Place, err error) {
+	selector, err := fieldSelector((*Place)(nil), fields, "geo")
+	if err != nil {
+		return
+	}
+	result := new(Place)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": id, "groupId": groupId}).Select(selector).One(result)
+	})
+	if err == nil {
+		place = result
+	} else {
+		err = notFound(err, CollectionPlaces, groupId, id)
+	}
+	return
+}
+
+// ListFields работает как List, но возвращает только указанные поля
+// места так же, как GetFields.
+func (db *Places) ListFields(groupID string, fields ...string) (places []*Place, err error) {
+	return db.ListFieldsContext(context.Background(), groupID, fields...)
+}
+
+// ListFieldsContext работает как ListFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) ListFieldsContext(ctx context.Context, groupID string, fields ...string) (places []*Place, err error) {
+	selector, err := fieldSelector((*Place)(nil), fields, "geo")
+	if err != nil {
+		return
+	}
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).Select(selector).All(&result)
+	})
+	if err == nil {
+		places = result
+	}
 	return
 }
 
 // List возвращает список всех мест, определенных в хранилище для данной группы
 // пользователей.
 func (db *Places) List(groupID string) (places []*Place, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionPlaces)
-	places = make([]*Place, 0)
-	err = coll.Find(bson.M{"groupId": groupID}).
-		Select(bson.M{"groupId": 0, "geo": 0}).All(&places)
-	session.Close()
+	return db.ListContext(context.Background(), groupID)
+}
+
+// ListContext работает как List, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) ListContext(ctx context.Context, groupID string) (places []*Place, err error) {
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).
+			Select(bson.M{"groupId": 0, "geo": 0}).All(&result)
+	})
+	if err == nil {
+		places = result
+	}
+	return
+}
+
+// Search возвращает список мест группы, имя которых содержит указанную строку
+// без учета регистра. Строка ищется как есть: специальные символы регулярных
+// выражений в ней не учитываются. Как и в List, данные для индексации (geo) не
+// возвращаются. Если ничего не найдено, то возвращается пустой список.
+func (db *Places) Search(groupId, query string) (places []*Place, err error) {
+	return db.SearchContext(context.Background(), groupId, query)
+}
+
+// SearchContext работает как Search, но позволяет прервать выполнение запроса
+// с помощью контекста.
+func (db *Places) SearchContext(ctx context.Context, groupId, query string) (places []*Place, err error) {
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupId, "name": containsRegex(query)}).
+			Select(bson.M{"groupId": 0, "geo": 0}).All(&result)
+	})
+	if err == nil {
+		places = result
+	}
+	return
+}
+
+// Count возвращает количество мест, зарегистрированных в указанной группе.
+func (db *Places) Count(groupId string) (count int, err error) {
+	return db.CountContext(context.Background(), groupId)
+}
+
+// CountContext работает как Count, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) CountContext(ctx context.Context, groupId string) (count int, err error) {
+	return (*DB)(db).countGroup(ctx, CollectionPlaces, groupId)
+}
+
+// Containing возвращает список мест группы, внутри которых находится указанная
+// точка. Поиск осуществляется по полю geo, поэтому одинаково работает как для
+// мест, заданных полигоном, так и для окружностей, преобразованных в полигон.
+func (db *Places) Containing(groupId string, p geo.Point) (places []*Place, err error) {
+	return db.ContainingContext(context.Background(), groupId, p)
+}
+
+// ContainingContext работает как Containing, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) ContainingContext(ctx context.Context, groupId string, p geo.Point) (places []*Place, err error) {
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{
+			"groupId": groupId,
+			"geo":     bson.M{"$geoIntersects": bson.M{"$geometry": geoPoint(p)}},
+		}).Select(bson.M{"groupId": 0, "geo": 0}).All(&result)
+	})
+	if err == nil {
+		places = result
+	}
+	return
+}
+
+// Evaluate возвращает список мест группы, внутри которых находится указанная
+// точка, т.е. геозон, в которые она попадает. Работает так же, как Containing.
+// Для проверки сразу нескольких событий удобнее использовать
+// Events.CreateEvaluate.
+func (db *Places) Evaluate(groupId string, p geo.Point) ([]*Place, error) {
+	return db.Containing(groupId, p)
+}
+
+// EvaluateContext работает как Evaluate, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) EvaluateContext(ctx context.Context, groupId string, p geo.Point) ([]*Place, error) {
+	return db.ContainingContext(ctx, groupId, p)
+}
+
+// Overlapping возвращает список других мест группы, геометрия которых
+// пересекается с геометрией указанного места. Само место в список не
+// попадает. Если место не найдено, то возвращается ErrNotFound. Окружности
+// при этом сравниваются в виде многоугольников, которыми они сохраняются в
+// хранилище, поэтому для окружностей, которые почти касаются друг друга,
+// результат может отличаться от точного.
+func (db *Places) Overlapping(groupId, placeId string) (places []*Place, err error) {
+	return db.OverlappingContext(context.Background(), groupId, placeId)
+}
+
+// OverlappingContext работает как Overlapping, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Places) OverlappingContext(ctx context.Context, groupId, placeId string) (places []*Place, err error) {
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		var place struct {
+			Geo bson.M `bson:"geo"`
+		}
+		err := coll.Find(bson.M{"_id": placeId, "groupId": groupId}).
+			Select(bson.M{"geo": 1}).One(&place)
+		if err != nil {
+			return err
+		}
+		return coll.Find(bson.M{
+			"groupId": groupId,
+			"_id":     bson.M{"$ne": placeId},
+			"$or":     intersects("geo", place.Geo),
+		}).Select(bson.M{"groupId": 0, "geo": 0}).All(&result)
+	})
+	if err == nil {
+		places = result
+	}
+	return
+}
+
+// intersects возвращает список условий $geoIntersects для поля field, хотя
+// бы одному из которых удовлетворяют объекты, пересекающиеся с сохраненной
+// геометрией места geometry. Коридор маршрута сохраняется как
+// GeometryCollection, который нельзя использовать в запросе, поэтому для
+// него условие составляется для каждой его части.
+func intersects(field string, geometry bson.M) []bson.M {
+	var geometries []interface{}
+	if geometry["type"] == "GeometryCollection" {
+		geometries, _ = geometry["geometries"].([]interface{})
+	} else {
+		geometries = []interface{}{geometry}
+	}
+	conditions := make([]bson.M, len(geometries))
+	for i, geometry := range geometries {
+		conditions[i] = bson.M{
+			field: bson.M{"$geoIntersects": bson.M{"$geometry": geometry}},
+		}
+	}
+	return conditions
+}
+
+// DevicesEntered возвращает отсортированный список идентификаторов устройств
+// группы, у которых есть события с координатами внутри указанного места за
+// интервал времени (границы интервала задаются так же, как в
+// Events.CountByTime). События, помеченные как удаленные, не учитываются.
+// Если место не найдено, то возвращается ErrNotFound.
+//
+// Координаты событий сравниваются с геометрией места, сохраненной в
+// хранилище, поэтому окружность проверяется в виде многоугольника, как и в
+// Overlapping. Для работы запроса необходим индекс 2dsphere по полю location
+// событий (смотри Events.EnsureIndexes).
+func (db *Places) DevicesEntered(groupId, placeId string, from, to time.Time) (devices []string, err error) {
+	return db.DevicesEnteredContext(context.Background(), groupId, placeId, from, to)
+}
+
+// DevicesEnteredContext работает как DevicesEntered, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Places) DevicesEnteredContext(ctx context.Context, groupId, placeId string, from, to time.Time) (devices []string, err error) {
+	result := make([]string, 0)
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) error {
+		var place struct {
+			Geo bson.M `bson:"geo"`
+		}
+		err := (*DB)(db).c(mdb, CollectionPlaces).Find(bson.M{"_id": placeId, "groupId": groupId}).
+			Select(bson.M{"geo": 1}).One(&place)
+		if err != nil {
+			return err
+		}
+		query := bson.M{"groupId": groupId, "$or": intersects("location", place.Geo)}
+		if period := timeRange(from, to); period != nil {
+			query["time"] = period
+		}
+		return (*DB)(db).c(mdb, CollectionEvents).Find(notDeleted(query)).
+			Distinct("deviceId", &result)
+	})
+	if err == nil {
+		sort.Strings(result)
+		devices = result
+	}
+	return
+}
+
+// ContainingAny возвращает для каждой точки из списка места группы, внутри
+// которых она находится. Ключом в возвращаемом словаре служит индекс точки в
+// списке; для точек, не попадающих ни в одно место, возвращается пустой
+// список. В отличие от вызова Containing для каждой точки, точки проверяются
+// пакетами по 100 за один запрос агрегации, а описания найденных мест
+// загружаются одним дополнительным запросом.
+func (db *Places) ContainingAny(groupId string, points []geo.Point) (map[int][]*Place, error) {
+	return db.ContainingAnyContext(context.Background(), groupId, points)
+}
+
+// ContainingAnyContext работает как ContainingAny, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Places) ContainingAnyContext(ctx context.Context, groupId string, points []geo.Point) (places map[int][]*Place, err error) {
+	var found [][]*Place
+	err = (*DB)(db).execDB(ctx, func(mdb *mgo.Database) (err error) {
+		found, err = containingAll((*DB)(db).c(mdb, CollectionPlaces), groupId, points)
+		return
+	})
+	if err != nil {
+		return
+	}
+	places = make(map[int][]*Place, len(found))
+	for i, list := range found {
+		places[i] = list
+	}
 	return
 }
 
+// containingBatchSize задает максимальное количество точек, проверяемых
+// containingAll за один запрос агрегации.
+const containingBatchSize = 100
+
+// containingAll возвращает для каждой точки из списка места группы, внутри
+// которых она находится. Точки проверяются пакетами по containingBatchSize:
+// для каждого пакета выполняется один запрос агрегации, в которой для каждой
+// точки задан свой отдельный фасет ($facet) с условием $geoIntersects. Фасеты
+// возвращают только идентификаторы мест, чтобы результат агрегации не
+// превышал допустимый размер документа, а сами описания найденных мест
+// загружаются одним дополнительным запросом. Поиск внутри фасетов не
+// использует индексы, но выполняется только по местам одной группы, которых
+// обычно немного. Требуется MongoDB версии 3.4 или выше.
+func containingAll(coll *mgo.Collection, groupId string, points []geo.Point) ([][]*Place, error) {
+	result := make([][]*Place, len(points))
+	ids := make([][]string, len(points))
+	unique := make(map[string]bool)
+	for offset := 0; offset < len(points); offset += containingBatchSize {
+		batch := points[offset:]
+		if len(batch) > containingBatchSize {
+			batch = batch[:containingBatchSize]
+		}
+		facets := make(bson.M, len(batch))
+		for i, p := range batch {
+			facets[strconv.Itoa(i)] = []bson.M{
+				{"$match": bson.M{
+					"geo": bson.M{"$geoIntersects": bson.M{"$geometry": geoPoint(p)}},
+				}},
+				{"$project": bson.M{"_id": 1}},
+			}
+		}
+		var found map[string][]struct {
+			ID string `bson:"_id"`
+		}
+		err := coll.Pipe([]bson.M{
+			{"$match": bson.M{"groupId": groupId}},
+			{"$facet": facets},
+		}).One(&found)
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			for _, place := range found[strconv.Itoa(i)] {
+				ids[offset+i] = append(ids[offset+i], place.ID)
+				unique[place.ID] = true
+			}
+		}
+	}
+	places := make(map[string]*Place, len(unique))
+	if len(unique) > 0 {
+		list := make([]string, 0, len(unique))
+		for id := range unique {
+			list = append(list, id)
+		}
+		var found []*Place
+		err := coll.Find(bson.M{"_id": bson.M{"$in": list}, "groupId": groupId}).
+			Select(bson.M{"groupId": 0, "geo": 0}).All(&found)
+		if err != nil {
+			return nil, err
+		}
+		for _, place := range found {
+			places[place.ID] = place
+		}
+	}
+	for i := range result {
+		result[i] = make([]*Place, 0, len(ids[i]))
+		for _, id := range ids[i] {
+			// место может быть удалено между запросами
+			if place, ok := places[id]; ok {
+				item := *place
+				result[i] = append(result[i], &item)
+			}
+		}
+	}
+	return result, nil
+}
+
+// GeoJSON возвращает все места группы в виде коллекции объектов
+// (FeatureCollection) в формате GeoJSON для отображения геозон на карте. В
+// качестве геометрии используется сохраненное для индексации описание места, а
+// в свойствах объекта сохраняются его идентификатор и имя.
+func (db *Places) GeoJSON(groupId string) (data []byte, err error) {
+	return db.GeoJSONContext(context.Background(), groupId)
+}
+
+// GeoJSONContext работает как GeoJSON, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) GeoJSONContext(ctx context.Context, groupId string) (data []byte, err error) {
+	result := make([]*Place, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		// в отличие от List, здесь нужно именно поле geo
+		return coll.Find(bson.M{"groupId": groupId}).
+			Select(bson.M{"name": 1, "geo": 1}).All(&result)
+	})
+	if err != nil {
+		return
+	}
+	collection := newGeoJSONFeatureCollection()
+	for _, place := range result {
+		feature := newGeoJSONFeature(place.ID, place.Geo)
+		feature.Properties["id"] = place.ID
+		if place.Name != "" {
+			feature.Properties["name"] = place.Name
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	return collection.Bytes()
+}
+
 // Create добавляет в хранилище описание нового места для группы. Указание
 // группы позволяет дополнительно защитить от ошибок переназначения места для
 // другой группы.
 func (db *Places) Create(groupId string, place *Place) (err error) {
+	return db.CreateContext(context.Background(), groupId, place)
+}
+
+// CreateContext работает как Create, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) CreateContext(ctx context.Context, groupId string, place *Place) (err error) {
 	if err = place.prepare(); err != nil {
 		return
 	}
@@ -44,24 +431,219 @@ func (db *Places) Create(groupId string, place *Place) (err error) {
 		place.ID = uid.New()
 	}
 	place.GroupID = groupId
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionPlaces)
-	err = coll.Insert(place)
-	session.Close()
+	now := time.Now().UTC()
+	place.CreatedAt, place.UpdatedAt = now, now
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return duplicate(coll.Insert(place))
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditCreate, CollectionPlaces, groupId, place.ID)
+	}
+	return
+}
+
+// BulkCreate добавляет в хранилище описания нескольких мест группы. В отличие
+// от Create, ошибка в описании одного места не прерывает сохранение
+// остальных: корректные описания сохраняются, а для каждого места
+// возвращается своя ошибка (nil, если место сохранено) в списке с теми же
+// индексами, что и у мест. Ошибки вставки, например, дублирование
+// идентификатора, также возвращаются в этом списке. Вторая возвращаемая
+// ошибка сообщает о проблемах, не связанных с конкретным местом, например, о
+// недоступности сервера.
+func (db *Places) BulkCreate(groupId string, places []*Place) (errs []error, err error) {
+	return db.BulkCreateContext(context.Background(), groupId, places)
+}
+
+// BulkCreateContext работает как BulkCreate, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Places) BulkCreateContext(ctx context.Context, groupId string, places []*Place) (errs []error, err error) {
+	result := make([]error, len(places))
+	now := time.Now().UTC()
+	objs := make([]interface{}, 0, len(places))
+	positions := make([]int, 0, len(places)) // индексы сохраняемых мест
+	for i, place := range places {
+		if result[i] = place.prepare(); result[i] != nil {
+			continue
+		}
+		if place.ID == "" {
+			place.ID = uid.New()
+		}
+		place.GroupID = groupId
+		place.CreatedAt, place.UpdatedAt = now, now
+		objs = append(objs, place)
+		positions = append(positions, i)
+	}
+	if len(objs) > 0 {
+		err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+			bulk := coll.Bulk()
+			bulk.Unordered()
+			bulk.Insert(objs...)
+			_, err := bulk.Run()
+			return err
+		})
+		if bulkErr, ok := err.(*mgo.BulkError); ok {
+			for _, c := range bulkErr.Cases() {
+				if c.Index < 0 || c.Index >= len(positions) {
+					return // неизвестно, к какому месту относится ошибка
+				}
+				result[positions[c.Index]] = duplicate(c.Err)
+			}
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	for _, i := range positions {
+		if result[i] == nil {
+			(*DB)(db).audit(ctx, AuditCreate, CollectionPlaces, groupId, places[i].ID)
+		}
+	}
+	errs = result
 	return
 }
 
 // Update обновляет информацию о месте в хранилище. Указание группы позволяет
-// дополнительно защитить от ошибок переназначения места для другой группы.
+// дополнительно защитить от ошибок переназначения места для другой группы:
+// если место не принадлежит ей, то возвращается ErrNotFound.
+//
+// Описание сохраняется только в том случае, если его версия совпадает с
+// сохраненной, т.е. оно не было изменено с момента чтения. В противном случае
+// возвращается ErrVersionConflict. При успешном обновлении версия
+// увеличивается.
 func (db *Places) Update(groupId string, place *Place) (err error) {
+	return db.UpdateContext(context.Background(), groupId, place)
+}
+
+// UpdateContext работает как Update, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) UpdateContext(ctx context.Context, groupId string, place *Place) (err error) {
 	if err = place.prepare(); err != nil {
 		return
 	}
 	place.GroupID = groupId
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionPlaces)
-	err = coll.UpdateId(place.ID, place)
-	session.Close()
+	// сохраняем копию описания со следующей версией и временем изменения
+	doc := *place
+	doc.Version++
+	doc.UpdatedAt = time.Now().UTC()
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) (err error) {
+		if doc.CreatedAt.IsZero() {
+			if doc.CreatedAt, err = storedCreatedAt(coll, doc.ID); err != nil {
+				return
+			}
+		}
+		return updateVersioned(coll, place.ID, groupId, place.Version, &doc)
+	})
+	if err == nil {
+		place.Version = doc.Version
+		place.CreatedAt, place.UpdatedAt = doc.CreatedAt, doc.UpdatedAt
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionPlaces, groupId, place.ID)
+	}
+	return
+}
+
+// Rename изменяет только имя места в указанной группе, не затрагивая его
+// геометрию и остальные поля описания. В отличие от Update, описание при этом
+// не проверяется и геометрия не вычисляется заново. Версия описания
+// увеличивается, чтобы последующее Update с прежней версией не затерло новое
+// имя. Пустое имя удаляет его. Если место не найдено, то возвращается
+// ErrNotFound.
+func (db *Places) Rename(groupId, id, name string) (err error) {
+	return db.RenameContext(context.Background(), groupId, id, name)
+}
+
+// RenameContext работает как Rename, но позволяет прервать выполнение запроса
+// с помощью контекста.
+func (db *Places) RenameContext(ctx context.Context, groupId, id, name string) (err error) {
+	update := renameUpdate(name)
+	update["$inc"] = bson.M{"version": 1}
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"_id": id, "groupId": groupId}, update)
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionPlaces, groupId, id)
+	}
+	return
+}
+
+// Upsert создает описание места в указанной группе или заменяет его, если
+// место с таким идентификатором уже существует, и возвращает true, если было
+// создано новое описание. Это позволяет синхронизировать описания мест с
+// конфигурацией без предварительного чтения.
+//
+// Место не может быть перенесено таким образом в другую группу: если место с
+// таким идентификатором уже принадлежит другой группе, то возвращается ошибка
+// дублирования ключа. Версия описания при этом не проверяется, но
+// увеличивается, как и при Update, поэтому последующее Update с версией,
+// прочитанной до Upsert, вернет ErrVersionConflict.
+func (db *Places) Upsert(groupId string, place *Place) (created bool, err error) {
+	return db.UpsertContext(context.Background(), groupId, place)
+}
+
+// UpsertContext работает как Upsert, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) UpsertContext(ctx context.Context, groupId string, place *Place) (created bool, err error) {
+	if err = place.prepare(); err != nil {
+		return
+	}
+	if place.ID == "" {
+		place.ID = uid.New()
+	}
+	place.GroupID = groupId
+	// заменяем все поля описания, кроме неизменяемых и версии, которая
+	// увеличивается, как и при Update
+	doc := *place
+	doc.UpdatedAt = time.Now().UTC()
+	data, err := bson.Marshal(&doc)
+	if err != nil {
+		return
+	}
+	var set bson.M
+	if err = bson.Unmarshal(data, &set); err != nil {
+		return
+	}
+	delete(set, "_id")
+	delete(set, "version")
+	delete(set, "createdAt")
+	unset := bson.M{}
+	for name := range bsonFields((*Place)(nil)) {
+		if _, ok := set[name]; !ok && name != "_id" && name != "version" && name != "createdAt" {
+			unset[name] = ""
+		}
+	}
+	update := bson.M{
+		"$set":         set,
+		"$inc":         bson.M{"version": 1},
+		"$setOnInsert": bson.M{"createdAt": doc.UpdatedAt},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var (
+		stored struct {
+			Version   int       `bson:"version"`
+			CreatedAt time.Time `bson:"createdAt"`
+		}
+		info *mgo.ChangeInfo
+	)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) (err error) {
+		info, err = coll.Find(bson.M{"_id": doc.ID, "groupId": groupId}).Apply(mgo.Change{
+			Update:    update,
+			Upsert:    true,
+			ReturnNew: true,
+		}, &stored)
+		return duplicate(err)
+	})
+	if err == nil {
+		created = info.UpsertedId != nil
+		place.Version = stored.Version
+		place.CreatedAt, place.UpdatedAt = stored.CreatedAt, doc.UpdatedAt
+		action := AuditUpdate
+		if created {
+			action = AuditCreate
+		}
+		(*DB)(db).audit(ctx, action, CollectionPlaces, groupId, place.ID)
+	}
 	return
 }
 
@@ -69,9 +651,76 @@ func (db *Places) Update(groupId string, place *Place) (err error) {
 // Указание группы позволяет дополнительно защитить от ошибок доступа к чужой
 // информации.
 func (db *Places) Delete(groupId, id string) (err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionPlaces)
-	err = coll.Remove(bson.M{"_id": id, "groupId": groupId})
-	session.Close()
+	return db.DeleteContext(context.Background(), groupId, id)
+}
+
+// DeleteContext работает как Delete, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Places) DeleteContext(ctx context.Context, groupId, id string) (err error) {
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		return coll.Remove(bson.M{"_id": id, "groupId": groupId})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionPlaces, groupId, id)
+	}
+	return
+}
+
+// ReindexGeometry заново вычисляет данные для индексации (поле geo) всех мест
+// группы по их описаниям и сохраняет их, не изменяя остальные поля, версию и
+// время изменения описаний. Это позволяет обновить сохраненную геометрию
+// после обновления библиотеки, если изменился способ ее вычисления, например,
+// количество сторон многоугольника, которым представляется окружность.
+// Возвращается количество обновленных мест и идентификаторы пропущенных мест:
+// тех, для которых не задана ни окружность, ни полигоны, ни маршрут, или
+// описание которых некорректно. Пропущенные места не прерывают обработку
+// остальных.
+//
+// Места, измененные или удаленные во время обработки, не обновляются и не
+// считаются пропущенными: их геометрия уже вычислена заново при изменении.
+// Все места группы загружаются в память, поэтому метод не предназначен для
+// групп с очень большим количеством мест.
+func (db *Places) ReindexGeometry(groupId string) (updated int, skipped []string, err error) {
+	return db.ReindexGeometryContext(context.Background(), groupId)
+}
+
+// ReindexGeometryContext работает как ReindexGeometry, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Places) ReindexGeometryContext(ctx context.Context, groupId string) (updated int, skipped []string, err error) {
+	var result int
+	invalid := make([]string, 0)
+	err = (*DB)(db).exec(ctx, CollectionPlaces, func(coll *mgo.Collection) error {
+		var list []*Place
+		err := coll.Find(bson.M{"groupId": groupId}).Select(bson.M{"geo": 0}).All(&list)
+		if err != nil {
+			return err
+		}
+		for _, place := range list {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := place.prepare(); err != nil {
+				invalid = append(invalid, place.ID)
+				continue
+			}
+			err := coll.Update(bson.M{
+				"_id":     place.ID,
+				"groupId": groupId,
+				"version": versionQuery(place.Version),
+			}, bson.M{"$set": bson.M{"geo": place.Geo}})
+			if err == ErrNotFound {
+				continue // место изменено или удалено во время обработки
+			}
+			if err != nil {
+				return err
+			}
+			result++
+			(*DB)(db).audit(ctx, AuditUpdate, CollectionPlaces, groupId, place.ID)
+		}
+		return nil
+	})
+	if err == nil {
+		updated, skipped = result, invalid
+	}
 	return
 }
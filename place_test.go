@@ -0,0 +1,613 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPlacesContaining(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	polygon := geo.Polygon{{
+		{37.60, 55.74}, {37.64, 55.74}, {37.64, 55.77}, {37.60, 55.77},
+		{37.60, 55.74},
+	}}
+	for _, place := range []*Place{
+		{ID: "circle", Circle: &circle},
+		{ID: "polygon", Polygon: &polygon},
+	} {
+		if err := places.Create("group", place); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := places.Containing("group", geo.Point{37.6173, 55.7558})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected places: %v", list)
+	}
+	list, err = places.Containing("group", geo.Point{37.63, 55.76})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "polygon" {
+		t.Errorf("unexpected places: %v", list)
+	}
+}
+
+func TestEventsCreateEvaluate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	place := &Place{ID: "center", Circle: &circle}
+	if err := db.Places().Create("group", place); err != nil {
+		t.Fatal(err)
+	}
+	places, err := db.Events().CreateEvaluate("group", "device",
+		&Event{Location: &geo.Point{37.6173, 55.7558}},
+		&Event{},
+		&Event{Location: &geo.Point{30.3141, 59.9386}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(places) != 3 {
+		t.Fatalf("unexpected result length: %d", len(places))
+	}
+	if len(places[0]) != 1 || places[0][0].ID != "center" {
+		t.Errorf("unexpected places for the first event: %v", places[0])
+	}
+	if len(places[1]) != 0 || len(places[2]) != 0 {
+		t.Errorf("unexpected places: %v, %v", places[1], places[2])
+	}
+}
+
+func TestEvaluateError(t *testing.T) {
+	cause := errors.New("aggregation failed")
+	var err error = &EvaluateError{Err: cause}
+	if !errors.Is(err, cause) {
+		t.Errorf("error does not wrap the cause: %v", err)
+	}
+	var evaluateErr *EvaluateError
+	if !errors.As(err, &evaluateErr) || err.Error() != "events stored, but places not evaluated: aggregation failed" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPlacesGeoJSON(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	polygon := geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}
+	err := db.Places().Create("group", &Place{ID: "id", Name: "name", Polygon: &polygon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.Places().GeoJSON("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collection struct {
+		Type     string
+		Features []struct {
+			Geometry   map[string]interface{}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		t.Fatal(err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 1 {
+		t.Fatalf("unexpected collection: %s", data)
+	}
+	feature := collection.Features[0]
+	if feature.Geometry["type"] != "Polygon" {
+		t.Errorf("unexpected geometry: %v", feature.Geometry)
+	}
+	if feature.Properties["id"] != "id" || feature.Properties["name"] != "name" {
+		t.Errorf("unexpected properties: %v", feature.Properties)
+	}
+}
+
+func TestPlacesUpsert(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	created, err := places.Upsert("group", &Place{ID: "id", Name: "old", Circle: &circle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("place is not created")
+	}
+	created, err = places.Upsert("group", &Place{ID: "id", Name: "new", Circle: &circle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("place is created twice")
+	}
+	place, err := places.Get("group", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place.Name != "new" {
+		t.Errorf("unexpected place name: %q", place.Name)
+	}
+	if _, err := places.Upsert("other", &Place{ID: "id", Circle: &circle}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPlacesUpdateVersion(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	if err := places.Create("group", &Place{ID: "id", Circle: &circle}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := places.Get("group", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := places.Get("group", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := places.Update("group", first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 1 {
+		t.Errorf("unexpected version: %d", first.Version)
+	}
+	if err := places.Update("group", second); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if second.Version != 0 {
+		t.Errorf("version changed on conflict: %d", second.Version)
+	}
+	if err := places.Update("other", first); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPlacesTimestamps(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	place := &Place{ID: "id", Circle: &circle}
+	if err := places.Create("group", place); err != nil {
+		t.Fatal(err)
+	}
+	if place.CreatedAt.IsZero() || !place.UpdatedAt.Equal(place.CreatedAt) {
+		t.Errorf("unexpected timestamps: %v, %v", place.CreatedAt, place.UpdatedAt)
+	}
+	created := place.CreatedAt
+	time.Sleep(10 * time.Millisecond)
+	// время создания должно сохраниться, даже если не передано
+	update := &Place{ID: "id", Name: "Home", Circle: &circle}
+	if err := places.Update("group", update); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := places.Get("group", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CreatedAt.Equal(created.Truncate(time.Millisecond)) {
+		t.Errorf("created time changed: %v != %v", stored.CreatedAt, created)
+	}
+	if !stored.UpdatedAt.After(stored.CreatedAt) {
+		t.Errorf("updated time not changed: %v", stored.UpdatedAt)
+	}
+}
+
+func TestPlacesContainingAny(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	if err := places.Create("group", &Place{ID: "center", Circle: &circle}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := places.ContainingAny("group", []geo.Point{
+		{37.6173, 55.7558}, {30.3141, 59.9386}, {37.6175, 55.7559},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("unexpected result size: %d", len(found))
+	}
+	for i, want := range []int{1, 0, 1} {
+		if len(found[i]) != want {
+			t.Errorf("point %d: unexpected places: %v", i, found[i])
+		}
+	}
+	if found[0][0].Circle == nil || found[0][0] == found[2][0] {
+		t.Errorf("unexpected place: %#v", found[0][0])
+	}
+	// точки проверяются несколькими пакетами
+	points := make([]geo.Point, 2*containingBatchSize+1)
+	for i := range points {
+		if points[i] = (geo.Point{30.3141, 59.9386}); i%3 == 0 {
+			points[i] = circle.Center
+		}
+	}
+	if found, err = places.ContainingAny("group", points); err != nil {
+		t.Fatal(err)
+	}
+	for i := range points {
+		want := 0
+		if i%3 == 0 {
+			want = 1
+		}
+		if len(found[i]) != want {
+			t.Errorf("point %d: unexpected places: %v", i, found[i])
+		}
+	}
+}
+
+func TestPlacesContainingLine(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	route := &Line{
+		Points: []geo.Point{{37.60, 55.75}, {37.62, 55.75}, {37.62, 55.76}},
+		Width:  200,
+	}
+	if err := places.Create("group", &Place{ID: "route", Line: route}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		point geo.Point
+		found bool
+	}{
+		{geo.Point{37.61, 55.75}, true},
+		{geo.Point{37.62, 55.755}, true},
+		{geo.Point{37.61, 55.76}, false},
+	} {
+		list, err := places.Containing("group", test.point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(list) == 1) != test.found {
+			t.Errorf("%v: unexpected places: %v", test.point, list)
+		}
+	}
+}
+
+func TestPlacesContainingPolygons(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	place := &Place{ID: "buildings", Polygons: []geo.Polygon{
+		{{{37.60, 55.75}, {37.61, 55.75}, {37.61, 55.76}, {37.60, 55.76}, {37.60, 55.75}}},
+		{{{37.70, 55.75}, {37.71, 55.75}, {37.71, 55.76}, {37.70, 55.76}, {37.70, 55.75}}},
+	}}
+	if err := places.Create("group", place); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		point geo.Point
+		found bool
+	}{
+		{geo.Point{37.605, 55.755}, true},
+		{geo.Point{37.705, 55.755}, true},
+		{geo.Point{37.655, 55.755}, false},
+	} {
+		list, err := places.Containing("group", test.point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(list) == 1) != test.found {
+			t.Errorf("%v: unexpected places: %v", test.point, list)
+		}
+	}
+}
+
+func TestPlacesBulkCreate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	bad := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: -1}
+	errs, err := places.BulkCreate("group", []*Place{
+		{ID: "1", Circle: &circle},
+		{ID: "2", Circle: &bad},
+		{ID: "3"},
+		{ID: "1", Circle: &circle},
+		{ID: "4", Circle: &circle},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 5 || errs[0] != nil || errs[1] != ErrInvalidRadius ||
+		errs[2] != ErrBadPlaceData || !errors.Is(errs[3], ErrDuplicate) || errs[4] != nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if n, err := places.Count("group"); err != nil || n != 2 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+}
+
+func TestPlacesOverlapping(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	route := &Line{
+		Points: []geo.Point{{37.60, 55.75}, {37.62, 55.75}},
+		Width:  200,
+	}
+	for groupId, list := range map[string][]*Place{
+		"group": {
+			{ID: "center", Circle: &geo.Circle{Center: geo.Point{37.61, 55.75}, Radius: 500}},
+			{ID: "near", Circle: &geo.Circle{Center: geo.Point{37.61, 55.754}, Radius: 400}},
+			{ID: "far", Circle: &geo.Circle{Center: geo.Point{37.70, 55.80}, Radius: 300}},
+			{ID: "route", Line: route},
+		},
+		"other": {
+			{ID: "foreign", Circle: &geo.Circle{Center: geo.Point{37.61, 55.75}, Radius: 500}},
+		},
+	} {
+		for _, place := range list {
+			if err := places.Create(groupId, place); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list, err := places.Overlapping("group", "center")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, place := range list {
+		ids[place.ID] = true
+	}
+	if len(list) != 2 || !ids["near"] || !ids["route"] {
+		t.Errorf("unexpected places: %v", list)
+	}
+	if list, err = places.Overlapping("group", "route"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected places for route: %v", list)
+	}
+	if _, err := places.Overlapping("group", "unknown"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPlacesDevicesEntered(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places, events := db.Places(), db.Events()
+	fence := &Place{ID: "fence", Circle: &geo.Circle{Center: geo.Point{37.61, 55.75}, Radius: 500}}
+	if err := places.Create("group", fence); err != nil {
+		t.Fatal(err)
+	}
+	route := &Place{ID: "route", Line: &Line{
+		Points: []geo.Point{{37.60, 55.75}, {37.62, 55.75}},
+		Width:  200,
+	}}
+	if err := places.Create("group", route); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	inside, outside := &geo.Point{37.611, 55.751}, &geo.Point{37.70, 55.80}
+	for deviceId, event := range map[string]*Event{
+		"entered": {Time: now.Add(-time.Hour), Location: inside},
+		"outside": {Time: now.Add(-time.Hour), Location: outside},
+		"earlier": {Time: now.Add(-48 * time.Hour), Location: inside},
+		"nowhere": {Time: now.Add(-time.Hour)},
+	} {
+		if err := events.Create("group", deviceId, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := events.Create("other", "foreign", &Event{Time: now, Location: inside}); err != nil {
+		t.Fatal(err)
+	}
+	deleted := &Event{Time: now.Add(-time.Hour), Location: inside}
+	if err := events.Create("group", "deleted", deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.SoftDelete("group", "deleted", deleted.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	for _, placeId := range []string{"fence", "route"} {
+		devices, err := places.DevicesEntered("group", placeId, now.Add(-24*time.Hour), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || devices[0] != "entered" {
+			t.Errorf("%s: unexpected devices: %v", placeId, devices)
+		}
+	}
+	devices, err := places.DevicesEntered("group", "fence", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0] != "earlier" || devices[1] != "entered" {
+		t.Errorf("unexpected devices: %v", devices)
+	}
+	if _, err := places.DevicesEntered("other", "fence", time.Time{}, time.Time{}); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPlacesRename(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	place := &Place{ID: "fence", Name: "Old",
+		Circle: &geo.Circle{Center: geo.Point{37.61, 55.75}, Radius: 500}}
+	if err := places.Create("group", place); err != nil {
+		t.Fatal(err)
+	}
+	if err := places.Rename("group", "fence", "New"); err != nil {
+		t.Fatal(err)
+	}
+	if err := places.Rename("other", "fence", "New"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	stored, err := places.Get("group", "fence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "New" || stored.Circle == nil || *stored.Circle != *place.Circle ||
+		stored.Version != place.Version+1 {
+		t.Errorf("unexpected renamed place: %v", stored)
+	}
+	// изменение описания с прежней версией не должно затереть новое имя
+	if err := places.Update("group", place); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	found, err := places.Containing("group", geo.Point{37.61, 55.75})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Name != "New" {
+		t.Errorf("geometry lost after rename: %v", found)
+	}
+}
+
+func TestPlacesReindexGeometry(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	polygon := geo.Polygon{{{37.60, 55.75}, {37.61, 55.75}, {37.61, 55.76}, {37.60, 55.76}, {37.60, 55.75}}}
+	for _, place := range []*Place{
+		{ID: "circle", Circle: &geo.Circle{Center: geo.Point{37.70, 55.80}, Radius: 500}},
+		{ID: "polygon", Polygon: &polygon},
+	} {
+		if err := places.Create("group", place); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coll := db.session.DB(db.name).C(CollectionPlaces)
+	// портим сохраненную геометрию и добавляем место без описания геометрии
+	stale := bson.M{"type": "Point", "coordinates": []float64{0, 0}}
+	if _, err := coll.UpdateAll(bson.M{"groupId": "group"}, bson.M{"$set": bson.M{"geo": stale}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Insert(bson.M{"_id": "empty", "groupId": "group", "name": "Empty"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := places.Get("group", "circle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, skipped, err := places.ReindexGeometry("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 2 {
+		t.Errorf("unexpected updated: %d", updated)
+	}
+	if len(skipped) != 1 || skipped[0] != "empty" {
+		t.Errorf("unexpected skipped: %v", skipped)
+	}
+	for id, point := range map[string]geo.Point{
+		"circle":  {37.70, 55.80},
+		"polygon": {37.605, 55.755},
+	} {
+		found, err := places.Containing("group", point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].ID != id {
+			t.Errorf("%s: geometry is not restored: %v", id, found)
+		}
+	}
+	reindexed, err := places.Get("group", "circle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reindexed.Version != stored.Version || !reindexed.UpdatedAt.Equal(stored.UpdatedAt) {
+		t.Errorf("place description is changed: %v", reindexed)
+	}
+}
+
+func TestPlacesSearch(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	for _, place := range []*Place{
+		{ID: "1", Name: "Office (main)"},
+		{ID: "2", Name: "office main"},
+		{ID: "3", Name: "Home"},
+	} {
+		place.Circle = &geo.Circle{Center: geo.Point{37.61, 55.75}, Radius: 100}
+		if err := places.Create("group", place); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := places.Search("group", "OFFICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("unexpected places: %v", list)
+	}
+	for _, place := range list {
+		if place.Geo != nil || place.Circle == nil {
+			t.Errorf("unexpected place fields: %v", place)
+		}
+	}
+	if list, err = places.Search("group", "(main)"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "1" {
+		t.Errorf("unexpected places: %v", list)
+	}
+	if list, err = places.Search("group", "park"); err != nil {
+		t.Fatal(err)
+	}
+	if list == nil || len(list) != 0 {
+		t.Errorf("unexpected places: %v", list)
+	}
+}
+
+func TestPlacesUpsertVersion(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	places := db.Places()
+	circle := geo.Circle{Center: geo.Point{37.6173, 55.7558}, Radius: 500}
+	place := &Place{ID: "id", Name: "first", Circle: &circle}
+	if err := places.Create("group", place); err != nil {
+		t.Fatal(err)
+	}
+	if err := places.Update("group", place); err != nil {
+		t.Fatal(err)
+	}
+	stale := *place
+	polygon := geo.Polygon{{{37.60, 55.75}, {37.61, 55.75}, {37.61, 55.76}, {37.60, 55.76}, {37.60, 55.75}}}
+	upserted := &Place{ID: "id", Name: "upserted", Polygon: &polygon}
+	if _, err := places.Upsert("group", upserted); err != nil {
+		t.Fatal(err)
+	}
+	if upserted.Version != place.Version+1 {
+		t.Errorf("unexpected upserted version: %d", upserted.Version)
+	}
+	if err := places.Update("group", &stale); err != ErrVersionConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	stored, err := places.Get("group", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "upserted" || stored.Polygon == nil || stored.Circle != nil ||
+		stored.Version != upserted.Version || !stored.CreatedAt.Equal(place.CreatedAt) {
+		t.Errorf("unexpected stored place: %v", stored)
+	}
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+// UserStore описывает основные операции с данными о пользователях. Ему
+// удовлетворяют как Users, работающий с MongoDB, так и хранилище в памяти,
+// возвращаемое NewMemory.
+type UserStore interface {
+	Login(login string) (*User, error)
+	Authenticate(login, password string) (*User, error)
+	Get(groupId, login string) (*User, error)
+	List(groupId string) ([]User, error)
+	Count(groupId string) (int, error)
+	Create(user *User) error
+	Update(user User) error
+	SetName(login, name string) error
+	ChangePassword(login, oldPassword, newPassword string) error
+	ChangeGroup(login, newGroupId string) error
+	Delete(login string) error
+}
+
+// DeviceStore описывает основные операции с данными об устройствах.
+type DeviceStore interface {
+	Login(id string) (*Device, error)
+	Authenticate(id, password string) (*Device, error)
+	Get(groupId, id string) (*Device, error)
+	List(groupId string) ([]*Device, error)
+	Search(groupId, query string) ([]*Device, error)
+	Count(groupId string) (int, error)
+	LastSeen(groupId, id string) (time.Time, error)
+	Create(groupId string, device *Device) error
+	Update(groupId string, device *Device) error
+	Upsert(groupId string, device *Device) (bool, error)
+	Rename(groupId, id, name string) error
+	SetPassword(groupId, id, password string) error
+	ChangeGroup(oldGroupId, id, newGroupId string) error
+	Delete(groupId, id string) error
+	DeleteWithEvents(groupId, id string) error
+}
+
+// EventStore описывает основные операции с данными о событиях.
+type EventStore interface {
+	Get(groupId, deviceId, id string) (*Event, error)
+	List(groupId, deviceId string) ([]*Event, error)
+	ListByType(groupId, deviceId string, types ...string) ([]*Event, error)
+	Count(groupId, deviceId string) (int, error)
+	CountByTime(groupId, deviceId string, from, to time.Time) (int, error)
+	LatestPerDevice(groupId string) (map[string]*Event, error)
+	Devices(groupId string) ([]string, error)
+	Create(groupId, deviceId string, events ...*Event) error
+	Update(groupId, deviceId string, event *Event) error
+	SoftDelete(groupId, deviceId, id string) error
+	ListDeleted(groupId, deviceId string) ([]*Event, error)
+	Delete(groupId, deviceId, id string) error
+	DeletePurgeForDevice(groupId, deviceId string) (int, error)
+}
+
+// PlaceStore описывает основные операции с данными о местах.
+type PlaceStore interface {
+	Get(groupId, id string) (*Place, error)
+	List(groupId string) ([]*Place, error)
+	Search(groupId, query string) ([]*Place, error)
+	Count(groupId string) (int, error)
+	Containing(groupId string, p geo.Point) ([]*Place, error)
+	ContainingAny(groupId string, points []geo.Point) (map[int][]*Place, error)
+	Create(groupId string, place *Place) error
+	Update(groupId string, place *Place) error
+	Upsert(groupId string, place *Place) (bool, error)
+	Rename(groupId, id, name string) error
+	Delete(groupId, id string) error
+}
+
+// Store описывает хранилище данных целиком. Код, который зависит только от
+// Store, может работать как с MongoDB (DB.Store), так и с хранилищем в памяти
+// (NewMemory) или любой другой реализацией, например, на основе PostGIS.
+type Store interface {
+	Users() UserStore
+	Devices() DeviceStore
+	Events() EventStore
+	Places() PlaceStore
+}
+
+// Store возвращает хранилище MongoDB в виде интерфейса Store. Методы DB.Users,
+// DB.Devices и т.д. продолжают возвращать конкретные типы, у которых помимо
+// методов интерфейсов есть варианты с контекстом и специфичные для MongoDB
+// запросы.
+func (db *DB) Store() Store {
+	return mgoStore{db}
+}
+
+// mgoStore реализует Store для хранилища MongoDB.
+type mgoStore struct {
+	db *DB
+}
+
+func (s mgoStore) Users() UserStore     { return s.db.Users() }
+func (s mgoStore) Devices() DeviceStore { return s.db.Devices() }
+func (s mgoStore) Events() EventStore   { return s.db.Events() }
+func (s mgoStore) Places() PlaceStore   { return s.db.Places() }
+
+// проверяем, что реализации хранилищ удовлетворяют интерфейсам
+var (
+	_ UserStore   = (*Users)(nil)
+	_ DeviceStore = (*Devices)(nil)
+	_ EventStore  = (*Events)(nil)
+	_ PlaceStore  = (*Places)(nil)
+	_ Store       = mgoStore{}
+	_ Store       = (*Memory)(nil)
+)
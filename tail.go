@@ -0,0 +1,118 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tailTimeout задает, как долго Events.Tail ждет новые события, прежде чем
+// проверить, не отменен ли контекст.
+const tailTimeout = time.Second
+
+// SetupEventsTail создает ограниченную по размеру (capped) коллекцию
+// CollectionEventsTail размером size байт, если ее еще нет, и включает
+// копирование в нее всех новых событий, добавляемых через это описание
+// хранилища. Это позволяет получать новые события с помощью Events.Tail, когда
+// change streams (Events.Watch) недоступны, например, на одиночном сервере
+// MongoDB.
+//
+// Копирование включается только для этого описания хранилища, поэтому метод
+// должен вызываться при инициализации в каждом процессе, добавляющем события.
+// Копируются события, добавленные методами Create, CreateEvaluate, Upsert и
+// BulkCreate (последним — только при успешной вставке всех событий). Ошибки
+// копирования игнорируются: основная коллекция событий остается единственным
+// надежным источником данных.
+//
+// По сравнению с change streams у такого подхода есть недостатки: каждое
+// событие записывается дважды, старые события вытесняются из коллекции при
+// достижении размера size, изменения и удаления событий не отслеживаются, а
+// события, добавленные в обход этого описания хранилища, в коллекцию не
+// попадают. Зато он работает с любой версией и конфигурацией MongoDB.
+func (db *DB) SetupEventsTail(size int) error {
+	return db.SetupEventsTailContext(context.Background(), size)
+}
+
+// SetupEventsTailContext работает как SetupEventsTail, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *DB) SetupEventsTailContext(ctx context.Context, size int) error {
+	err := db.exec(ctx, CollectionEventsTail, func(coll *mgo.Collection) error {
+		err := coll.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: size})
+		// коллекция уже существует (NamespaceExists)
+		if e, ok := err.(*mgo.QueryError); ok && e.Code == 48 {
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		db.tail = true
+	}
+	return err
+}
+
+// mirror копирует добавленные события в CollectionEventsTail, если это
+// включено с помощью DB.SetupEventsTail. Ошибки копирования игнорируются.
+func (db *Events) mirror(mdb *mgo.Database, objs ...interface{}) {
+	if db.tail && len(objs) > 0 {
+		(*DB)(db).c(mdb, CollectionEventsTail).Insert(objs...)
+	}
+}
+
+// Tail возвращает итератор по новым событиям устройства, которые будут
+// добавлены после его создания. В отличие от обычного итератора, метод Next
+// не возвращает false, когда события заканчиваются, а ждет добавления новых
+// событий. Перебор прекращается только при ошибке, отмене контекста (см.
+// TailContext) или вызове Close, который обязательно должен быть вызван по
+// окончании работы.
+//
+// События читаются из коллекции CollectionEventsTail с помощью tailable
+// cursor, поэтому предварительно должен быть вызван DB.SetupEventsTail. Если
+// итератор читает события медленнее, чем они добавляются, и коллекция успевает
+// переполниться, то часть событий будет пропущена.
+//
+// События возвращаются в порядке их добавления в коллекцию, а не в порядке
+// идентификаторов, поэтому события, одновременно добавленные разными
+// процессами, не пропускаются, даже если их идентификаторы созданы не по
+// порядку.
+func (db *Events) Tail(groupID, deviceId string) (*EventIter, error) {
+	return db.TailContext(context.Background(), groupID, deviceId)
+}
+
+// TailContext работает как Tail, но ожидание новых событий прекращается при
+// отмене контекста. Отмена обнаруживается с задержкой до одной секунды.
+func (db *Events) TailContext(ctx context.Context, groupID, deviceId string) (*EventIter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := db.session.Copy()
+	coll := (*DB)(db).c(session.DB(db.name), CollectionEventsTail)
+	// пропускаем события, добавленные до создания итератора
+	var last Event
+	err := coll.Find(nil).Select(bson.M{"_id": 1}).Sort("-$natural").One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		session.Close()
+		return nil, err
+	}
+	// идентификаторы событий, созданных разными процессами, не обязательно
+	// возрастают в порядке вставки, поэтому чтение возобновляется в порядке
+	// вставки: вместе с событиями устройства запрашивается последнее
+	// прочитанное событие, и все события до него включительно пропускаются
+	retail := func(last bson.ObjectId) *mgo.Iter {
+		query := bson.M{"groupId": groupID, "deviceId": deviceId}
+		if last.Valid() {
+			query = bson.M{"$or": []bson.M{query, {"_id": last}}}
+		}
+		return coll.Find(query).Select(bson.M{"groupId": 0, "deviceId": 0}).
+			Tail(tailTimeout)
+	}
+	return &EventIter{
+		ctx:     ctx,
+		session: session,
+		iter:    retail(last.ID),
+		retail:  retail,
+		last:    last.ID,
+		resume:  last.ID.Valid(),
+	}, nil
+}
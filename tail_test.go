@@ -0,0 +1,73 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventsTail(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	if err := db.SetupEventsTail(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	// повторный вызов не должен приводить к ошибке
+	if err := db.SetupEventsTail(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	events := db.Events()
+	if err := events.Create("group", "device", &Event{Comment: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	iter, err := events.TailContext(ctx, "group", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, deviceId := range []string{"device", "other", "device"} {
+		if err := events.Create("group", deviceId, &Event{Comment: "new"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var event Event
+	for i := 0; i < 2; i++ {
+		if !iter.Next(&event) {
+			t.Fatalf("event %d is not received: %v", i, iter.Err())
+		}
+		if event.Comment != "new" || event.DeviceID != "" {
+			t.Errorf("unexpected event: %#v", event)
+		}
+	}
+	if iter.Next(&event) {
+		t.Errorf("unexpected event: %#v", event)
+	}
+	if err := iter.Close(); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// событие, добавленное после создания итератора, возвращается, даже если
+	// его идентификатор меньше идентификатора последнего события в коллекции
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if iter, err = events.TailContext(ctx, "group", "device"); err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	earlier := &Event{
+		ID:       bson.NewObjectIdWithTime(time.Now().Add(-time.Hour)),
+		GroupID:  "group",
+		DeviceID: "device",
+		Time:     time.Now().UTC(),
+		Comment:  "earlier",
+	}
+	if err := db.session.DB(db.name).C(CollectionEventsTail).Insert(earlier); err != nil {
+		t.Fatal(err)
+	}
+	if !iter.Next(&event) || event.ID != earlier.ID {
+		t.Errorf("event is not received: %#v, %v", event, iter.Err())
+	}
+}
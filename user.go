@@ -1,60 +1,373 @@
 package model
 
 import (
+	"context"
+	"time"
+
 	"github.com/geotrace/uid"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-type Users DB // для обращения к данным о зарегистрированных пользователях
+// Users предоставляет доступ к данным о зарегистрированных пользователях.
+// Получить его можно с помощью метода DB.Users.
+type Users DB
 
 // Login возвращает информацию о пользователе по его логину.
 func (db *Users) Login(userID string) (user *User, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionUsers)
-	err = coll.FindId(userID).One(&user)
-	session.Close()
+	return db.LoginContext(context.Background(), userID)
+}
+
+// LoginContext работает как Login, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) LoginContext(ctx context.Context, userID string) (user *User, err error) {
+	result := new(User)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.FindId(userID).One(result)
+	})
+	if err == nil {
+		user = result
+	}
+	return
+}
+
+// Authenticate проверяет пароль пользователя и возвращает информацию о нем,
+// если пароль верен. Хеш пароля в возвращаемом описании не заполняется. Если
+// пользователь не найден, то возвращается ErrNotFound, а если пароль неверен —
+// ErrWrongPassword.
+func (db *Users) Authenticate(login, password string) (user *User, err error) {
+	return db.AuthenticateContext(context.Background(), login, password)
+}
+
+// AuthenticateContext работает как Authenticate, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Users) AuthenticateContext(ctx context.Context, login, password string) (user *User, err error) {
+	result, err := db.LoginContext(ctx, login)
+	if err != nil {
+		return
+	}
+	if !result.Password.Compare(password) {
+		err = ErrWrongPassword
+		return
+	}
+	result.Password = nil
+	user = result
+	return
+}
+
+// Get возвращает информацию о пользователе с указанным логином, который
+// зарегистрирован в указанной группе. Хеш пароля пользователя не возвращается.
+func (db *Users) Get(groupId, login string) (user *User, err error) {
+	return db.GetContext(context.Background(), groupId, login)
+}
+
+// GetContext работает как Get, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) GetContext(ctx context.Context, groupId, login string) (user *User, err error) {
+	result := new(User)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": login, "groupId": groupId}).
+			Select(bson.M{"password": 0, "groupId": 0}).One(result)
+	})
+	if err == nil {
+		user = result
+	} else {
+		err = notFound(err, CollectionUsers, groupId, login)
+	}
+	return
+}
+
+// GetFields работает как Get, но возвращает только указанные поля пользователя
+// (названия задаются так же, как в хранилище), что позволяет сократить объем
+// передаваемых данных. Хеш пароля запросить нельзя: для него,
+// как и для неизвестных полей, возвращается ErrBadField.
+func (db *Users) GetFields(groupId, login string, fields ...string) (user *User, err error) {
+	return db.GetFieldsContext(context.Background(), groupId, login, fields...)
+}
+
+// GetFieldsContext работает как GetFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Users) GetFieldsContext(ctx context.Context, groupId, login string, fields ...string) (user *User, err error) {
+	selector, err := fieldSelector((*User)(nil), fields, "password")
+	if err != nil {
+		return
+	}
+	result := new(User)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": login, "groupId": groupId}).Select(selector).One(result)
+	})
+	if err == nil {
+		user = result
+	} else {
+		err = notFound(err, CollectionUsers, groupId, login)
+	}
+	return
+}
+
+// ListFields работает как List, но возвращает только указанные поля
+// пользователя так же, как GetFields.
+func (db *Users) ListFields(groupID string, fields ...string) (users []User, err error) {
+	return db.ListFieldsContext(context.Background(), groupID, fields...)
+}
+
+// ListFieldsContext работает как ListFields, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Users) ListFieldsContext(ctx context.Context, groupID string, fields ...string) (users []User, err error) {
+	selector, err := fieldSelector((*User)(nil), fields, "password")
+	if err != nil {
+		return
+	}
+	result := make([]User, 0)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).Select(selector).All(&result)
+	})
+	if err == nil {
+		users = result
+	}
 	return
 }
 
 // List возвращает список всех пользователей, зарегистрированных в указанной
 // группе.
 func (db *Users) List(groupID string) (users []User, err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionUsers)
-	users = make([]User, 0)
-	err = coll.Find(bson.M{"groupId": groupID}).
-		Select(bson.M{"password": 0, "groupId": 0}).All(&users)
-	session.Close()
+	return db.ListContext(context.Background(), groupID)
+}
+
+// ListContext работает как List, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) ListContext(ctx context.Context, groupID string) (users []User, err error) {
+	result := make([]User, 0)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"groupId": groupID}).
+			Select(bson.M{"password": 0, "groupId": 0}).All(&result)
+	})
+	if err == nil {
+		users = result
+	}
 	return
 }
 
+// Count возвращает количество пользователей, зарегистрированных в указанной группе.
+func (db *Users) Count(groupId string) (count int, err error) {
+	return db.CountContext(context.Background(), groupId)
+}
+
+// CountContext работает как Count, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) CountContext(ctx context.Context, groupId string) (count int, err error) {
+	return (*DB)(db).countGroup(ctx, CollectionUsers, groupId)
+}
+
 // Create создает нового пользователя по его описанию. Поле Login должно быть
-// уникальным, в противном случае возвращается ошибка.
+// уникальным, в противном случае возвращается ошибка. Если роль пользователя
+// не указана, то ему назначается RoleMember, а если указана неизвестная роль,
+// то возвращается ErrBadRole.
 func (db *Users) Create(user *User) (err error) {
+	return db.CreateContext(context.Background(), user)
+}
+
+// CreateContext работает как Create, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) CreateContext(ctx context.Context, user *User) (err error) {
+	if err = user.prepareRole(); err != nil {
+		return
+	}
 	if user.Login == "" {
 		user.Login = uid.New()
 	}
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionUsers)
-	err = coll.Insert(user)
-	session.Close()
+	now := time.Now().UTC()
+	user.CreatedAt, user.UpdatedAt = now, now
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return duplicate(coll.Insert(user))
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditCreate, CollectionUsers, user.GroupID, user.Login)
+	}
 	return
 }
 
-// Update обновляет информацию о пользователе в хранилище.
+// Update обновляет информацию о пользователе в хранилище. Роль проверяется так
+// же, как в Create.
 func (db *Users) Update(user User) (err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionUsers)
-	err = coll.UpdateId(user.Login, user)
-	session.Close()
+	return db.UpdateContext(context.Background(), user)
+}
+
+// UpdateContext работает как Update, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) UpdateContext(ctx context.Context, user User) (err error) {
+	if err = user.prepareRole(); err != nil {
+		return
+	}
+	user.UpdatedAt = time.Now().UTC()
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) (err error) {
+		if user.CreatedAt.IsZero() {
+			if user.CreatedAt, err = storedCreatedAt(coll, user.Login); err != nil {
+				return
+			}
+		}
+		return coll.UpdateId(user.Login, user)
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionUsers, user.GroupID, user.Login)
+	}
+	return
+}
+
+// ChangePassword изменяет пароль пользователя, предварительно проверив, что
+// указанный старый пароль совпадает с сохраненным. Если пользователь не найден,
+// то возвращается ErrNotFound, а если старый пароль неверен — ErrWrongPassword.
+//
+// Новый хеш пароля сохраняется только в том случае, если сохраненный пароль не
+// изменился с момента проверки: при одновременной смене пароля будет возвращена
+// ошибка ErrNotFound.
+func (db *Users) ChangePassword(login, oldPassword, newPassword string) (err error) {
+	return db.ChangePasswordContext(context.Background(), login, oldPassword, newPassword)
+}
+
+// ChangePasswordContext работает как ChangePassword, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Users) ChangePasswordContext(ctx context.Context, login, oldPassword, newPassword string) (err error) {
+	passwd, err := NewPassword(newPassword)
+	if err != nil {
+		return
+	}
+	var user User
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		err := coll.FindId(login).Select(bson.M{"password": 1, "groupId": 1}).One(&user)
+		if err != nil {
+			return err
+		}
+		if !user.Password.Compare(oldPassword) {
+			return ErrWrongPassword
+		}
+		return coll.Update(bson.M{"_id": login, "password": user.Password},
+			bson.M{"$set": bson.M{"password": passwd, "updatedAt": time.Now().UTC()}})
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionUsers, user.GroupID, login)
+	}
+	return
+}
+
+// ListByRole возвращает список пользователей группы с указанной ролью.
+// Пользователи, сохраненные без роли, считаются участниками (RoleMember).
+func (db *Users) ListByRole(groupId, role string) (users []User, err error) {
+	return db.ListByRoleContext(context.Background(), groupId, role)
+}
+
+// ListByRoleContext работает как ListByRole, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Users) ListByRoleContext(ctx context.Context, groupId, role string) (users []User, err error) {
+	query := bson.M{"groupId": groupId, "role": role}
+	switch role {
+	case RoleAdmin:
+	case RoleMember:
+		query["role"] = bson.M{"$in": []interface{}{RoleMember, nil}}
+	default:
+		err = ErrBadRole
+		return
+	}
+	result := make([]User, 0)
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.Find(query).Select(bson.M{"password": 0, "groupId": 0}).All(&result)
+	})
+	if err == nil {
+		users = result
+	}
+	return
+}
+
+// IsAdmin возвращает true, если пользователь с указанным логином является
+// администратором своей группы. Если пользователь не зарегистрирован, то
+// возвращается ErrNotFound.
+func (db *Users) IsAdmin(login string) (admin bool, err error) {
+	return db.IsAdminContext(context.Background(), login)
+}
+
+// IsAdminContext работает как IsAdmin, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Users) IsAdminContext(ctx context.Context, login string) (admin bool, err error) {
+	var result User
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		return coll.FindId(login).Select(bson.M{"role": 1}).One(&result)
+	})
+	if err == nil {
+		admin = result.Role == RoleAdmin
+	}
+	return
+}
+
+// SetName изменяет только имя пользователя, не затрагивая остальные поля
+// описания, в том числе пароль. Пустое имя удаляет его. Если пользователь с
+// таким логином не зарегистрирован, то возвращается ErrNotFound.
+func (db *Users) SetName(login, name string) (err error) {
+	return db.SetNameContext(context.Background(), login, name)
+}
+
+// SetNameContext работает как SetName, но позволяет прервать выполнение
+// запроса с помощью контекста.
+func (db *Users) SetNameContext(ctx context.Context, login, name string) (err error) {
+	var user User
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		_, err := coll.FindId(login).Select(bson.M{"groupId": 1}).
+			Apply(mgo.Change{Update: renameUpdate(name)}, &user)
+		return err
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionUsers, user.GroupID, login)
+	}
+	return
+}
+
+// ChangeGroup переводит пользователя в другую группу. Если пользователь с
+// таким логином не зарегистрирован, то возвращается ErrNotFound. Пустой
+// идентификатор группы не допускается: в этом случае возвращается
+// ErrBadGroupId.
+func (db *Users) ChangeGroup(login, newGroupId string) (err error) {
+	return db.ChangeGroupContext(context.Background(), login, newGroupId)
+}
+
+// ChangeGroupContext работает как ChangeGroup, но позволяет прервать
+// выполнение запроса с помощью контекста.
+func (db *Users) ChangeGroupContext(ctx context.Context, login, newGroupId string) (err error) {
+	if newGroupId == "" {
+		err = ErrBadGroupId
+		return
+	}
+	// прежняя группа нужна для журнала изменений
+	var user User
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		_, err := coll.FindId(login).Select(bson.M{"groupId": 1}).
+			Apply(mgo.Change{Update: bson.M{"$set": bson.M{
+				"groupId":   newGroupId,
+				"updatedAt": time.Now().UTC(),
+			}}}, &user)
+		return err
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionUsers, user.GroupID, login)
+		(*DB)(db).audit(ctx, AuditUpdate, CollectionUsers, newGroupId, login)
+	}
 	return
 }
 
 // Delete удаляет пользователя с указанным логином из хранилища.
 func (db *Users) Delete(login string) (err error) {
-	session := db.session.Copy()
-	coll := session.DB(db.name).C(CollectionUsers)
-	err = coll.RemoveId(login)
-	session.Close()
+	return db.DeleteContext(context.Background(), login)
+}
+
+// DeleteContext работает как Delete, но позволяет прервать выполнение запроса с
+// помощью контекста.
+func (db *Users) DeleteContext(ctx context.Context, login string) (err error) {
+	// группа удаленного пользователя нужна для журнала изменений
+	var user User
+	err = (*DB)(db).exec(ctx, CollectionUsers, func(coll *mgo.Collection) error {
+		_, err := coll.FindId(login).Select(bson.M{"groupId": 1}).
+			Apply(mgo.Change{Remove: true}, &user)
+		return err
+	})
+	if err == nil {
+		(*DB)(db).audit(ctx, AuditDelete, CollectionUsers, user.GroupID, login)
+	}
 	return
 }
@@ -0,0 +1,247 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUsersChangePassword(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	passwd, err := NewPassword("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(&User{Login: "login", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ChangePassword("login", "wrong", "new"); err != ErrWrongPassword {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.ChangePassword("unknown", "old", "new"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.ChangePassword("login", "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.Login("login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Password.Compare("new") {
+		t.Error("password is not changed")
+	}
+}
+
+func TestUsersChangeGroup(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	if err := users.Create(&User{Login: "login", GroupID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ChangeGroup("login", ""); err != ErrBadGroupId {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.ChangeGroup("unknown", "new"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := users.ChangeGroup("login", "new"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := users.List("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Login != "login" {
+		t.Errorf("user is not in the new group: %v", list)
+	}
+	if list, err = users.List("old"); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("user is still in the old group: %v", list)
+	}
+}
+
+func TestUsersGet(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Create(&User{Login: "login", GroupID: "group", Password: passwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.Get("group", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "login" || len(user.Password) != 0 {
+		t.Errorf("unexpected user: %#v", user)
+	}
+	_, err = users.Get("other", "login")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Collection != CollectionUsers ||
+		notFound.ID != "login" || notFound.GroupID != "other" {
+		t.Errorf("unexpected not found error: %#v", err)
+	}
+}
+
+func TestUsersAuthenticate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	passwd, err := NewPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(&User{Login: "login", Password: passwd}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.Authenticate("login", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "login" || user.Password != nil {
+		t.Errorf("unexpected user: %#v", user)
+	}
+	if _, err := users.Authenticate("login", "wrong"); err != ErrWrongPassword {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := users.Authenticate("unknown", "secret"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUsersTimestamps(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	user := &User{Login: "login", GroupID: "group"}
+	if err := users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	if user.CreatedAt.IsZero() || !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Errorf("unexpected timestamps: %v, %v", user.CreatedAt, user.UpdatedAt)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := users.Update(User{Login: "login", GroupID: "group", Name: "Name"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := users.Get("group", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CreatedAt.Equal(user.CreatedAt.Truncate(time.Millisecond)) {
+		t.Errorf("created time changed: %v != %v", stored.CreatedAt, user.CreatedAt)
+	}
+	if !stored.UpdatedAt.After(stored.CreatedAt) {
+		t.Errorf("updated time not changed: %v", stored.UpdatedAt)
+	}
+}
+
+func TestUsersSetName(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	passwd, err := NewPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Create(&User{Login: "login", GroupID: "group", Password: passwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetName("login", "Name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetName("unknown", "Name"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	user, err := users.Authenticate("login", "password")
+	if err != nil {
+		t.Fatalf("password lost after rename: %v", err)
+	}
+	if user.Name != "Name" {
+		t.Errorf("unexpected name: %q", user.Name)
+	}
+}
+
+func TestUsersCreateDuplicate(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	if err := users.Create(&User{Login: "login", GroupID: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	err := users.Create(&User{Login: "login", GroupID: "other"})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !mgo.IsDup(errors.Unwrap(err)) {
+		t.Errorf("original error is lost: %v", err)
+	}
+}
+
+func TestUsersRoles(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	users := db.Users()
+	for _, user := range []*User{
+		{Login: "admin", GroupID: "group", Role: RoleAdmin},
+		{Login: "member", GroupID: "group"},
+		{Login: "other", GroupID: "other", Role: RoleAdmin},
+	} {
+		if err := users.Create(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Create(&User{Login: "root", Role: "root"}); err != ErrBadRole {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// пользователь, сохраненный до появления ролей
+	err := db.session.DB(db.name).C(CollectionUsers).Insert(
+		bson.M{"_id": "legacy", "groupId": "group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admins, err := users.ListByRole("group", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admins) != 1 || admins[0].Login != "admin" {
+		t.Errorf("unexpected admins: %v", admins)
+	}
+	members, err := users.ListByRole("group", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Errorf("unexpected members: %v", members)
+	}
+	if _, err := users.ListByRole("group", "root"); err != ErrBadRole {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for login, expected := range map[string]bool{
+		"admin": true, "member": false, "legacy": false,
+	} {
+		if admin, err := users.IsAdmin(login); err != nil || admin != expected {
+			t.Errorf("%s: unexpected admin: %v, %v", login, admin, err)
+		}
+	}
+	if _, err := users.IsAdmin("unknown"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"context"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EventStream описывает подписку на новые события группы, возвращаемую
+// Events.Watch. Новые события передаются через канал Events в порядке их
+// добавления в хранилище.
+//
+// Подписка удерживает отдельную сессию соединения с MongoDB, поэтому по
+// окончании работы с ней обязательно нужно вызвать Close, даже если канал
+// событий уже был закрыт из-за ошибки.
+type EventStream struct {
+	events  chan *Event
+	session *mgo.Session
+	iter    *mgo.Iter
+	stop    chan struct{} // закрывается при вызове Close
+	done    chan struct{} // закрывается по окончании чтения событий
+	once    sync.Once
+	reason  error // причина остановки, заданная при вызове close
+	err     error
+}
+
+// Events возвращает канал, через который передаются новые события. Канал
+// закрывается после вызова Close, отмены контекста или ошибки чтения: узнать
+// причину можно с помощью Err.
+func (s *EventStream) Events() <-chan *Event {
+	return s.events
+}
+
+// Err возвращает ошибку, из-за которой был закрыт канал событий. Если канал
+// закрыт вызовом Close, то возвращается nil, а если отменой контекста — ошибка
+// контекста. Значение имеет смысл только после закрытия канала.
+func (s *EventStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close прекращает получение событий, закрывает канал Events и освобождает
+// сессию соединения. Возвращает ошибку, если она случилась до остановки.
+func (s *EventStream) Close() error {
+	s.close(nil)
+	return s.err
+}
+
+// close останавливает подписку, запоминая причину остановки. Повторные вызовы
+// ничего не делают.
+func (s *EventStream) close(reason error) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.stop)
+		// закрытие курсора прерывает ожидание новых данных в run
+		s.iter.Close()
+		<-s.done
+		s.session.Close()
+	})
+}
+
+// run читает изменения из курсора и передает новые события в канал.
+func (s *EventStream) run() {
+	defer close(s.done)
+	defer close(s.events)
+	var change struct {
+		Event *Event `bson:"fullDocument"`
+	}
+read:
+	for s.iter.Next(&change) {
+		select {
+		case s.events <- change.Event:
+			change.Event = nil
+		case <-s.stop:
+			break read
+		}
+	}
+	select {
+	case <-s.stop:
+		// ошибка закрытого курсора при остановке не интересна
+		s.err = s.reason
+	default:
+		s.err = s.iter.Err()
+	}
+}
+
+// Watch подписывается на новые события группы и возвращает подписку, через
+// канал которой они передаются по мере добавления в хранилище. Учитываются
+// только добавленные события: изменения и удаления существующих событий
+// игнорируются.
+//
+// Для подписки используются change streams MongoDB, поэтому требуется MongoDB
+// версии 3.6 или выше, запущенная в виде набора реплик (replica set) или
+// кластера с шардированием; для одиночного сервера возвращается ошибка. Сервер
+// хранит изменения в oplog, поэтому если читать события из канала медленнее,
+// чем они добавляются, часть изменений может быть потеряна при переполнении
+// oplog: в этом случае канал закрывается с ошибкой.
+func (db *Events) Watch(groupID string) (*EventStream, error) {
+	return db.WatchContext(context.Background(), groupID)
+}
+
+// WatchContext работает как Watch, но подписка прекращается при отмене
+// контекста.
+func (db *Events) WatchContext(ctx context.Context, groupID string) (*EventStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := db.session.Copy()
+	// запрос агрегации выполняется сразу, поэтому ошибки, например, отсутствие
+	// поддержки change streams сервером, можно проверить до запуска чтения
+	iter := (*DB)(db).c(session.DB(db.name), CollectionEvents).Pipe([]bson.M{
+		{"$changeStream": bson.M{}},
+		{"$match": bson.M{
+			"operationType":        "insert",
+			"fullDocument.groupId": groupID,
+		}},
+	}).Iter()
+	if err := iter.Err(); err != nil {
+		iter.Close()
+		session.Close()
+		return nil, err
+	}
+	stream := &EventStream{
+		events:  make(chan *Event),
+		session: session,
+		iter:    iter,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go stream.run()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.close(ctx.Err())
+			case <-stream.done:
+			}
+		}()
+	}
+	return stream, nil
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventsWatch(t *testing.T) {
+	db := testDB(t)
+	defer closeTestDB(db)
+	events := db.Events()
+	stream, err := events.Watch("group")
+	if err != nil {
+		// change streams доступны только для набора реплик
+		t.Skip("change streams are not supported:", err)
+	}
+	for _, groupID := range []string{"other", "group"} {
+		if err := events.Create(groupID, "device", &Event{Comment: groupID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case event := <-stream.Events():
+		if event == nil || event.Comment != "group" {
+			t.Errorf("unexpected event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event is not received")
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-stream.Events(); ok {
+		t.Error("events channel is not closed")
+	}
+}